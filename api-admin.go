@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminKeyRequest is the body of a request to create an API key
+type adminKeyRequest struct {
+	Scopes      []string   `json:"scopes"`
+	Packages    []string   `json:"packages"`
+	Expires     *time.Time `json:"expires"`
+	Description string     `json:"description"`
+	Owner       string     `json:"owner"`
+}
+
+// adminKey is an API key as returned by the admin API, the key itself is only included when created or rotated
+type adminKey struct {
+	ID          string     `json:"id"`
+	Key         string     `json:"key,omitempty"`
+	Scopes      []string   `json:"scopes"`
+	Packages    []string   `json:"packages,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Expired     bool       `json:"expired"`
+	Description string     `json:"description,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+}
+
+// newAdminKey returns the admin API form of a key
+func newAdminKey(k *apiKey, key string) *adminKey {
+	return &adminKey{
+		ID:          k.Reference(),
+		Key:         key,
+		Scopes:      k.Scopes,
+		Packages:    k.Packages,
+		Expires:     k.Expires,
+		Expired:     k.Expired(),
+		Description: k.Description,
+		Owner:       k.Owner,
+		Created:     k.Created,
+	}
+}
+
+// ToBytes exports structure as byte array
+func (ak *adminKey) ToBytes() []byte {
+	b, _ := json.Marshal(ak)
+	return b
+}
+
+// adminKeyList is returned from a request to list the API keys
+type adminKeyList struct {
+	Keys []*adminKey `json:"keys"`
+}
+
+// ToBytes exports structure as byte array
+func (kl *adminKeyList) ToBytes() []byte {
+	b, _ := json.Marshal(kl)
+	return b
+}
+
+func serveAdmin(w http.ResponseWriter, r *http.Request, a *access) {
+
+	// Changes are audited once handled, the handlers fill in the action
+	sw := &statusWriter{ResponseWriter: w}
+	e := newAuditEvent(r, a, "")
+
+	// Bounce any request without admin access
+	if !a.Can(scopeAdmin) {
+		denyAccess(sw, a)
+		e.Action = auditAdmin
+		recordAudit(e, sw.Status())
+		return
+	}
+
+	// Split the path into {resource}/{id}/{action}
+	x := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, server.URL.Path+`admin/`), `/`), `/`)
+
+	// Route
+	switch {
+	case x[0] == "keys" && len(x) == 1 && r.Method == http.MethodGet:
+		listAPIKeys(sw, r)
+	case x[0] == "keys" && len(x) == 1 && r.Method == http.MethodPost:
+		createAPIKey(sw, r, e)
+	case x[0] == "keys" && len(x) == 2 && r.Method == http.MethodDelete:
+		revokeAPIKey(sw, r, e, x[1])
+	case x[0] == "keys" && len(x) == 3 && x[2] == "rotate" && r.Method == http.MethodPost:
+		rotateAPIKey(sw, r, e, x[1])
+	case (x[0] == "owners" || x[0] == "prefixes") && len(x) == 1 && r.Method == http.MethodGet:
+		listOwners(sw, r, x[0])
+	case (x[0] == "owners" || x[0] == "prefixes") && len(x) == 2 && x[1] != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		setOwner(sw, r, e, x[0], x[1])
+	case x[0] == "audit" && len(x) == 1 && r.Method == http.MethodGet:
+		queryAudit(sw, r)
+	default:
+		sw.WriteHeader(http.StatusNotFound)
+	}
+
+	if e.Action != "" {
+		recordAudit(e, sw.Status())
+	}
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+
+	// Get all keys
+	keys, err := server.ks.ListAPIKeys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Oldest first, keys from the config have no created time
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i].Created == nil) != (keys[j].Created == nil) {
+			return keys[i].Created == nil
+		}
+		if keys[i].Created != nil && !keys[i].Created.Equal(*keys[j].Created) {
+			return keys[i].Created.Before(*keys[j].Created)
+		}
+		return keys[i].Hash < keys[j].Hash
+	})
+
+	// Output Json
+	kl := &adminKeyList{Keys: []*adminKey{}}
+	for _, k := range keys {
+		kl.Keys = append(kl.Keys, newAdminKey(k, ""))
+	}
+	serveJSON(w, kl.ToBytes())
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request, e *auditEvent) {
+
+	e.Action = auditKeyCreate
+
+	// Read the request
+	var kr adminKeyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&kr); err != nil || len(kr.Scopes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Make the key
+	now := time.Now().UTC()
+	k := &apiKey{
+		Scopes:      kr.Scopes,
+		Packages:    kr.Packages,
+		Expires:     kr.Expires,
+		Description: kr.Description,
+		Owner:       kr.Owner,
+		Created:     &now,
+	}
+	key, status := storeNewAPIKey(k)
+	if status != http.StatusCreated {
+		w.WriteHeader(status)
+		return
+	}
+	e.Target = k.Reference()
+	log.Println("Created API Key", k.Reference(), k.Description)
+
+	// Output Json, the only time the key is returned
+	serveJSONStatus(w, http.StatusCreated, newAdminKey(k, key).ToBytes())
+}
+
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, e *auditEvent, ref string) {
+
+	e.Action, e.Target = auditKeyRevoke, ref
+
+	// Remove the key
+	k, err := server.ks.RevokeAPIKey(ref)
+	if err != nil {
+		w.WriteHeader(apiKeyErrorStatus(err))
+		return
+	}
+	e.Target = k.Reference()
+	log.Println("Revoked API Key", k.Reference(), k.Description)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func rotateAPIKey(w http.ResponseWriter, r *http.Request, e *auditEvent, ref string) {
+
+	e.Action, e.Target = auditKeyRotate, ref
+
+	// Find the key to replace
+	keys, err := server.ks.ListAPIKeys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	old, err := findAPIKey(keys, ref)
+	if err != nil {
+		w.WriteHeader(apiKeyErrorStatus(err))
+		return
+	}
+
+	// Store a new key with the same settings
+	now := time.Now().UTC()
+	k := *old
+	k.Created = &now
+	key, status := storeNewAPIKey(&k)
+	if status != http.StatusCreated {
+		w.WriteHeader(status)
+		return
+	}
+
+	// Remove the old key, taking the new one back out if that fails
+	if _, err := server.ks.RevokeAPIKey(old.Hash); err != nil {
+		server.ks.RevokeAPIKey(k.Hash)
+		w.WriteHeader(apiKeyErrorStatus(err))
+		return
+	}
+	e.Target = old.Reference() + " " + k.Reference()
+	log.Println("Rotated API Key", old.Reference(), "to", k.Reference(), k.Description)
+
+	// Output Json, the only time the key is returned
+	serveJSON(w, newAdminKey(&k, key).ToBytes())
+}
+
+// storeNewAPIKey generates a key and stores it with the settings in k, returning the key and the status for the response
+func storeNewAPIKey(k *apiKey) (string, int) {
+
+	// Generate the key
+	key, err := generateAPIKey()
+	if err != nil {
+		return "", http.StatusInternalServerError
+	}
+	k.Hash = hashAPIKey(key)
+
+	// Check the settings are valid
+	if err := k.Validate(); err != nil {
+		return "", http.StatusBadRequest
+	}
+
+	// Store it
+	if err := server.ks.CreateAPIKey(k); err != nil {
+		return "", apiKeyErrorStatus(err)
+	}
+	return key, http.StatusCreated
+}
+
+// adminOwnerRequest is the body of a request to set an owner
+type adminOwnerRequest struct {
+	Owner string `json:"owner"`
+}
+
+func listOwners(w http.ResponseWriter, r *http.Request, kind string) {
+
+	// Get the package owners or reserved prefixes
+	var owners map[string]string
+	var err error
+	if kind == "owners" {
+		owners, err = server.fs.GetPackageOwners()
+	} else {
+		owners, err = server.fs.GetReservedPrefixes()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Output Json as owners or prefixes, each keyed by lowercase ID or prefix
+	b, _ := json.Marshal(map[string]map[string]string{kind: owners})
+	serveJSON(w, b)
+}
+
+func setOwner(w http.ResponseWriter, r *http.Request, e *auditEvent, kind string, name string) {
+
+	// Owner changes are recorded against the package ID, prefix changes against the prefix
+	switch {
+	case kind == "owners" && r.Method == http.MethodPut:
+		e.Action, e.ID = auditOwnerSet, name
+	case kind == "owners":
+		e.Action, e.ID = auditOwnerRemove, name
+	case r.Method == http.MethodPut:
+		e.Action, e.Target = auditPrefixSet, name
+	default:
+		e.Action, e.Target = auditPrefixRemove, name
+	}
+
+	// Read the new owner, DELETE removes the owner
+	var or adminOwnerRequest
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&or); err != nil || or.Owner == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	e.Owner = or.Owner
+
+	// Transfer the package or reserve the prefix
+	var err error
+	if kind == "owners" {
+		log.Println("Setting Owner of", name, "to", or.Owner)
+		err = server.fs.SetPackageOwner(name, or.Owner)
+	} else {
+		log.Println("Reserving Prefix", name, "for", or.Owner)
+		err = server.fs.SetReservedPrefix(name, or.Owner)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func queryAudit(w http.ResponseWriter, r *http.Request) {
+
+	// Read the filters, returning the latest 100 events unless asked for more
+	q := r.URL.Query()
+	aq := &auditQuery{ID: q.Get("id"), Actor: q.Get("actor"), Limit: 100}
+	if q.Get("limit") != "" {
+		var err error
+		if aq.Limit, err = strconv.Atoi(q.Get("limit")); err != nil || aq.Limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	// Cap the page size
+	if aq.Limit > 1000 {
+		aq.Limit = 1000
+	}
+
+	// Run the query
+	events, err := server.as.QueryEvents(aq)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Output Json
+	el := &auditEventList{Events: events}
+	serveJSON(w, el.ToBytes())
+}
+
+// apiKeyErrorStatus returns the response status for a keyStore error
+func apiKeyErrorStatus(err error) int {
+	switch err {
+	case ErrAPIKeyNotFound:
+		return http.StatusNotFound
+	case ErrAPIKeyExists, ErrAPIKeyInConfig:
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// Actor recorded in the audit log for keys created from the command line
+const createKeyActor = "create-key"
+
+// runCreateKey creates a key from the command line and prints it, so the first admin key can be made
+func runCreateKey(args []string) int {
+
+	// Read the flags
+	fl := flag.NewFlagSet("create-key", flag.ContinueOnError)
+	scopes := fl.String("scopes", scopeAdmin, "Comma separated scopes, any of read, push, push-new-id, unlist and admin")
+	packages := fl.String("packages", "", "Comma separated glob patterns of the package IDs the key can act on, empty for all")
+	description := fl.String("description", "", "Description of the key")
+	owner := fl.String("owner", "", "Owner recorded for new package IDs pushed with the key")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "Usage: "+os.Args[0]+" create-key [flags]")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if fl.NArg() != 0 || len(splitList(*scopes)) == 0 {
+		fl.Usage()
+		return 2
+	}
+
+	// Make and store the key
+	now := time.Now().UTC()
+	k := &apiKey{
+		Scopes:      splitList(*scopes),
+		Packages:    splitList(*packages),
+		Description: *description,
+		Owner:       *owner,
+		Created:     &now,
+	}
+	if err := validateScopes(k.Scopes, k.Packages); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	e := &auditEvent{Time: now, Actor: createKeyActor, Action: auditKeyCreate}
+	key, status := storeNewAPIKey(k)
+	if status == http.StatusCreated {
+		e.Target = k.Reference()
+	}
+	recordAudit(e, status)
+	if status != http.StatusCreated {
+		fmt.Fprintln(os.Stderr, "Error creating key:", http.StatusText(status))
+		return 1
+	}
+
+	// Print the key, the only time it is shown
+	fmt.Println(key)
+	return 0
+}
+
+// splitList splits a comma separated list, dropping empty items
+func splitList(s string) []string {
+	var l []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			l = append(l, x)
+		}
+	}
+	return l
+}
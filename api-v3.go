@@ -0,0 +1,306 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func serveServiceIndex(w http.ResponseWriter, r *http.Request) {
+
+	// Create a new Service Index Struct
+	si := NewNugetServiceIndex(server.URL.String())
+
+	// Output Json
+	serveJSON(w, si.ToBytes())
+}
+
+func serveFlatContainer(w http.ResponseWriter, r *http.Request) {
+
+	// Split the path into {id}/index.json or {id}/{ver}/{file}
+	x := strings.Split(strings.TrimPrefix(r.URL.Path, server.URL.Path+`v3-flatcontainer/`), `/`)
+
+	// Get all versions of this ID
+	entries, err := getPackageVersions(x[0])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(x) == 2 && x[1] == "index.json":
+		// Version list (lowercase as per the spec)
+		pv := &NugetPackageVersions{}
+		for _, e := range entries {
+			pv.Versions = append(pv.Versions, strings.ToLower(normalizeVersion(e.Properties.Version)))
+		}
+		serveJSON(w, pv.ToBytes())
+
+	case len(x) == 3:
+		// Find the requested version
+		var npe *NugetPackageEntry
+		for _, e := range entries {
+			if sameVersion(e.Properties.Version, x[1]) {
+				npe = e
+			}
+		}
+		if npe == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Serve the requested file
+		switch strings.ToLower(x[2]) {
+		case strings.ToLower(npe.Properties.ID + "." + x[1] + ".nupkg"):
+			servePackageFile(w, r, npe.Properties.ID, npe.Properties.Version)
+		case strings.ToLower(npe.Properties.ID + ".nuspec"):
+			serveNuspecFile(w, r, npe)
+		case "icon":
+			servePackageAsset(w, r, npe, npe.Properties.IconFile)
+		case "readme":
+			servePackageAsset(w, r, npe, npe.Properties.ReadmeFile)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func serveRegistration(w http.ResponseWriter, r *http.Request) {
+
+	// Split the path into {id}/index.json, {id}/page/{lower}/{upper}.json or {id}/{ver}.json
+	x := strings.Split(strings.TrimPrefix(r.URL.Path, server.URL.Path+`v3/registration/`), `/`)
+
+	// Get all versions of this ID
+	entries, err := getPackageVersions(x[0])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(x) == 2 && x[1] == "index.json":
+		// Registration index
+		ri := NewNugetRegistrationIndex(entries, server.URL.String())
+		serveJSON(w, ri.ToBytes())
+
+	case len(x) == 4 && x[1] == "page":
+		// Registration page, find the page with matching bounds
+		for _, page := range registrationPages(entries) {
+			rp := NewNugetRegistrationPage(page, server.URL.String())
+			if rp.Lower == strings.ToLower(x[2]) && rp.Upper+".json" == strings.ToLower(x[3]) {
+				serveJSON(w, rp.ToBytes())
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	case len(x) == 2 && strings.HasSuffix(x[1], ".json"):
+		// Registration leaf
+		for _, e := range entries {
+			if sameVersion(e.Properties.Version, strings.TrimSuffix(x[1], ".json")) {
+				rl := NewNugetRegistrationLeafIndex(e, server.URL.String())
+				serveJSON(w, rl.ToBytes())
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func serveSearch(w http.ResponseWriter, r *http.Request) {
+
+	// Read the query parameters
+	q := r.URL.Query()
+	skip, take, ok := searchPaging(q)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Run the search
+	results, err := searchPackages(q.Get("q"), q.Get("prerelease") == "true", allowsSemVer2(q.Get("semVerLevel")))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// IDs owned by the owner of their reserved prefix are verified
+	owners, err := server.fs.GetPackageOwners()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	prefixes, err := server.fs.GetReservedPrefixes()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Page and format the results
+	sr := &NugetSearchResults{TotalHits: len(results), Data: []*NugetSearchResult{}}
+	for i := skip; i < len(results) && i < skip+take; i++ {
+		res := NewNugetSearchResult(results[i].Versions, server.URL.String())
+		res.Verified = isVerifiedPackage(owners, prefixes, res.PackageID)
+		sr.Data = append(sr.Data, res)
+	}
+
+	// Output Json
+	serveJSON(w, sr.ToBytes())
+}
+
+func serveAutocomplete(w http.ResponseWriter, r *http.Request) {
+
+	// Read the query parameters
+	q := r.URL.Query()
+	skip, take, ok := searchPaging(q)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	prerelease := q.Get("prerelease") == "true"
+	semVer2 := allowsSemVer2(q.Get("semVerLevel"))
+
+	ar := &NugetAutocompleteResults{Data: []string{}}
+
+	if q.Get("id") != "" {
+		// Versions of a single ID
+		entries, err := getPackageVersions(q.Get("id"))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, e := range entries {
+			if !e.IsListed() {
+				continue
+			}
+			if !prerelease && isPrereleaseVersion(e.Properties.Version) {
+				continue
+			}
+			if !semVer2 && isSemVer2Version(e.Properties.Version) {
+				continue
+			}
+			ar.Data = append(ar.Data, normalizeVersion(e.Properties.Version))
+		}
+		ar.TotalHits = len(ar.Data)
+	} else {
+		// IDs starting with or containing the query
+		results, err := searchPackages("", prerelease, semVer2)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var ids []string
+		term := strings.ToLower(q.Get("q"))
+		for _, sr := range results {
+			if strings.HasPrefix(sr.Latest.Properties.IDLowerCase, term) {
+				ids = append(ids, sr.Latest.Properties.ID)
+			}
+		}
+		for _, sr := range results {
+			if !strings.HasPrefix(sr.Latest.Properties.IDLowerCase, term) && strings.Contains(sr.Latest.Properties.IDLowerCase, term) {
+				ids = append(ids, sr.Latest.Properties.ID)
+			}
+		}
+		ar.TotalHits = len(ids)
+		for i := skip; i < len(ids) && i < skip+take; i++ {
+			ar.Data = append(ar.Data, ids[i])
+		}
+	}
+
+	// Output Json
+	serveJSON(w, ar.ToBytes())
+}
+
+// searchPaging reads skip and take from a V3 search query
+func searchPaging(q url.Values) (int, int, bool) {
+
+	// Set defaults
+	skip, take := 0, 20
+	var err error
+
+	if q.Get("skip") != "" {
+		if skip, err = strconv.Atoi(q.Get("skip")); err != nil || skip < 0 {
+			return 0, 0, false
+		}
+	}
+	if q.Get("take") != "" {
+		if take, err = strconv.Atoi(q.Get("take")); err != nil || take < 0 {
+			return 0, 0, false
+		}
+	}
+	// Cap the page size
+	if take > 1000 {
+		take = 1000
+	}
+
+	return skip, take, true
+}
+
+func serveNuspecFile(w http.ResponseWriter, r *http.Request, npe *NugetPackageEntry) {
+
+	// The nuspec is extracted to the root of the package directory
+	f, _, err := server.fs.GetFile(path.Join(packageStoreDir(npe.Properties.ID, npe.Properties.Version), npe.Properties.ID+".nuspec"))
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Set Headers
+	w.Header().Set("Content-Type", "application/xml;charset=utf-8")
+
+	// Output Xml
+	serveStoreFile(w, r, f)
+}
+
+// getPackageVersions returns all entries for an ID in ascending version order
+func getPackageVersions(id string) ([]*NugetPackageEntry, error) {
+
+	// Get all entries for this ID
+	entries, _, err := server.fs.GetPackageFeedEntries(id, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort into version order
+	sort.Slice(entries, func(i, j int) bool {
+		return compareVersions(entries[i].Properties.Version, entries[j].Properties.Version) < 0
+	})
+
+	return entries, nil
+}
+
+func serveJSON(w http.ResponseWriter, b []byte) {
+	serveJSONStatus(w, http.StatusOK, b)
+}
+
+func serveJSONStatus(w http.ResponseWriter, status int, b []byte) {
+
+	// Set Headers
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.WriteHeader(status)
+
+	// Output Json
+	w.Write(b)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+	"time"
+)
+
+// Scopes that can be given to an API key
+const (
+	scopeRead      = "read"        // Read feeds and download packages
+	scopePush      = "push"        // Push new versions of existing package IDs
+	scopePushNewID = "push-new-id" // Push new package IDs as well as new versions
+	scopeUnlist    = "unlist"      // Unlist, relist and delete packages
+	scopeAdmin     = "admin"       // Manage API keys
+)
+
+// Scopes granted in dev mode and to keys from before scopes existed, admin is never granted without a key
+var (
+	devScopes       = []string{scopeRead, scopePush, scopePushNewID, scopeUnlist}
+	readWriteScopes = []string{scopePush, scopePushNewID, scopeUnlist}
+)
+
+// apiKey is an API key as held in the store, only the hash of the key itself is kept
+type apiKey struct {
+	Hash        string     `json:"hash"`               // Hex encoded SHA256 of the key
+	Scopes      []string   `json:"scopes"`             // Any of read, push, push-new-id, unlist and admin
+	Packages    []string   `json:"packages,omitempty"` // Glob patterns of the package IDs the key can act on, empty for all
+	Expires     *time.Time `json:"expires,omitempty"`
+	Description string     `json:"description,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+}
+
+// APIKeyError represents an invalid API key
+type APIKeyError struct {
+	ErrorString string
+}
+
+func (ke *APIKeyError) Error() string {
+	return ke.ErrorString
+}
+
+// hashAPIKey returns the hash an API key is stored under
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// generateAPIKey returns a new random key
+func generateAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Reference identifies a key in logs without revealing it
+func (k *apiKey) Reference() string {
+	if len(k.Hash) < 12 {
+		return k.Hash
+	}
+	return k.Hash[:12]
+}
+
+// Expired returns true once a key is past its expiry date
+func (k *apiKey) Expired() bool {
+	return k.Expires != nil && time.Now().After(*k.Expires)
+}
+
+// Validate checks the hash, scopes and package patterns of a key
+func (k *apiKey) Validate() error {
+	if b, err := hex.DecodeString(k.Hash); err != nil || len(b) != sha256.Size {
+		return &APIKeyError{"Invalid API key hash: " + k.Hash}
+	}
+	return validateScopes(k.Scopes, k.Packages)
+}
+
+// validateScopes checks scopes and package patterns are valid
+func validateScopes(scopes []string, packages []string) error {
+	for _, s := range scopes {
+		switch s {
+		case scopeRead, scopePush, scopePushNewID, scopeUnlist, scopeAdmin:
+		default:
+			return &APIKeyError{"Invalid scope: " + s}
+		}
+	}
+	for _, p := range packages {
+		if _, err := path.Match(p, ""); err != nil {
+			return &APIKeyError{"Invalid package pattern: " + p}
+		}
+	}
+	return nil
+}
+
+// access is what has been granted to a request
+type access struct {
+	Actor    string   // Reference of the key used, empty for anonymous requests
+	Scopes   []string // Scopes granted
+	Packages []string // Glob patterns of the package IDs the scopes apply to, empty for all
+	Owner    string   // Owner of the key, recorded as the owner of new package IDs
+}
+
+// keyAccess works out the access given by a key found in the store (nil if not found), with no keys
+// in the store everything but admin is allowed and once any key has the read scope anonymous reads are refused
+func keyAccess(k *apiKey, keys bool, private bool) *access {
+
+	// Check for case where no keys are declared yet - dev mode
+	if !keys {
+		return &access{Scopes: devScopes}
+	}
+
+	// Unknown and expired keys are anonymous
+	if k == nil || k.Expired() {
+		if private {
+			return &access{}
+		}
+		return &access{Scopes: []string{scopeRead}}
+	}
+
+	// Any valid key can read
+	a := &access{Actor: k.Reference(), Packages: k.Packages, Owner: k.Owner}
+	a.Scopes = append(append(a.Scopes, k.Scopes...), scopeRead)
+	return a
+}
+
+// Can returns true if a scope has been granted, pushing new IDs includes pushing new versions
+func (a *access) Can(scope string) bool {
+	for _, s := range a.Scopes {
+		if s == scope || (scope == scopePush && s == scopePushNewID) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPackage returns true if a scope has been granted for a package ID
+func (a *access) CanPackage(scope string, id string) bool {
+	if !a.Can(scope) {
+		return false
+	}
+	return len(a.Packages) == 0 || matchPackagePatterns(a.Packages, id)
+}
+
+// matchPackagePatterns returns true if an ID matches any of a list of glob patterns, ignoring case
+func matchPackagePatterns(patterns []string, id string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(id)); ok {
+			return true
+		}
+	}
+	return false
+}
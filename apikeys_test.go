@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyAccess(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	key := &apiKey{Hash: strings.Repeat("ab", 32), Scopes: []string{scopePush}, Packages: []string{"Team.*"}, Owner: "team", Expires: &future}
+
+	tests := []struct {
+		name    string
+		k       *apiKey
+		keys    bool
+		private bool
+		actor   string
+		scopes  []string
+	}{
+		{"dev mode", nil, false, false, "", devScopes},
+		{"dev mode with a key", key, false, false, "", devScopes},
+		{"anonymous", nil, true, false, "", []string{scopeRead}},
+		{"anonymous to a private feed", nil, true, true, "", nil},
+		{"expired key", &apiKey{Hash: key.Hash, Scopes: []string{scopeAdmin}, Expires: &past}, true, false, "", []string{scopeRead}},
+		{"expired key to a private feed", &apiKey{Hash: key.Hash, Scopes: []string{scopeAdmin}, Expires: &past}, true, true, "", nil},
+		{"key", key, true, true, "abababababab", []string{scopePush, scopeRead}},
+	}
+	for _, tt := range tests {
+		a := keyAccess(tt.k, tt.keys, tt.private)
+		if a.Actor != tt.actor || strings.Join(a.Scopes, ",") != strings.Join(tt.scopes, ",") {
+			t.Errorf("%s: keyAccess gave %+v", tt.name, a)
+		}
+		if a.Can(scopeAdmin) {
+			t.Errorf("%s: keyAccess gave admin", tt.name)
+		}
+	}
+}
+
+func TestAccessCanPackage(t *testing.T) {
+	tests := []struct {
+		a     access
+		scope string
+		id    string
+		can   bool
+	}{
+		{access{Scopes: []string{scopePush}}, scopePush, "Any.Pkg", true},
+		{access{Scopes: []string{scopePush}}, scopePushNewID, "Any.Pkg", false},
+		{access{Scopes: []string{scopePushNewID}}, scopePush, "Any.Pkg", true},
+		{access{Scopes: []string{scopeRead}}, scopeUnlist, "Any.Pkg", false},
+		{access{Scopes: []string{scopePush}, Packages: []string{"Team.*"}}, scopePush, "team.pkg", true},
+		{access{Scopes: []string{scopePush}, Packages: []string{"Team.*"}}, scopePush, "Other.Pkg", false},
+		{access{Scopes: []string{scopePush}, Packages: []string{"Team.*", "Shared"}}, scopePush, "SHARED", true},
+		{access{Scopes: []string{scopeUnlist}, Packages: []string{"Team.*"}}, scopePush, "Team.Pkg", false},
+		{access{}, scopeRead, "Any.Pkg", false},
+	}
+	for _, tt := range tests {
+		if can := tt.a.CanPackage(tt.scope, tt.id); can != tt.can {
+			t.Errorf("%+v CanPackage(%s, %s) gave %v", tt.a, tt.scope, tt.id, can)
+		}
+	}
+}
+
+func TestAPIKeyValidate(t *testing.T) {
+	hash := hashAPIKey("key")
+	tests := []struct {
+		k     apiKey
+		valid bool
+	}{
+		{apiKey{Hash: hash, Scopes: []string{scopeRead, scopePush, scopePushNewID, scopeUnlist, scopeAdmin}}, true},
+		{apiKey{Hash: hash, Scopes: []string{scopePush}, Packages: []string{"Team.*"}}, true},
+		{apiKey{Hash: "key", Scopes: []string{scopePush}}, false},
+		{apiKey{Hash: hash[:10], Scopes: []string{scopePush}}, false},
+		{apiKey{Hash: hash, Scopes: []string{"root"}}, false},
+		{apiKey{Hash: hash, Scopes: []string{scopePush}, Packages: []string{"["}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.k.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v Validate gave %v", tt.k, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+type auditStoreGCP struct {
+	fs *fileStoreGCP // Holds the Firestore connection
+}
+
+// firestoreAuditEvent is an audit event as stored in Firebase, with the ID lowercased for queries
+type firestoreAuditEvent struct {
+	auditEvent
+	IDLowerCase string
+}
+
+func (as *auditStoreGCP) Init(s *Server) error {
+	return nil
+}
+
+func (as *auditStoreGCP) RecordEvent(e *auditEvent) error {
+	_, _, err := as.fs.firestore.Collection("Nuget-Audit").Add(as.fs.ctx, &firestoreAuditEvent{*e, strings.ToLower(e.ID)})
+	return err
+}
+
+func (as *auditStoreGCP) QueryEvents(q *auditQuery) ([]*auditEvent, error) {
+
+	// Filtering and ordering together needs a composite index, so only order unfiltered queries
+	query := as.fs.firestore.Collection("Nuget-Audit").Query
+	if q.ID != "" {
+		query = query.Where("IDLowerCase", "==", strings.ToLower(q.ID))
+	}
+	if q.Actor != "" {
+		query = query.Where("Actor", "==", q.Actor)
+	}
+	if q.ID == "" && q.Actor == "" {
+		query = query.OrderBy("Time", firestore.Desc).Limit(q.Limit)
+	}
+
+	// Cycle through the events
+	events := []*auditEvent{}
+	iter := query.Documents(as.fs.ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e firestoreAuditEvent
+		if err := d.DataTo(&e); err != nil {
+			return nil, err
+		}
+		events = append(events, &e.auditEvent)
+	}
+
+	// Newest first
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
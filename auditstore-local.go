@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// Name of the append only file holding the audit log in the state directory, one JSON event per line
+const localAuditFile = "audit.jsonl"
+
+type auditStoreLocal struct {
+	fs    *fileStoreLocal // Holds the repo the log is saved in
+	mutex sync.Mutex
+}
+
+func (as *auditStoreLocal) Init(s *Server) error {
+	return nil
+}
+
+func (as *auditStoreLocal) RecordEvent(e *auditEvent) error {
+
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// Append the event as a single write so lines are never interleaved
+	f, err := os.OpenFile(as.fs.statePath(localAuditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (as *auditStoreLocal) QueryEvents(q *auditQuery) ([]*auditEvent, error) {
+
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	// The log will not exist until something is recorded
+	f, err := os.Open(as.fs.statePath(localAuditFile))
+	if os.IsNotExist(err) {
+		return []*auditEvent{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Keep the last matching events, the log is in time order
+	var events []*auditEvent
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1<<20)
+	for s.Scan() {
+		var e auditEvent
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			// Skip a line cut short by a crash
+			continue
+		}
+		if q.Matches(&e) {
+			events = append(events, &e)
+			if len(events) > q.Limit {
+				events = events[1:]
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	// Newest first
+	list := make([]*auditEvent, 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		list = append(list, events[i])
+	}
+	return list, nil
+}
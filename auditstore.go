@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type auditStore interface {
+	Init(s *Server) error
+	RecordEvent(e *auditEvent) error
+	QueryEvents(q *auditQuery) ([]*auditEvent, error)
+}
+
+// Actions recorded in the audit log
+const (
+	auditPush         = "push"
+	auditPushSymbols  = "push-symbols"
+	auditDelete       = "delete"
+	auditUnlist       = "unlist"
+	auditRelist       = "relist"
+	auditKeyCreate    = "key-create"
+	auditKeyRevoke    = "key-revoke"
+	auditKeyRotate    = "key-rotate"
+	auditOwnerSet     = "owner-set"
+	auditOwnerRemove  = "owner-remove"
+	auditPrefixSet    = "prefix-set"
+	auditPrefixRemove = "prefix-remove"
+	auditAdmin        = "admin" // Admin requests refused before reaching an action
+)
+
+// Outcomes of a recorded action, worked out from the response status
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+	auditFailed  = "failed"
+)
+
+// auditEvent is a write or admin action as recorded in the audit log
+type auditEvent struct {
+	Time         time.Time `json:"time"`
+	Actor        string    `json:"actor"` // Key reference or token subject, empty for anonymous requests
+	Action       string    `json:"action"`
+	ID           string    `json:"id,omitempty"`
+	Version      string    `json:"version,omitempty"`
+	Hash         string    `json:"hash,omitempty"`   // Hex encoded SHA512 of a pushed package
+	Target       string    `json:"target,omitempty"` // Key reference (old and new when rotated) or prefix acted on by admin actions
+	Owner        string    `json:"owner,omitempty"`  // Owner given a package ID or prefix
+	ClientIP     string    `json:"clientIP"`
+	ForwardedFor string    `json:"forwardedFor,omitempty"` // X-Forwarded-For as sent, not trusted for ClientIP
+	Status       int       `json:"status"`
+	Outcome      string    `json:"outcome"`
+}
+
+// auditQuery filters the audit log, newest events are returned first
+type auditQuery struct {
+	ID    string // Package ID, matched case insensitively
+	Actor string
+	Limit int
+}
+
+// Matches returns true if an event passes the query's filters
+func (q *auditQuery) Matches(e *auditEvent) bool {
+	if q.ID != "" && !strings.EqualFold(q.ID, e.ID) {
+		return false
+	}
+	if q.Actor != "" && q.Actor != e.Actor {
+		return false
+	}
+	return true
+}
+
+// auditEventList is returned from a query of the audit log
+type auditEventList struct {
+	Events []*auditEvent `json:"events"`
+}
+
+// ToBytes exports structure as byte array
+func (el *auditEventList) ToBytes() []byte {
+	b, _ := json.Marshal(el)
+	return b
+}
+
+// newAuditEvent starts an event for an action taken by a request
+func newAuditEvent(r *http.Request, a *access, action string) *auditEvent {
+	e := &auditEvent{
+		Time:         time.Now().UTC(),
+		Action:       action,
+		ClientIP:     r.RemoteAddr,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.ClientIP = host
+	}
+	if a != nil {
+		e.Actor = a.Actor
+	}
+	return e
+}
+
+// recordRefused records a write or admin request refused before it reached its handler
+func recordRefused(r *http.Request, a *access, status int) {
+	var e *auditEvent
+	switch {
+	case strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/`):
+		e = newAuditEvent(r, a, auditAdmin)
+	case r.Method == http.MethodPut:
+		e = newAuditEvent(r, a, auditPush)
+	case r.Method == http.MethodDelete:
+		e = newAuditEvent(r, a, auditDeleteAction())
+		e.ID, e.Version, _ = packagePathParams(r.URL.Path)
+	case r.Method == http.MethodPost:
+		e = newAuditEvent(r, a, auditRelist)
+		e.ID, e.Version, _ = packagePathParams(r.URL.Path)
+	default:
+		return
+	}
+	recordAudit(e, status)
+}
+
+// auditDeleteAction returns the action taken by a delete in the configured mode
+func auditDeleteAction() string {
+	if server.config.DeleteMode == "delete" {
+		return auditDelete
+	}
+	return auditUnlist
+}
+
+// recordAudit sets the outcome of an event from the response status and records it, failures are
+// logged rather than failing the request that has already been handled
+func recordAudit(e *auditEvent, status int) {
+	e.Status = status
+	switch {
+	case status < 300:
+		e.Outcome = auditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Outcome = auditDenied
+	default:
+		e.Outcome = auditFailed
+	}
+	log.Println("Audit::", e.Outcome, e.Action, e.Actor, e.ID, e.Version, e.Target)
+	if err := server.as.RecordEvent(e); err != nil {
+		log.Println("Error recording audit event:", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// runCommand runs a subcommand of the server against the configured store, returning the process exit code
+func runCommand(args []string) int {
+	switch args[0] {
+	case "mirror":
+		return runMirror(args[1:])
+	case "import":
+		return runImport(args[1:])
+	case "export":
+		return runExport(args[1:])
+	case "create-key":
+		return runCreateKey(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command:", args[0])
+		fmt.Fprintln(os.Stderr, "Commands: mirror, import, export, create-key")
+		return 2
+	}
+}
+
+// commandStore returns the store subcommands work on, a proxied store would fetch missing
+// packages from its upstream so the store behind it is used
+func commandStore() fileStore {
+	if p, ok := server.fs.(*fileStoreProxy); ok {
+		return p.fileStore
+	}
+	return server.fs
+}
+
+// storeCommandPackage stores a package or symbol package for a subcommand, recording it in the audit
+// log as the server does for pushes, it returns true if the package was already stored
+func storeCommandPackage(fs fileStore, pkg packageReader, owner string, actor string) (bool, error) {
+
+	pa, err := openPackage(pkg)
+	if err != nil {
+		return false, err
+	}
+	e := &auditEvent{Time: time.Now().UTC(), Actor: actor, Action: auditPush, ID: pa.nsf.Meta.ID, Version: pa.nsf.Meta.Version}
+	if pa.IsSymbolPackage() {
+		e.Action = auditPushSymbols
+	}
+	if e.Hash, _, err = hashPackage(pkg); err != nil {
+		return false, err
+	}
+
+	// Store the file
+	var exists bool
+	if pa.IsSymbolPackage() {
+		exists, err = fs.StoreSymbolPackage(pkg, owner)
+	} else {
+		exists, err = fs.StorePackage(pkg, owner)
+	}
+	_, badSymbols := err.(*SymbolError)
+	switch {
+	case err == ErrNotOwner:
+		recordAudit(e, http.StatusForbidden)
+	case err == ErrFileNotFound:
+		// Symbols for a package not in the store
+		recordAudit(e, http.StatusNotFound)
+	case badSymbols:
+		recordAudit(e, http.StatusBadRequest)
+	case err != nil:
+		recordAudit(e, http.StatusInternalServerError)
+	case !exists:
+		recordAudit(e, http.StatusCreated)
+	}
+	return exists, err
+}
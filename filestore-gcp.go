@@ -2,10 +2,8 @@ package main
 
 import (
 	"context"
-	"crypto/sha512"
-	"encoding/hex"
 	"errors"
-	"io/ioutil"
+	"io"
 	"log"
 	"path"
 	"strings"
@@ -56,53 +54,67 @@ func (fs *fileStoreGCP) Init(s *Server) error {
 	return nil
 }
 
-func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
+func (fs *fileStoreGCP) StorePackage(pkg packageReader, owner string) (bool, error) {
 
-	// Extract files
-	nsf, files, err := extractPackage(pkg)
+	// Read the .nuspec from the package
+	pa, err := openPackage(pkg)
 	if err != nil {
 		return false, err
 	}
+	nsf := pa.nsf
 
-	// Generate local variables for ease
-	pkgRef := nsf.Meta.ID + "." + nsf.Meta.Version
-	pkgFileName := pkgRef + ".nupkg"                   // Package File Name
-	pkgDir := path.Join(nsf.Meta.ID, nsf.Meta.Version) // Package Directory Name
+	// Paths are built from the ID and version so check them first
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return false, err
+	}
+
+	// Generate local variables for ease, documents and objects are named by the normalized version
+	pkgRef := gcpPackageKey(nsf.Meta.ID, nsf.Meta.Version)
+	pkgDir := packageStoreDir(nsf.Meta.ID, nsf.Meta.Version) // Package Directory Name
 
-	// Check to see if package already exists
-	d, err := fs.firestore.Collection("Nuget-Packages").Doc(pkgRef).Get(fs.ctx)
-	if err != nil && grpc.Code(err) != codes.NotFound {
+	// Check the ID can be pushed to by this owner
+	current, err := fs.getPackageOwner(nsf.Meta.ID)
+	if err != nil {
 		return false, err
 	}
-	if d.Exists() {
-		return true, nil
+	prefixes, err := fs.GetReservedPrefixes()
+	if err != nil {
+		return false, err
+	}
+	owner, err = checkPackageOwner(current, prefixes, nsf.Meta.ID, owner)
+	if err != nil {
+		return false, err
 	}
 
-	// Save Package
-	wc := fs.bucket.Object(path.Join(pkgDir, pkgFileName)).NewWriter(fs.ctx)
-	wc.ContentType = "application/octet-stream"
-	if _, err := wc.Write(pkg); err != nil {
+	// Check to see if package already exists (in any equivalent version form)
+	d, err := fs.getPackageDoc(nsf.Meta.ID, nsf.Meta.Version)
+	if err != nil && err != ErrFileNotFound {
 		return false, err
 	}
-	if err := wc.Close(); err != nil {
+	if d != nil {
+		return true, nil
+	}
+
+	// Save Package
+	if err := fs.writeObject(packageStoreFile(nsf.Meta.ID, nsf.Meta.Version, ".nupkg"), func(w io.Writer) error { return copyPackage(w, pkg) }); err != nil {
 		return false, err
 	}
 
-	// Save Files
-	for name, content := range files {
-		wc := fs.bucket.Object(path.Join(pkgDir, name)).NewWriter(fs.ctx)
-		wc.ContentType = "application/octet-stream"
-		if _, err := wc.Write(content); err != nil {
-			return false, err
+	// Save Files (skipping directory entries)
+	for _, zf := range pa.zip.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
 		}
-		if err := wc.Close(); err != nil {
+		if err := fs.writeObject(path.Join(pkgDir, zf.Name), func(w io.Writer) error { return copyZipFile(w, zf) }); err != nil {
 			return false, err
 		}
-
 	}
 
 	// Make a new Package Entry
-	npe := NewNugetPackageEntry(nsf)
+	npe := NewNugetPackageEntry(nsf, pa.ne)
+
+	// Record the frameworks targeted by the package contents
+	npe.Properties.Frameworks = packageFrameworks(pa.names, pa.ne)
 
 	// Populate additional time values
 	npe.Properties.Created.Value = time.Now().Format(zuluTimeLayout)
@@ -111,10 +123,13 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 	npe.Updated = time.Now().Format(zuluTimeLayout)
 
 	// Populate additional package values
-	h := sha512.Sum512(pkg)
-	npe.Properties.PackageHash = hex.EncodeToString(h[:])
+	hash, size, err := hashPackage(pkg)
+	if err != nil {
+		return false, err
+	}
+	npe.Properties.PackageHash = hash
 	npe.Properties.PackageHashAlgorithm = `SHA512`
-	npe.Properties.PackageSize.Value = len(pkg)
+	npe.Properties.PackageSize.Value = int(size)
 	npe.Properties.PackageSize.Type = "Edm.Int64"
 
 	// Save to Firestore
@@ -122,45 +137,265 @@ func (fs *fileStoreGCP) StorePackage(pkg []byte) (bool, error) {
 		return false, err
 	}
 
+	// Update the latest versions for this ID
+	if err := fs.updateExtras(npe.Properties.ID); err != nil {
+		return false, err
+	}
+
+	// Record the owner of a new ID
+	if owner != "" && current == "" {
+		if err := fs.SetPackageOwner(npe.Properties.ID, owner); err != nil {
+			return false, err
+		}
+	}
+	// Return
+	return false, nil
+}
+
+// updateExtras recalculates the latest listed versions of an ID, removing the extras once no versions remain
+func (fs *fileStoreGCP) updateExtras(id string) error {
+
 	// Local Extras object
 	pe := &packagesExtra{}
+	found := false
 
 	// Cycle through all packages with this ID to get the latest version
-	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.ID", "==", npe.Properties.ID).Documents(fs.ctx)
+	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.ID", "==", id).Documents(fs.ctx)
 	// Cycle Iterator
 	for {
-		d, err = iter.Next()
+		d, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			return false, err
+			return err
 		}
 		// Marshall into structure
 		var npe *NugetPackageEntry
 		if err := d.DataTo(&npe); err != nil {
-			return false, err
+			return err
 		}
+		found = true
 		// Check against latest and overrite if higher
-		if npe.Properties.Version > pe.Latest {
-			pe.Latest = npe.Properties.Version
+		if npe.IsListed() {
+			pe.Update(npe.Properties.Version)
 		}
 	}
 
+	// Remove the extras if this was the last version
+	if !found {
+		_, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Delete(fs.ctx)
+		return err
+	}
+
 	// Ensure Extras is created for this id
-	if _, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(npe.Properties.ID).Set(fs.ctx,
+	_, err := fs.firestore.Collection("Nuget-Packages-Extra").Doc(id).Set(fs.ctx,
 		pe,
-		firestore.Merge([]string{"Latest"}),
-	); err != nil {
+		firestore.Merge([]string{"Latest"}, []string{"AbsoluteLatest"}),
+	)
+	return err
+}
+
+func (fs *fileStoreGCP) RemovePackage(id string, ver string) error {
+
+	// Fetch this document
+	d, err := fs.getPackageDoc(id, ver)
+	if err != nil {
+		return err
+	}
+	var npe *NugetPackageEntry
+	if err := d.DataTo(&npe); err != nil {
+		return err
+	}
+
+	// Delete the symbols indexed from the symbol package that no other package uses
+	if f, _, err := fs.GetFile(packageStoreFile(npe.Properties.ID, npe.Properties.Version, ".snupkg")); err == nil {
+		pa, err := openPackage(f)
+		if err == nil {
+			symbols, _ := symbolFiles(pa)
+			for name := range symbols {
+				if err := fs.releaseSymbolFile(name, d.Ref.ID); err != nil {
+					f.Close()
+					return err
+				}
+			}
+		}
+		f.Close()
+	}
+
+	// Delete the package and extracted files, from the directory of the version as pushed too
+	for _, pkgDir := range fs.packageDirs(npe) {
+		iter := fs.bucket.Objects(fs.ctx, &storage.Query{Prefix: pkgDir + "/"})
+		for {
+			a, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := fs.bucket.Object(a.Name).Delete(fs.ctx); err != nil && err != storage.ErrObjectNotExist {
+				return err
+			}
+		}
+	}
+
+	// Delete the entry
+	if _, err := d.Ref.Delete(fs.ctx); err != nil {
+		return err
+	}
+
+	// Update the latest versions for this ID
+	return fs.updateExtras(npe.Properties.ID)
+}
+
+func (fs *fileStoreGCP) SetPackageListed(id string, ver string, listed bool) error {
+
+	// Fetch this document
+	d, err := fs.getPackageDoc(id, ver)
+	if err != nil {
+		return err
+	}
+	var npe *NugetPackageEntry
+	if err := d.DataTo(&npe); err != nil {
+		return err
+	}
+
+	// Update the entry
+	npe.SetListed(listed)
+	_, err = d.Ref.Update(fs.ctx, []firestore.Update{
+		{Path: "Properties.Listed", Value: npe.Properties.Listed},
+		{Path: "Properties.Published", Value: npe.Properties.Published},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Update the latest versions for this ID
+	return fs.updateExtras(npe.Properties.ID)
+}
+
+func (fs *fileStoreGCP) StoreSymbolPackage(pkg packageReader, owner string) (bool, error) {
+
+	// Read the .nuspec from the package
+	pa, err := openPackage(pkg)
+	if err != nil {
 		return false, err
 	}
-	// Return
+	nsf := pa.nsf
+
+	// Paths are built from the ID and version so check them first
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return false, err
+	}
+
+	// Symbols can only be added to an existing package
+	d, err := fs.getPackageDoc(nsf.Meta.ID, nsf.Meta.Version)
+	if err != nil {
+		return false, err
+	}
+	var npe *NugetPackageEntry
+	if err := d.DataTo(&npe); err != nil {
+		return false, err
+	}
+
+	// Check the ID can be pushed to by this owner
+	current, err := fs.getPackageOwner(npe.Properties.ID)
+	if err != nil {
+		return false, err
+	}
+	prefixes, err := fs.GetReservedPrefixes()
+	if err != nil {
+		return false, err
+	}
+	if _, err := checkPackageOwner(current, prefixes, npe.Properties.ID, owner); err != nil {
+		return false, err
+	}
+
+	// Check for an existing symbol package
+	name := packageStoreFile(npe.Properties.ID, npe.Properties.Version, ".snupkg")
+	if f, _, err := fs.GetFile(name); err == nil {
+		f.Close()
+		return true, nil
+	} else if err != ErrFileNotFound {
+		return false, err
+	}
+
+	// Save the symbol files by their key, refusing packages with symbols that can't be read
+	symbols, err := symbolFiles(pa)
+	if err != nil {
+		return false, err
+	}
+	for name, zf := range symbols {
+		if err := fs.writeObject(name, func(w io.Writer) error { return copyZipFile(w, zf) }); err != nil {
+			return false, err
+		}
+	}
+
+	// Save the .snupkg beside the .nupkg
+	if err := fs.writeObject(name, func(w io.Writer) error { return copyPackage(w, pkg) }); err != nil {
+		return false, err
+	}
+
+	// Record the package as a user of its symbol files
+	for name := range symbols {
+		_, err := fs.firestore.Collection("Nuget-Symbols").Doc(gcpSymbolKey(name)).Set(fs.ctx,
+			map[string]interface{}{"Packages": firestore.ArrayUnion(d.Ref.ID)},
+			firestore.MergeAll,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
 	return false, nil
 }
 
-type packagesExtra struct {
-	Downloads int
-	Latest    string
+// releaseSymbolFile removes a package from the users of a symbol file, deleting the file once none are left
+func (fs *fileStoreGCP) releaseSymbolFile(name string, pkgKey string) error {
+
+	// Remove the package from the file's document in a transaction, so concurrent removals see each other
+	doc := fs.firestore.Collection("Nuget-Symbols").Doc(gcpSymbolKey(name))
+	unused := false
+	err := fs.firestore.RunTransaction(fs.ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		fsym := firestoreSymbol{}
+		d, err := tx.Get(doc)
+		if err == nil {
+			err = d.DataTo(&fsym)
+		}
+		if err != nil && grpc.Code(err) != codes.NotFound {
+			return err
+		}
+		var packages []string
+		for _, k := range fsym.Packages {
+			if k != pkgKey {
+				packages = append(packages, k)
+			}
+		}
+		if unused = len(packages) == 0; unused {
+			return tx.Delete(doc)
+		}
+		return tx.Set(doc, firestoreSymbol{Packages: packages})
+	})
+	if err != nil || !unused {
+		return err
+	}
+
+	// Delete the file now nothing uses it
+	if err := fs.bucket.Object(name).Delete(fs.ctx); err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
+}
+
+// writeObject creates an object in the bucket, filling it from write
+func (fs *fileStoreGCP) writeObject(name string, write func(w io.Writer) error) error {
+	wc := fs.bucket.Object(name).NewWriter(fs.ctx)
+	wc.ContentType = "application/octet-stream"
+	if err := write(wc); err != nil {
+		wc.Close()
+		return err
+	}
+	return wc.Close()
 }
 
 func (fs *fileStoreGCP) getPackageExtras(id string) (*packagesExtra, error) {
@@ -185,7 +420,7 @@ func (fs *fileStoreGCP) getPackageExtras(id string) (*packagesExtra, error) {
 func (fs *fileStoreGCP) GetPackageEntry(id string, ver string) (*NugetPackageEntry, error) {
 
 	// Fetch this document
-	d, err := fs.firestore.Collection("Nuget-Packages").Doc(id + "." + ver).Get(fs.ctx)
+	d, err := fs.getPackageDoc(id, ver)
 	if err != nil {
 		return nil, err
 	}
@@ -195,44 +430,75 @@ func (fs *fileStoreGCP) GetPackageEntry(id string, ver string) (*NugetPackageEnt
 	if err := d.DataTo(&npe); err != nil {
 		return nil, err
 	}
+	// Entries saved before listing was tracked are listed
+	npe.SetListed(npe.IsListed())
 
-	pe, err := fs.getPackageExtras(id)
+	pe, err := fs.getPackageExtras(npe.Properties.ID)
 	if err != nil {
 		return nil, err
 	}
-	// Get download count for this id all versions
-	npe.Properties.DownloadCount.Value = pe.Downloads
-	// Get latest version and compare to this
-	npe.Properties.IsLatestVersion.Value = pe.Latest == ver
-	npe.Properties.IsAbsoluteLatestVersion.Value = pe.Latest == ver
+	// Get download count for this id all versions and compare to latest versions
+	pe.Apply(npe)
 
-	// TODO: Returns 500 error when no matching package - should return 404
 	return npe, nil
 }
 
+// getPackageDoc returns the document for a package, matching the version in any equivalent form
+func (fs *fileStoreGCP) getPackageDoc(id string, ver string) (*firestore.DocumentSnapshot, error) {
+
+	// Check for the normalized key, then the version as given for documents saved before versions were normalized
+	for _, key := range []string{gcpPackageKey(id, ver), id + "." + ver} {
+		d, err := fs.firestore.Collection("Nuget-Packages").Doc(key).Get(fs.ctx)
+		if err == nil {
+			return d, nil
+		} else if grpc.Code(err) != codes.NotFound {
+			return nil, err
+		}
+	}
+
+	// Check all versions of this ID for a normalized match (e.g. 1.0 and 1.0.0)
+	iter := fs.firestore.Collection("Nuget-Packages").Where("Properties.IDLowerCase", "==", strings.ToLower(id)).Documents(fs.ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var npe *NugetPackageEntry
+		if err := d.DataTo(&npe); err != nil {
+			return nil, err
+		}
+		if sameVersion(npe.Properties.Version, ver) {
+			return d, nil
+		}
+	}
+
+	return nil, ErrFileNotFound
+}
+
 func (fs *fileStoreGCP) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
 
-	// Increment max to get one more than we need, to use to detect if another page exists
-	max = max + 1
 	// Create new empty feed
 	var f []*NugetPackageEntry
-	// Create new itterator
-	var iter *firestore.DocumentIterator
 	// Create map of extra details so only looked up once per id
 	extras := make(map[string]*packagesExtra)
-	// Populate Itterator
+	// Build the query, in document order so startAfter needs no document to exist
+	q := fs.firestore.Collection("Nuget-Packages").OrderBy(firestore.DocumentID, firestore.Asc)
+	if id != "" {
+		q = q.Where("Properties.IDLowerCase", "==", strings.ToLower(id))
+	}
 	if startAfter != "" {
-		// Get specific APIKey entry
-		d, err := fs.firestore.Collection("Nuget-Packages").Doc(startAfter).Get(fs.ctx)
-		if err != nil {
-			return nil, false, err
-		}
-		iter = fs.firestore.Collection("Nuget-Packages").StartAfter(d).Limit(max).Documents(fs.ctx)
-	} else if id != "" {
-		iter = fs.firestore.Collection("Nuget-Packages").Limit(max).Where("Properties.IDLowerCase", "==", strings.ToLower(id)).Documents(fs.ctx)
-	} else {
-		iter = fs.firestore.Collection("Nuget-Packages").Limit(max).Documents(fs.ctx)
+		q = q.StartAfter(startAfter)
+	}
+	// Get two more than we need, one may be a startAfter given with an unnormalized version and one
+	// detects if another page exists (max of zero is no limit)
+	if max > 0 {
+		q = q.Limit(max + 2)
 	}
+	// Create new itterator
+	iter := q.Documents(fs.ctx)
 	// Cycle Iterator
 	for {
 		// Get next
@@ -249,6 +515,12 @@ func (fs *fileStoreGCP) GetPackageFeedEntries(id string, startAfter string, max
 		if err := doc.DataTo(&e); err != nil {
 			return nil, false, err
 		}
+		// Skip the entry startAfter names if it was given with an unnormalized version
+		if startAfter != "" && strings.EqualFold(e.Filename(), startAfter+".nupkg") {
+			continue
+		}
+		// Entries saved before listing was tracked are listed
+		e.SetListed(e.IsListed())
 		// Get extras if not in map already
 		if _, ok := extras[e.Properties.ID]; !ok {
 			extra, err := fs.getPackageExtras(e.Properties.ID)
@@ -258,38 +530,51 @@ func (fs *fileStoreGCP) GetPackageFeedEntries(id string, startAfter string, max
 			extras[e.Properties.ID] = extra
 		}
 		// Add extra details to entry
-		e.Properties.DownloadCount.Value = extras[e.Properties.ID].Downloads
-		e.Properties.IsLatestVersion.Value = extras[e.Properties.ID].Latest == e.Properties.Version
-		e.Properties.IsAbsoluteLatestVersion.Value = extras[e.Properties.ID].Latest == e.Properties.Version
+		extras[e.Properties.ID].Apply(e)
 		// Add in to list
 		f = append(f, e)
 	}
 
 	// Check array has no more
-	if len(f) < max {
+	if max <= 0 || len(f) <= max {
 		return f, false, nil
 	}
 	// Remove end
-	f = f[:len(f)-1]
+	f = f[:max]
 	return f, true, nil
 }
 
-func (fs *fileStoreGCP) GetPackageFile(id string, ver string) ([]byte, string, error) {
+func (fs *fileStoreGCP) GetPackageFile(id string, ver string, download bool) (storeFile, string, error) {
 
-	// Set the filename
-	key := id + "." + ver
+	// Resolve the stored form of the id and version
+	d, err := fs.getPackageDoc(id, ver)
+	if err != nil {
+		return nil, "", err
+	}
+	var npe *NugetPackageEntry
+	if err := d.DataTo(&npe); err != nil {
+		return nil, "", err
+	}
+	id = npe.Properties.ID
 
-	// Get the file
-	b, _, err := fs.GetFile(path.Join(id, ver, key+".nupkg"))
+	// Get the file, the package hash is its ETag
+	f, _, err := fs.openPackageObject(npe, gcpPackageKey(id, npe.Properties.Version)+".nupkg")
 	if err != nil {
 		return nil, "", err
 	}
+	f.etag = npe.Properties.PackageHash
+
+	// Only whole downloads are counted
+	if !download {
+		return f, "binary/octet-stream", nil
+	}
 
 	// Increment this verson's download count
-	_, err = fs.firestore.Collection("Nuget-Packages").Doc(key).Update(fs.ctx, []firestore.Update{
+	_, err = d.Ref.Update(fs.ctx, []firestore.Update{
 		{Path: "Properties.VersionDownloadCount.Value", Value: firestore.Increment(1)},
 	})
 	if err != nil {
+		f.Close()
 		return nil, "", err
 	}
 
@@ -298,14 +583,71 @@ func (fs *fileStoreGCP) GetPackageFile(id string, ver string) ([]byte, string, e
 		{Path: "Downloads", Value: firestore.Increment(1)},
 	})
 	if err != nil {
+		f.Close()
 		return nil, "", err
 	}
 
 	// Return it
-	return b, "binary/octet-stream", nil
+	return f, "binary/octet-stream", nil
+}
+
+func (fs *fileStoreGCP) GetFile(f string) (storeFile, string, error) {
+	or, c, err := fs.openObject(f)
+	if err == ErrFileNotFound {
+		// Files of packages stored before versions were normalized are under the version as pushed
+		parts := strings.SplitN(strings.TrimPrefix(f, "/"), "/", 3)
+		if len(parts) < 3 || strings.HasPrefix(parts[0], "_") {
+			return nil, "", err
+		}
+		d, err := fs.getPackageDoc(parts[0], parts[1])
+		if err != nil {
+			return nil, "", err
+		}
+		var npe *NugetPackageEntry
+		if err := d.DataTo(&npe); err != nil {
+			return nil, "", err
+		}
+		if or, c, err = fs.openPackageObject(npe, parts[2]); err != nil {
+			return nil, "", err
+		}
+		return or, c, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return or, c, nil
 }
 
-func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
+// openPackageObject opens a file by its path within a package's directory, falling back to the directory
+// of the version as pushed for packages stored before versions were normalized
+func (fs *fileStoreGCP) openPackageObject(npe *NugetPackageEntry, rel string) (*gcpObjectReader, string, error) {
+
+	dirs := fs.packageDirs(npe)
+	or, c, err := fs.openObject(path.Join(dirs[0], rel))
+	if err != ErrFileNotFound || len(dirs) == 1 {
+		return or, c, err
+	}
+
+	// The package files are named by the version too
+	norm := gcpPackageKey(npe.Properties.ID, npe.Properties.Version)
+	if strings.HasPrefix(rel, norm+".") {
+		rel = npe.Properties.ID + "." + npe.Properties.Version + strings.TrimPrefix(rel, norm)
+	}
+	return fs.openObject(path.Join(dirs[1], rel))
+}
+
+// packageDirs returns the directory of a package's files, and the directory of the version as pushed
+// if it differs, where packages stored before versions were normalized keep theirs
+func (fs *fileStoreGCP) packageDirs(npe *NugetPackageEntry) []string {
+	dirs := []string{packageStoreDir(npe.Properties.ID, npe.Properties.Version)}
+	if legacy := path.Join(npe.Properties.ID, npe.Properties.Version); legacy != dirs[0] {
+		dirs = append(dirs, legacy)
+	}
+	return dirs
+}
+
+// openObject finds an object in the bucket, falling back to a lowercase filename
+func (fs *fileStoreGCP) openObject(f string) (*gcpObjectReader, string, error) {
 
 	if strings.HasPrefix(f, `/`) {
 		f = f[1:]
@@ -320,7 +662,7 @@ func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
 		fn := path.Base(f)
 		fp := path.Join(d, strings.ToLower(fn))
 		obj = fs.bucket.Object(fp)
-		_, err = obj.Attrs(fs.ctx)
+		a, err = obj.Attrs(fs.ctx)
 		if err == storage.ErrObjectNotExist {
 			// ToDo: Full loop of directory contents on ToLower comparison of full
 			// path looking for match
@@ -332,73 +674,167 @@ func (fs *fileStoreGCP) GetFile(f string) ([]byte, string, error) {
 		return nil, "", err
 	}
 
-	r, err := obj.NewReader(fs.ctx)
+	// Contents are read from the bucket as they are needed
+	return &gcpObjectReader{ctx: fs.ctx, obj: obj, size: a.Size, modTime: a.Updated, etag: a.Etag}, a.ContentType, nil
+}
+
+// gcpObjectReader streams an object from the bucket, seeking reopens the object at the new offset
+type gcpObjectReader struct {
+	ctx     context.Context
+	obj     *storage.ObjectHandle
+	size    int64
+	offset  int64
+	r       *storage.Reader
+	modTime time.Time
+	etag    string
+}
+
+func (or *gcpObjectReader) Read(p []byte) (int, error) {
+	if or.offset >= or.size {
+		return 0, io.EOF
+	}
+	if or.r == nil {
+		r, err := or.obj.NewRangeReader(or.ctx, or.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		or.r = r
+	}
+	n, err := or.r.Read(p)
+	or.offset += int64(n)
+	return n, err
+}
+
+func (or *gcpObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += or.offset
+	case io.SeekEnd:
+		offset += or.size
+	}
+	if offset < 0 {
+		return 0, &FileStoreError{"Invalid Seek Offset"}
+	}
+	if offset != or.offset {
+		or.Close()
+		or.offset = offset
+	}
+	return offset, nil
+}
+
+func (or *gcpObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= or.size {
+		return 0, io.EOF
+	}
+	r, err := or.obj.NewRangeReader(or.ctx, off, int64(len(p)))
 	if err != nil {
-		return nil, "", err
+		return 0, err
 	}
 	defer r.Close()
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, "", err
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
 	}
-
-	return b, a.ContentType, nil
+	return n, err
 }
 
-// FirestoreAPIKey represents a ApiKey as stored in Firebase
-type FirestoreAPIKey struct {
-	Reference string
-	Access    string
+func (or *gcpObjectReader) ModTime() time.Time {
+	return or.modTime
 }
 
-func (fs *fileStoreGCP) GetAccessLevel(key string) (access, error) {
+func (or *gcpObjectReader) ETag() string {
+	return or.etag
+}
 
-	// Set default variables
-	var err error
-	a := accessDenied
-	var iter *firestore.DocumentIterator
-
-	// Check for case where no ReadOnly keys are in place
-	iter = fs.firestore.Collection("Nuget-APIKeys").Where("Access", "==", "ReadOnly").Documents(fs.ctx)
-	_, err = iter.Next()
-	// Attempt to advance to first in the list
-	if err == iterator.Done {
-		// No ReadWrite keys were found, default access becomes ReadOnly
-		a = accessReadOnly
-	} else if err != nil {
-		// Another error happened, return no access and error
-		return a, err
+func (or *gcpObjectReader) Close() error {
+	if or.r == nil {
+		return nil
 	}
+	err := or.r.Close()
+	or.r = nil
+	return err
+}
 
-	// Check for case where no keys are declared yet - dev mode
-	iter = fs.firestore.Collection("Nuget-APIKeys").Documents(fs.ctx)
-	_, err = iter.Next()
-	// Attempt to advance to first in the list
-	if err == iterator.Done {
-		// No ReadWrite keys were found, access granted as server in dev mode
-		return accessReadWrite, nil
+// gcpPackageKey returns the name of a package's document, by its normalized version
+func gcpPackageKey(id string, ver string) string {
+	return packageName(id, ver)
+}
+
+// gcpSymbolKey returns the name of the document listing the packages using a symbol file,
+// the file's path in the store with its slashes replaced as document names can't hold them
+func gcpSymbolKey(name string) string {
+	return strings.ReplaceAll(strings.TrimPrefix(name, symbolsDir+"/"), "/", ":")
+}
+
+// firestoreSymbol lists the package documents using a symbol file
+type firestoreSymbol struct {
+	Packages []string
+}
+
+// firestoreOwner is the owner of a package ID or reserved prefix, named by the lowercase ID or prefix
+type firestoreOwner struct {
+	Owner string
+}
+
+// getPackageOwner returns the owner of an ID, or an empty string if it has none
+func (fs *fileStoreGCP) getPackageOwner(id string) (string, error) {
+	d, err := fs.firestore.Collection("Nuget-Package-Owners").Doc(strings.ToLower(id)).Get(fs.ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return "", nil
 	} else if err != nil {
-		// Another error happened, return no access and error
-		return a, err
+		return "", err
 	}
-
-	// Get specific APIKey entry
-	k := FirestoreAPIKey{}
-	d, err := fs.firestore.Collection("Nuget-APIKeys").Doc(key).Get(fs.ctx)
-	if err != nil {
-		return a, nil
+	o := firestoreOwner{}
+	if err := d.DataTo(&o); err != nil {
+		return "", err
 	}
-	// Convert to local structure
-	if err := d.DataTo(&k); err != nil {
-		return a, nil
+	return o.Owner, nil
+}
+
+func (fs *fileStoreGCP) GetPackageOwners() (map[string]string, error) {
+	return fs.getOwners("Nuget-Package-Owners")
+}
+
+func (fs *fileStoreGCP) SetPackageOwner(id string, owner string) error {
+	return fs.setOwner("Nuget-Package-Owners", id, owner)
+}
+
+func (fs *fileStoreGCP) GetReservedPrefixes() (map[string]string, error) {
+	return fs.getOwners("Nuget-Reserved-Prefixes")
+}
+
+func (fs *fileStoreGCP) SetReservedPrefix(prefix string, owner string) error {
+	return fs.setOwner("Nuget-Reserved-Prefixes", prefix, owner)
+}
+
+// getOwners returns the owners in a collection by document name
+func (fs *fileStoreGCP) getOwners(collection string) (map[string]string, error) {
+	owners := make(map[string]string)
+	iter := fs.firestore.Collection(collection).Documents(fs.ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		o := firestoreOwner{}
+		if err := d.DataTo(&o); err != nil {
+			return nil, err
+		}
+		owners[d.Ref.ID] = o.Owner
 	}
-	// Grant access if permission present on key
-	switch k.Access {
-	case "ReadWrite":
-		a = accessReadWrite
-	case "ReadOnly":
-		a = accessReadOnly
+	return owners, nil
+}
+
+// setOwner sets the owner of a lowercase ID or prefix, an empty owner removes it
+func (fs *fileStoreGCP) setOwner(collection string, name string, owner string) error {
+	doc := fs.firestore.Collection(collection).Doc(strings.ToLower(name))
+	if owner == "" {
+		_, err := doc.Delete(fs.ctx)
+		return err
 	}
-	// Deny access if not
-	return a, nil
+	_, err := doc.Set(fs.ctx, firestoreOwner{Owner: owner})
+	return err
 }
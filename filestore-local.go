@@ -1,22 +1,51 @@
 package main
 
 import (
-	"archive/zip"
-	"bytes"
-	"crypto/sha512"
-	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory in the repo holding the state files, the underscore keeps it clear of package IDs and GetFile never serves it
+const localStateDir = "_state"
 
-	nuspec "github.com/soloworks/go-nuspec"
+// Names of the files used to persist download counts, unlisted packages, owners and symbol users in the state directory
+const (
+	localDownloadsFile = "downloads.json"
+	localUnlistedFile  = "unlisted.json"
+	localOwnersFile    = "owners.json"
+	localPrefixesFile  = "prefixes.json"
+	localSymbolsFile   = "symbols.json"
 )
 
+// How often changed download counts are saved, they are kept in memory so downloads don't each rewrite the file
+const localDownloadsFlushInterval = 30 * time.Second
+
 type fileStoreLocal struct {
-	rootDir  string
-	packages []*NugetPackageEntry
+	rootDir   string
+	packages  []*NugetPackageEntry
+	downloads map[string]int
+	unlisted  map[string]bool
+	owners    map[string]string          // Owner by lowercase ID
+	prefixes  map[string]string          // Owner by lowercase reserved ID prefix
+	symbols   map[string]map[string]bool // Packages using each symbol file, as builds can share a PDB
+	mutex     sync.RWMutex
+	// Download counts changed since they were last saved
+	downloadsDirty bool
+	flushMutex     sync.Mutex
+	// Saves download counts in the background until Close
+	flushTicker *time.Ticker
+	flushStop   chan struct{}
 }
 
 func (fs *fileStoreLocal) Init(s *Server) error {
@@ -34,18 +63,71 @@ func (fs *fileStoreLocal) Init(s *Server) error {
 		}
 	}
 
+	// Create the state directory
+	if err := os.MkdirAll(filepath.Join(fs.rootDir, localStateDir), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Load the download counts and unlisted packages (files will not exist on a fresh repo)
+	fs.downloads = make(map[string]int)
+	if err := fs.readState(localDownloadsFile, &fs.downloads); err != nil {
+		return err
+	}
+	fs.unlisted = make(map[string]bool)
+	if err := fs.readState(localUnlistedFile, &fs.unlisted); err != nil {
+		return err
+	}
+
+	// Load the package owners and reserved prefixes
+	fs.owners = make(map[string]string)
+	if err := fs.readState(localOwnersFile, &fs.owners); err != nil {
+		return err
+	}
+	fs.prefixes = make(map[string]string)
+	if err := fs.readState(localPrefixesFile, &fs.prefixes); err != nil {
+		return err
+	}
+
+	// Load the packages using each symbol file
+	fs.symbols = make(map[string]map[string]bool)
+	if err := fs.readState(localSymbolsFile, &fs.symbols); err != nil {
+		return err
+	}
+
 	// Refresh Packages
 	err := fs.RefeshPackages()
 	if err != nil {
 		return err
 	}
 
+	// Save download counts in the background
+	fs.flushTicker = time.NewTicker(localDownloadsFlushInterval)
+	fs.flushStop = make(chan struct{})
+	go func(t *time.Ticker, stop chan struct{}) {
+		for {
+			select {
+			case <-t.C:
+				if err := fs.FlushDownloads(); err != nil {
+					log.Println("Error saving download counts:", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(fs.flushTicker, fs.flushStop)
+
 	// Return repo
 	return nil
 }
 
 func (fs *fileStoreLocal) RefeshPackages() error {
 
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Start from an empty list
+	fs.packages = nil
+
 	// Read in all files in directory root
 	IDs, err := ioutil.ReadDir(fs.rootDir)
 	if err != nil {
@@ -54,8 +136,8 @@ func (fs *fileStoreLocal) RefeshPackages() error {
 
 	// Loop through all directories (first level is lowercase IDs)
 	for _, ID := range IDs {
-		// Check if this is a directory
-		if ID.IsDir() {
+		// Check if this is a package directory (underscore prefix is reserved for static files)
+		if ID.IsDir() && !strings.HasPrefix(ID.Name(), "_") {
 			// Search files in directory (second level is versions)
 			Vers, err := ioutil.ReadDir(filepath.Join(fs.rootDir, ID.Name()))
 			if err != nil {
@@ -64,20 +146,29 @@ func (fs *fileStoreLocal) RefeshPackages() error {
 			for _, Ver := range Vers {
 				// Check if this is a directory
 				if Ver.IsDir() {
+					// Move directories stored before versions were normalized
+					ver, err := fs.migratePackageDir(ID.Name(), Ver.Name())
+					if err != nil {
+						log.Println("Error: Cannot move package directory")
+						log.Println(err)
+						continue
+					}
 					// Create full filepath
-					fp := filepath.Join(fs.rootDir, ID.Name(), Ver.Name(), ID.Name()+"."+Ver.Name()+".nupkg")
+					fp := filepath.Join(fs.rootDir, ID.Name(), ver, ID.Name()+"."+ver+".nupkg")
 					if _, err := os.Stat(fp); os.IsNotExist(err) {
 						log.Println("Not a nupkg directory")
-						break
+						continue
 					}
 					err = fs.LoadPackage(fp)
 					if err != nil {
 						log.Println("Error: Cannot load package")
 						log.Println(err)
-						break
+						continue
 					}
 				}
 			}
+			// Set the latest version and download counts for this ID
+			fs.updateExtras(ID.Name())
 		}
 	}
 
@@ -86,128 +177,722 @@ func (fs *fileStoreLocal) RefeshPackages() error {
 	return nil
 }
 
+// LoadPackage reads a .nupkg from disk into the in memory list, caller must hold the lock
 func (fs *fileStoreLocal) LoadPackage(fp string) error {
 
-	// Open and read in the file (Is a Zip file under the hood)
-	content, err := ioutil.ReadFile(fp)
+	// Open the file (Is a Zip file under the hood)
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.Stat(fp)
+	// Read the .nuspec from the package
+	pa, err := openPackage(f)
 	if err != nil {
 		return err
 	}
 
-	// Set up a zipReader
-	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	// Read Entry into memory
+	p := NewNugetPackageEntry(pa.nsf, pa.ne)
+	p.Properties.Frameworks = packageFrameworks(pa.names, pa.ne)
+
+	// Set Updated to match file
+	p.Properties.Created.Value = fi.ModTime().Format(zuluTimeLayout)
+	p.Properties.LastEdited.Value = fi.ModTime().Format(zuluTimeLayout)
+	p.Properties.Published.Value = fi.ModTime().Format(zuluTimeLayout)
+	p.Updated = fi.ModTime().Format(zuluTimeLayout)
+	// Get and Set file hash
+	hash, size, err := hashPackage(f)
 	if err != nil {
 		return err
 	}
+	p.Properties.PackageHash = hash
+	p.Properties.PackageHashAlgorithm = `SHA512`
+	p.Properties.PackageSize.Value = int(size)
+	p.Properties.PackageSize.Type = "Edm.Int64"
+	// Set this version's download count and listing
+	if err := fs.migratePackageKey(p.Properties.ID, p.Properties.Version); err != nil {
+		return err
+	}
+	p.Properties.VersionDownloadCount.Value = fs.downloads[localPackageKey(p.Properties.ID, p.Properties.Version)]
+	p.SetListed(!fs.unlisted[localPackageKey(p.Properties.ID, p.Properties.Version)])
+	// Insert this into the array in order
+	index := sort.Search(len(fs.packages), func(i int) bool { return fs.packages[i].Filename() > p.Filename() })
+	x := NugetPackageEntry{}
+	fs.packages = append(fs.packages, &x)
+	copy(fs.packages[index+1:], fs.packages[index:])
+	fs.packages[index] = p
 
-	// NugetPackage Object
-	var p *NugetPackageEntry
+	return nil
+}
 
-	// Find and Process the .nuspec file
-	for _, zipFile := range zipReader.File {
-		// If this is the root .nuspec file read it into a NewspecFile structure
-		if filepath.Dir(zipFile.Name) == "." && filepath.Ext(zipFile.Name) == ".nuspec" {
-			// Marshall XML into Structure
-			rc, err := zipFile.Open()
-			if err != nil {
-				return err
-			}
-			b, err := ioutil.ReadAll(rc)
-			if err != nil {
-				return err
+// RemovePackage removes a package from the in memory list and deletes its directory
+func (fs *fileStoreLocal) RemovePackage(id string, ver string) error {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Find the package
+	p := fs.findPackage(id, ver)
+	if p == nil {
+		return ErrFileNotFound
+	}
+
+	// Remove the Package from the list
+	for i := range fs.packages {
+		if fs.packages[i] == p {
+			fs.packages = append(fs.packages[:i], fs.packages[i+1:]...)
+			break
+		}
+	}
+	fs.updateExtras(p.Properties.IDLowerCase)
+
+	// Forget its download count and listing
+	k := localPackageKey(p.Properties.ID, p.Properties.Version)
+	delete(fs.downloads, k)
+	fs.downloadsDirty = true
+	delete(fs.unlisted, k)
+	if err := fs.writeState(localUnlistedFile, fs.unlisted); err != nil {
+		return err
+	}
+
+	// Delete the symbols indexed from the symbol package that no other package uses
+	if f, err := os.Open(fs.storePath(packageStoreFile(p.Properties.ID, p.Properties.Version, ".snupkg"))); err == nil {
+		if pa, err := openPackage(f); err == nil {
+			symbols, _ := symbolFiles(pa)
+			for name := range symbols {
+				delete(fs.symbols[name], k)
+				if len(fs.symbols[name]) > 0 {
+					continue
+				}
+				delete(fs.symbols, name)
+				// Remove the file and its key directories if now empty
+				fp := filepath.Join(fs.rootDir, filepath.FromSlash(name))
+				os.Remove(fp)
+				os.Remove(filepath.Dir(fp))
+				os.Remove(filepath.Dir(filepath.Dir(fp)))
 			}
-			// Read into NuspecFile structure
-			nsf, err := nuspec.FromBytes(b)
-
-			// Read Entry into memory
-			p = NewNugetPackageEntry(nsf)
-
-			// Set Updated to match file
-			p.Properties.Created.Value = f.ModTime().Format(zuluTimeLayout)
-			p.Properties.LastEdited.Value = f.ModTime().Format(zuluTimeLayout)
-			p.Properties.Published.Value = f.ModTime().Format(zuluTimeLayout)
-			p.Updated = f.ModTime().Format(zuluTimeLayout)
-			// Get and Set file hash
-			h := sha512.Sum512(content)
-			p.Properties.PackageHash = hex.EncodeToString(h[:])
-			p.Properties.PackageHashAlgorithm = `SHA512`
-			p.Properties.PackageSize.Value = len(content)
-			p.Properties.PackageSize.Type = "Edm.Int64"
-			// Insert this into the array in order
-			index := sort.Search(len(fs.packages), func(i int) bool { return fs.packages[i].Filename() > p.Filename() })
-			x := NugetPackageEntry{}
-			fs.packages = append(fs.packages, &x)
-			copy(fs.packages[index+1:], fs.packages[index:])
-			fs.packages[index] = p
+		}
+		f.Close()
+		if err := fs.writeState(localSymbolsFile, fs.symbols); err != nil {
+			return err
 		}
 	}
 
+	// Delete the contents directory, and the ID directory if now empty
+	if err := os.RemoveAll(fs.storePath(packageStoreDir(p.Properties.ID, p.Properties.Version))); err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(fs.rootDir, p.Properties.IDLowerCase))
 	return nil
 }
 
-func (fs *fileStoreLocal) RemovePackage(fn string) {
-	// Remove the Package from the Map
-	for i, p := range fs.packages {
-		if p.Filename() == fn {
-			fs.packages = append(fs.packages[:i], fs.packages[i+1:]...)
-		}
+func (fs *fileStoreLocal) SetPackageListed(id string, ver string, listed bool) error {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Find the package
+	p := fs.findPackage(id, ver)
+	if p == nil {
+		return ErrFileNotFound
 	}
-	// Delete the contents directory
-	os.RemoveAll(filepath.Join(fs.rootDir, `content`, fn))
+
+	// Update the entry and the latest versions for this ID
+	p.SetListed(listed)
+	fs.updateExtras(p.Properties.IDLowerCase)
+
+	// Persist the unlisted packages
+	k := localPackageKey(p.Properties.ID, p.Properties.Version)
+	if listed {
+		delete(fs.unlisted, k)
+	} else {
+		fs.unlisted[k] = true
+	}
+	return fs.writeState(localUnlistedFile, fs.unlisted)
 }
 
-func (fs *fileStoreLocal) StorePackage(pkg []byte) (bool, error) {
-	/*
-		// Test for folder, if present bail, if not make it
-		// Fixme: Broke this to get to compile
-		packagePath := filepath.Join(c.FileStore.RepoDIR, strings.ToLower(nsf.Meta.ID), nsf.Meta.Version)
-		if _, err := os.Stat(packagePath); !os.IsNotExist(err) {
-			// Path already exists
-			w.WriteHeader(http.StatusConflict)
-			return
+func (fs *fileStoreLocal) StorePackage(pkg packageReader, owner string) (bool, error) {
+
+	// Read the .nuspec from the package
+	pa, err := openPackage(pkg)
+	if err != nil {
+		return false, err
+	}
+	nsf := pa.nsf
+
+	// Paths are built from the ID and version so check them first
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return false, err
+	}
+
+	// Generate local variables for ease
+	id := strings.ToLower(nsf.Meta.ID)
+	packagePath := fs.storePath(packageStoreDir(id, nsf.Meta.Version))
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Check the ID can be pushed to by this owner
+	owner, err = checkPackageOwner(fs.owners[id], fs.prefixes, id, owner)
+	if err != nil {
+		return false, err
+	}
+
+	// Test for the version or its folder, if present bail, if not make it
+	if fs.findPackage(id, nsf.Meta.Version) != nil {
+		return true, nil
+	}
+	if _, err := os.Stat(packagePath); !os.IsNotExist(err) {
+		// Path already exists
+		return true, nil
+	}
+	log.Println("Creating Directory: ", packagePath)
+	err = os.MkdirAll(packagePath, os.ModePerm)
+	if err != nil {
+		return false, err
+	}
+
+	// Remove the directory if the package isn't stored, a partial one would block every later push of this version
+	stored := false
+	defer func() {
+		if !stored {
+			os.RemoveAll(packagePath)
+			os.Remove(filepath.Dir(packagePath))
 		}
-		err = os.MkdirAll(packagePath, os.ModePerm)
+	}()
+
+	// Save Files (skipping directory entries)
+	for _, zf := range pa.zip.File {
+		if strings.HasSuffix(zf.Name, "/") {
+			continue
+		}
+		fp, err := fs.localPath(packagePath, zf.Name)
 		if err != nil {
-			println(err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return false, err
 		}
-		log.Println("Creating Directory: ", packagePath)
+		if err := writeLocalFile(fp, func(w io.Writer) error { return copyZipFile(w, zf) }); err != nil {
+			return false, err
+		}
+	}
+
+	// Dump the .nupkg file in the same directory
+	fp := fs.storePath(packageStoreFile(id, nsf.Meta.Version, ".nupkg"))
+	if err := writeLocalFile(fp, func(w io.Writer) error { return copyPackage(w, pkg) }); err != nil {
+		return false, err
+	}
+
+	// Read the new package into memory
+	if err := fs.LoadPackage(fp); err != nil {
+		return false, err
+	}
+	stored = true
+	fs.updateExtras(id)
+
+	// Record the owner of a new ID
+	if owner != "" && fs.owners[id] == "" {
+		fs.owners[id] = owner
+		if err := fs.writeState(localOwnersFile, fs.owners); err != nil {
+			return false, err
+		}
+	}
 
-		// Dump the .nupkg file in the same directory
-		err = ioutil.WriteFile(filepath.Join(packagePath, strings.ToLower(nsf.Meta.ID)+"."+nsf.Meta.Version+".nupkg"), body, os.ModePerm)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}*/
 	return false, nil
 }
 
+func (fs *fileStoreLocal) StoreSymbolPackage(pkg packageReader, owner string) (bool, error) {
+
+	// Read the .nuspec from the package
+	pa, err := openPackage(pkg)
+	if err != nil {
+		return false, err
+	}
+	nsf := pa.nsf
+
+	// Paths are built from the ID and version so check them first
+	if err := checkPackageIdentity(nsf.Meta.ID, nsf.Meta.Version); err != nil {
+		return false, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Symbols can only be added to an existing package
+	p := fs.findPackage(nsf.Meta.ID, nsf.Meta.Version)
+	if p == nil {
+		return false, ErrFileNotFound
+	}
+
+	// Check the ID can be pushed to by this owner
+	if _, err := checkPackageOwner(fs.owners[p.Properties.IDLowerCase], fs.prefixes, p.Properties.IDLowerCase, owner); err != nil {
+		return false, err
+	}
+
+	// Test for an existing symbol package, if present bail
+	fp := fs.storePath(packageStoreFile(p.Properties.ID, p.Properties.Version, ".snupkg"))
+	if _, err := os.Stat(fp); !os.IsNotExist(err) {
+		return true, nil
+	}
+
+	// Save the symbol files by their key, refusing packages with symbols that can't be read
+	symbols, err := symbolFiles(pa)
+	if err != nil {
+		return false, err
+	}
+	for name, zf := range symbols {
+		sp, err := fs.localPath(fs.rootDir, name)
+		if err != nil {
+			return false, err
+		}
+		if err := writeLocalFile(sp, func(w io.Writer) error { return copyZipFile(w, zf) }); err != nil {
+			return false, err
+		}
+	}
+
+	// Dump the .snupkg file beside the .nupkg
+	if err := writeLocalFile(fp, func(w io.Writer) error { return copyPackage(w, pkg) }); err != nil {
+		return false, err
+	}
+
+	// Record the package as a user of its symbol files
+	k := localPackageKey(p.Properties.ID, p.Properties.Version)
+	for name := range symbols {
+		if fs.symbols[name] == nil {
+			fs.symbols[name] = make(map[string]bool)
+		}
+		fs.symbols[name][k] = true
+	}
+	return false, fs.writeState(localSymbolsFile, fs.symbols)
+}
+
 func (fs *fileStoreLocal) GetPackageEntry(id string, ver string) (*NugetPackageEntry, error) {
 
-	return nil, nil
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	p := fs.findPackage(id, ver)
+	if p == nil {
+		return nil, ErrFileNotFound
+	}
+
+	// Return a copy so callers can't modify the cache
+	npe := *p
+	return &npe, nil
 }
 
 func (fs *fileStoreLocal) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
 
-	return nil, false, nil
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	// Create new empty feed
+	var f []*NugetPackageEntry
+
+	// Packages are sorted by filename so skip forward past startAfter if supplied, resuming after the
+	// package it names if present
+	i := 0
+	if startAfter != "" {
+		i = sort.Search(len(fs.packages), func(i int) bool {
+			return fs.packages[i].Filename() > startAfter+".nupkg"
+		})
+		for j, p := range fs.packages {
+			if strings.EqualFold(packageName(p.Properties.ID, p.Properties.Version), startAfter) {
+				i = j + 1
+				break
+			}
+		}
+	}
+
+	for ; i < len(fs.packages); i++ {
+		p := fs.packages[i]
+		// Filter on ID if requested
+		if id != "" && p.Properties.IDLowerCase != strings.ToLower(id) {
+			continue
+		}
+		// Return if there is more than requested (max of zero is no limit)
+		if max > 0 && len(f) == max {
+			return f, true, nil
+		}
+		// Add a copy in to list
+		e := *p
+		f = append(f, &e)
+	}
+
+	return f, false, nil
 }
 
-func (fs *fileStoreLocal) GetPackageFile(id string, ver string) ([]byte, string, error) {
+func (fs *fileStoreLocal) GetPackageFile(id string, ver string, download bool) (storeFile, string, error) {
 
-	return nil, "", nil
+	// Find the package
+	fs.mutex.RLock()
+	p := fs.findPackage(id, ver)
+	if p == nil {
+		fs.mutex.RUnlock()
+		return nil, "", ErrFileNotFound
+	}
+	fp := fs.storePath(packageStoreFile(p.Properties.ID, p.Properties.Version, ".nupkg"))
+	etag := p.Properties.PackageHash
+	fs.mutex.RUnlock()
+
+	// Get the file, the package hash is its ETag
+	f, err := openLocalFile(fp)
+	if err != nil {
+		return nil, "", err
+	}
+	f.etag = etag
+
+	// Only whole downloads are counted
+	if !download {
+		return f, "binary/octet-stream", nil
+	}
+
+	// Increment this verson's download count, if it hasn't been removed since, they are saved by FlushDownloads
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if p := fs.findPackage(id, ver); p != nil {
+		k := localPackageKey(p.Properties.ID, p.Properties.Version)
+		fs.downloads[k]++
+		p.Properties.VersionDownloadCount.Value = fs.downloads[k]
+		fs.updateExtras(p.Properties.IDLowerCase)
+		fs.downloadsDirty = true
+	}
+
+	// Return it
+	return f, "binary/octet-stream", nil
+}
+
+// FlushDownloads saves the download counts if they have changed since they were last saved
+func (fs *fileStoreLocal) FlushDownloads() error {
+
+	// Only one save at a time, so an older copy never overwrites a newer one
+	fs.flushMutex.Lock()
+	defer fs.flushMutex.Unlock()
+
+	// Copy the counts so downloads aren't held up while the file is written
+	fs.mutex.Lock()
+	if !fs.downloadsDirty {
+		fs.mutex.Unlock()
+		return nil
+	}
+	downloads := make(map[string]int, len(fs.downloads))
+	for k, n := range fs.downloads {
+		downloads[k] = n
+	}
+	fs.downloadsDirty = false
+	fs.mutex.Unlock()
+
+	// Try again next time if the save fails
+	if err := fs.writeState(localDownloadsFile, downloads); err != nil {
+		fs.mutex.Lock()
+		fs.downloadsDirty = true
+		fs.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops saving download counts in the background and saves them a last time
+func (fs *fileStoreLocal) Close() error {
+	if fs.flushTicker != nil {
+		fs.flushTicker.Stop()
+		close(fs.flushStop)
+		fs.flushTicker = nil
+	}
+	return fs.FlushDownloads()
+}
+
+func (fs *fileStoreLocal) GetFile(f string) (storeFile, string, error) {
+
+	// First level of the repo is lowercase IDs, and the second their lowercase normalized versions
+	f = strings.TrimPrefix(path.Clean("/"+f), "/")
+	parts := strings.SplitN(f, "/", 3)
+	parts[0] = strings.ToLower(parts[0])
+
+	// Only files within the package and static directories are served, never the state files
+	if len(parts) < 2 || parts[0] == localStateDir {
+		return nil, "", ErrFileNotFound
+	}
+	if len(parts) > 1 && !strings.HasPrefix(parts[0], "_") {
+		parts[1] = strings.ToLower(normalizeVersion(parts[1]))
+	}
+
+	// Resolve the path inside the repo
+	fp, err := fs.localPath(fs.rootDir, path.Join(parts...))
+	if err != nil {
+		return nil, "", ErrFileNotFound
+	}
+
+	// Check for exact match
+	file, err := openLocalFile(fp)
+	if err == ErrFileNotFound {
+		// Check for lowercase filename match (Due to zip file not keeping cases)
+		fp = filepath.Join(filepath.Dir(fp), strings.ToLower(filepath.Base(fp)))
+		file, err = openLocalFile(fp)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Work out the content type from extension, falling back to sniffing
+	c := mime.TypeByExtension(filepath.Ext(fp))
+	if c == "" {
+		if c, err = sniffContentType(file); err != nil {
+			file.Close()
+			return nil, "", err
+		}
+	}
+
+	return file, c, nil
+}
+
+func (fs *fileStoreLocal) GetPackageOwners() (map[string]string, error) {
+
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	// Return a copy so callers can't modify the cache
+	owners := make(map[string]string)
+	for id, o := range fs.owners {
+		owners[id] = o
+	}
+	return owners, nil
+}
+
+func (fs *fileStoreLocal) SetPackageOwner(id string, owner string) error {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// An empty owner removes the record
+	if owner == "" {
+		delete(fs.owners, strings.ToLower(id))
+	} else {
+		fs.owners[strings.ToLower(id)] = owner
+	}
+	return fs.writeState(localOwnersFile, fs.owners)
 }
-func (fs *fileStoreLocal) GetFile(f string) ([]byte, string, error) {
 
-	return nil, "", nil
+func (fs *fileStoreLocal) GetReservedPrefixes() (map[string]string, error) {
+
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	// Return a copy so callers can't modify the cache
+	prefixes := make(map[string]string)
+	for p, o := range fs.prefixes {
+		prefixes[p] = o
+	}
+	return prefixes, nil
+}
+
+func (fs *fileStoreLocal) SetReservedPrefix(prefix string, owner string) error {
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// An empty owner releases the prefix
+	if owner == "" {
+		delete(fs.prefixes, strings.ToLower(prefix))
+	} else {
+		fs.prefixes[strings.ToLower(prefix)] = owner
+	}
+	return fs.writeState(localPrefixesFile, fs.prefixes)
 }
 
-func (fs *fileStoreLocal) GetAccessLevel(key string) (access, error) {
+// findPackage returns the cached entry for id and version, caller must hold the lock
+func (fs *fileStoreLocal) findPackage(id string, ver string) *NugetPackageEntry {
+	for _, p := range fs.packages {
+		if p.Properties.IDLowerCase == strings.ToLower(id) && sameVersion(p.Properties.Version, ver) {
+			return p
+		}
+	}
+	return nil
+}
+
+// updateExtras sets download totals and latest flags for all versions of an ID, caller must hold the lock
+func (fs *fileStoreLocal) updateExtras(id string) {
+
+	// Local Extras object
+	pe := &packagesExtra{}
+
+	// Cycle through all packages with this ID to get the total and latest listed versions
+	for _, p := range fs.packages {
+		if p.Properties.IDLowerCase == id {
+			pe.Downloads += p.Properties.VersionDownloadCount.Value
+			if p.IsListed() {
+				pe.Update(p.Properties.Version)
+			}
+		}
+	}
+
+	// Add extra details to entries
+	for _, p := range fs.packages {
+		if p.Properties.IDLowerCase == id {
+			pe.Apply(p)
+		}
+	}
+}
+
+// statePath returns the local path of a file in the state directory
+func (fs *fileStoreLocal) statePath(name string) string {
+	return filepath.Join(fs.rootDir, localStateDir, name)
+}
+
+// readState reads a JSON file from the state directory into v, leaving v untouched if the file does not exist
+func (fs *fileStoreLocal) readState(name string, v interface{}) error {
+	b, err := ioutil.ReadFile(fs.statePath(name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeState saves v as a JSON file in the state directory, replacing the file so it is never left half written
+func (fs *fileStoreLocal) writeState(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fp := fs.statePath(name)
+	if err := ioutil.WriteFile(fp+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fp+".tmp", fp)
+}
+
+// storePath returns the local path of a package directory or file named by packageStoreDir or packageStoreFile,
+// package paths are lowercase
+func (fs *fileStoreLocal) storePath(name string) string {
+	return filepath.Join(fs.rootDir, filepath.FromSlash(strings.ToLower(name)))
+}
+
+// migratePackageDir renames a version directory stored before versions were normalized, and the packages in it,
+// returning the directory's name, caller must hold the lock
+func (fs *fileStoreLocal) migratePackageDir(id string, ver string) (string, error) {
+
+	norm := strings.ToLower(normalizeVersion(ver))
+	if norm == ver {
+		return ver, nil
+	}
+	dir := filepath.Join(fs.rootDir, id, ver)
+	newDir := filepath.Join(fs.rootDir, id, norm)
+
+	// Leave directories that don't hold a package
+	if _, err := os.Stat(filepath.Join(dir, id+"."+ver+".nupkg")); os.IsNotExist(err) {
+		return ver, nil
+	}
+
+	// Another form of the same version may have been stored since
+	if _, err := os.Stat(newDir); err == nil && !strings.EqualFold(norm, ver) {
+		return "", &FileStoreError{"Version " + ver + " of " + id + " is also stored as " + norm}
+	}
+
+	// Rename the packages then the directory
+	log.Println("Moving Directory: ", dir, "to", newDir)
+	for _, ext := range []string{".nupkg", ".snupkg"} {
+		err := os.Rename(filepath.Join(dir, id+"."+ver+ext), filepath.Join(dir, id+"."+norm+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+	return norm, os.Rename(dir, newDir)
+}
+
+// migratePackageKey moves a version's download count and listing saved before versions were normalized
+// to the normalized key, caller must hold the lock
+func (fs *fileStoreLocal) migratePackageKey(id string, ver string) error {
+
+	k := localPackageKey(id, ver)
+	old := strings.ToLower(id + "." + ver)
+	if old == k {
+		return nil
+	}
+	if n, ok := fs.downloads[old]; ok {
+		fs.downloads[k] += n
+		delete(fs.downloads, old)
+		fs.downloadsDirty = true
+	}
+	if fs.unlisted[old] {
+		fs.unlisted[k] = true
+		delete(fs.unlisted, old)
+		return fs.writeState(localUnlistedFile, fs.unlisted)
+	}
+	return nil
+}
+
+// localPath joins a slash separated name to dir, refusing anything outside of dir
+func (fs *fileStoreLocal) localPath(dir string, name string) (string, error) {
+	fp := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, fp)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &FileStoreError{"Invalid Path: " + name}
+	}
+	return fp, nil
+}
+
+// localFile is a file opened from the repo
+type localFile struct {
+	*os.File
+	modTime time.Time
+	etag    string
+}
+
+func (lf *localFile) ModTime() time.Time {
+	return lf.modTime
+}
+
+func (lf *localFile) ETag() string {
+	return lf.etag
+}
+
+// openLocalFile opens a file from the repo, the ETag defaults to its modified time and size
+func openLocalFile(fp string) (*localFile, error) {
+	f, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Directories are not files
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil, ErrFileNotFound
+	}
+
+	return &localFile{
+		File:    f,
+		modTime: fi.ModTime(),
+		etag:    fmt.Sprintf("%x-%x", fi.ModTime().UnixNano(), fi.Size()),
+	}, nil
+}
+
+// writeLocalFile creates a file and any missing directories, filling it from write
+func writeLocalFile(fp string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.Create(fp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	return accessDenied, nil
+// localPackageKey returns the key used for a package in the download counts and unlisted files
+func localPackageKey(id string, ver string) string {
+	return strings.ToLower(id + "." + normalizeVersion(ver))
 }
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Owner recorded for package IDs cached from the upstream feed, only IDs with no packages or this
+// owner are looked up upstream so a public package can never be mixed into a private ID
+const upstreamOwner = "upstream"
+
+// Most upstream listings kept, expired listings then the oldest are dropped to make room for more
+const proxyMaxListings = 10000
+
+// fileStoreProxy wraps a fileStore, fetching packages it doesn't have from an upstream feed and caching them in it
+type fileStoreProxy struct {
+	fileStore
+	url      string
+	allow    []string
+	deny     []string
+	ttl      time.Duration
+	upstream *upstreamFeed               // Created on first use so the server starts while the upstream is down
+	listings map[string]*upstreamListing // Upstream versions, keyed by lowercase ID
+	max      int                         // Most listings kept
+	mutex    sync.Mutex
+	// Listings and downloads in progress, so concurrent requests for an ID or version fetch it once
+	listing flightGroup
+	caching flightGroup
+}
+
+// upstreamListing is the versions of an ID on the upstream feed as last fetched
+type upstreamListing struct {
+	packages []*upstreamPackage
+	fetched  time.Time
+}
+
+func (fs *fileStoreProxy) Init(s *Server) error {
+
+	// Start the store packages are cached in
+	if err := fs.fileStore.Init(s); err != nil {
+		return err
+	}
+
+	// Read the upstream config
+	fs.url = s.config.Upstream.URL
+	fs.allow = s.config.Upstream.Allow
+	fs.deny = s.config.Upstream.Deny
+	for _, p := range append(append([]string{}, fs.allow...), fs.deny...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return &UpstreamError{"Invalid upstream package pattern: " + p, 0}
+		}
+	}
+	fs.ttl = time.Duration(s.config.Upstream.TTLMinutes) * time.Minute
+	fs.listings = make(map[string]*upstreamListing)
+	fs.max = proxyMaxListings
+
+	log.Println("Proxying packages from", fs.url)
+	return nil
+}
+
+// GetPackageFeedEntries adds the upstream versions of an ID to a full listing of it, paged
+// listings and listings of every ID only come from the store
+func (fs *fileStoreProxy) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+
+	entries, more, err := fs.fileStore.GetPackageFeedEntries(id, startAfter, max)
+	if err != nil || id == "" || startAfter != "" || max > 0 {
+		return entries, more, err
+	}
+
+	// Add the versions not cached yet
+	for _, p := range fs.upstreamPackages(id, entries) {
+		cached := false
+		for _, e := range entries {
+			if sameVersion(e.Properties.Version, p.Version) {
+				cached = true
+				break
+			}
+		}
+		if !cached {
+			e := *p.Entry
+			entries = append(entries, &e)
+		}
+	}
+
+	// Keep to the store's filename order
+	sortByFilename(entries)
+	return entries, false, nil
+}
+
+func (fs *fileStoreProxy) GetPackageEntry(id string, ver string) (*NugetPackageEntry, error) {
+	npe, err := fs.fileStore.GetPackageEntry(id, ver)
+	if err == ErrFileNotFound && fs.cachePackage(id, ver) {
+		return fs.fileStore.GetPackageEntry(id, ver)
+	}
+	return npe, err
+}
+
+func (fs *fileStoreProxy) GetPackageFile(id string, ver string, download bool) (storeFile, string, error) {
+	f, t, err := fs.fileStore.GetPackageFile(id, ver, download)
+	if err == ErrFileNotFound && fs.cachePackage(id, ver) {
+		return fs.fileStore.GetPackageFile(id, ver, download)
+	}
+	return f, t, err
+}
+
+// GetFile caches the package for files within one, such as the nuspec, icon and readme
+func (fs *fileStoreProxy) GetFile(f string) (storeFile, string, error) {
+	sf, t, err := fs.fileStore.GetFile(f)
+	if err != ErrFileNotFound {
+		return sf, t, err
+	}
+
+	// Only paths within a package directory are looked up, not the store's own files
+	x := strings.SplitN(strings.TrimPrefix(path.Clean("/"+f), "/"), "/", 3)
+	if len(x) == 3 && !strings.HasPrefix(x[0], "_") && fs.cachePackage(x[0], x[1]) {
+		return fs.fileStore.GetFile(f)
+	}
+	return sf, t, err
+}
+
+// cachePackage fetches a package from upstream into the store, returning true if it is now there,
+// requests for a version already being fetched wait for that fetch
+func (fs *fileStoreProxy) cachePackage(id string, ver string) bool {
+	return fs.caching.Do(strings.ToLower(id)+"/"+strings.ToLower(normalizeVersion(ver)), func() interface{} {
+		return fs.fetchPackage(id, ver)
+	}).(bool)
+}
+
+// fetchPackage fetches a package from upstream into the store, returning true if it is now there
+func (fs *fileStoreProxy) fetchPackage(id string, ver string) bool {
+
+	// Find the version upstream
+	entries, _, err := fs.fileStore.GetPackageFeedEntries(id, "", 0)
+	if err != nil {
+		return false
+	}
+	var p *upstreamPackage
+	for _, up := range fs.upstreamPackages(id, entries) {
+		if sameVersion(up.Version, ver) {
+			p = up
+		}
+	}
+	if p == nil {
+		return false
+	}
+
+	// Download and check it, the feed has been read in finding the version
+	fs.mutex.Lock()
+	uf := fs.upstream
+	fs.mutex.Unlock()
+	log.Println("Fetching", p.ID, p.Version, "from upstream")
+	tmp, verified, err := uf.Download(p, server.config.MaxPackageSizeMB<<20)
+	if err != nil {
+		log.Println("Error fetching", p.ID, p.Version, "from upstream:", err)
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if !verified {
+		log.Println("Upstream gave no hash for", p.ID, p.Version+", caching it unverified")
+	}
+
+	// Store it, another request may have got there first
+	if _, err := fs.fileStore.StorePackage(tmp, upstreamOwner); err != nil {
+		log.Println("Error caching", p.ID, p.Version, err)
+		return false
+	}
+	return true
+}
+
+// upstreamPackages returns the versions of an ID on the upstream feed, or none if it isn't proxied or
+// the feed can't be reached, entries are the store's versions of the ID
+func (fs *fileStoreProxy) upstreamPackages(id string, entries []*NugetPackageEntry) []*upstreamPackage {
+
+	// Check the lists, only valid IDs are looked up
+	if !isValidPackageID(id) || matchPackagePatterns(fs.deny, id) || (len(fs.allow) > 0 && !matchPackagePatterns(fs.allow, id)) {
+		return nil
+	}
+
+	// Use the last listing until it expires, IDs with no versions upstream need no more checks
+	fs.mutex.Lock()
+	l, ok := fs.listings[strings.ToLower(id)]
+	fs.mutex.Unlock()
+	if ok && time.Since(l.fetched) < fs.ttl && len(l.packages) == 0 {
+		return nil
+	}
+
+	// IDs pushed to the store, or reserved for someone else, are not proxied
+	if len(entries) > 0 {
+		owners, err := fs.fileStore.GetPackageOwners()
+		if err != nil || owners[strings.ToLower(id)] != upstreamOwner {
+			return nil
+		}
+	}
+	prefixes, err := fs.fileStore.GetReservedPrefixes()
+	if err != nil {
+		return nil
+	}
+	if owner, ok := reservedPrefixOwner(prefixes, id); ok && owner != upstreamOwner {
+		return nil
+	}
+	if ok && time.Since(l.fetched) < fs.ttl {
+		return l.packages
+	}
+
+	// Fetch a new listing, requests for an ID already being fetched wait for that fetch
+	return fs.listing.Do(strings.ToLower(id), func() interface{} {
+		return fs.fetchListing(id, l)
+	}).([]*upstreamPackage)
+}
+
+// fetchListing fetches the versions of an ID from upstream, keeping the last listing if the upstream can't be reached
+func (fs *fileStoreProxy) fetchListing(id string, last *upstreamListing) []*upstreamPackage {
+
+	// Create the feed on first use
+	fs.mutex.Lock()
+	uf := fs.upstream
+	fs.mutex.Unlock()
+	if uf == nil {
+		var err error
+		if uf, err = newUpstreamFeed(fs.url); err != nil {
+			log.Println("Error reading upstream feed:", err)
+			return nil
+		}
+	}
+	packages, err := uf.Packages(id)
+	if err != nil {
+		log.Println("Error listing", id, "upstream:", err)
+		if last != nil {
+			return last.packages
+		}
+		return nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.upstream = uf
+	if _, ok := fs.listings[strings.ToLower(id)]; !ok && len(fs.listings) >= fs.max {
+		fs.dropListings()
+	}
+	fs.listings[strings.ToLower(id)] = &upstreamListing{packages: packages, fetched: time.Now()}
+
+	return packages
+}
+
+// dropListings makes room for a listing by dropping the expired ones, or the oldest if none have, caller must hold the lock
+func (fs *fileStoreProxy) dropListings() {
+	oldest := ""
+	for id, l := range fs.listings {
+		if time.Since(l.fetched) >= fs.ttl {
+			delete(fs.listings, id)
+		} else if oldest == "" || l.fetched.Before(fs.listings[oldest].fetched) {
+			oldest = id
+		}
+	}
+	if len(fs.listings) >= fs.max && oldest != "" {
+		delete(fs.listings, oldest)
+	}
+}
+
+// flightGroup runs one call at a time for each key, callers arriving while a call runs wait for its result
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is a call in progress
+type flightCall struct {
+	done  chan struct{}
+	value interface{}
+}
+
+// Do runs fn for key, or waits for the call already running for it, returning its result
+func (g *flightGroup) Do(key string, fn func() interface{}) interface{} {
+	g.mutex.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-c.done
+		return c.value
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mutex.Unlock()
+
+	c.value = fn()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	close(c.done)
+	return c.value
+}
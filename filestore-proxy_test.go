@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testProxy returns a proxy over a local store in a temp directory, the caller must remove the directory
+func testProxy(t *testing.T, source string, allow []string, deny []string) (*fileStoreProxy, string) {
+	dir, err := ioutil.TempDir("", "proxy-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFeedServer()
+	server.config.FileStore.RepoDIR = dir
+	server.config.Upstream.URL = source
+	server.config.Upstream.Allow = allow
+	server.config.Upstream.Deny = deny
+	server.config.Upstream.TTLMinutes = 30
+	fs := &fileStoreProxy{fileStore: &fileStoreLocal{}}
+	if err := fs.Init(server); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server.fs = fs
+	return fs, dir
+}
+
+func TestProxyCaching(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0", "Test.Pkg", "2.0.0-Beta", "Test.Pkg", "3.0.0")
+	defer tf.Close()
+	fs, dir := testProxy(t, tf.URL+"/v3/index.json", nil, nil)
+	defer os.RemoveAll(dir)
+
+	// Upstream versions are listed before they are cached
+	entries, _, err := fs.GetPackageFeedEntries("test.pkg", "", 0)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("GetPackageFeedEntries gave %d entries, %v", len(entries), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.pkg")); !os.IsNotExist(err) {
+		t.Errorf("package cached by listing it")
+	}
+
+	// Downloading a version caches it under the upstream owner
+	f, _, err := fs.GetPackageFile("Test.Pkg", "1.0.0", true)
+	if err != nil {
+		t.Fatalf("GetPackageFile error: %v", err)
+	}
+	b, _ := ioutil.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(b, tf.packages[0].Nupkg) {
+		t.Errorf("GetPackageFile gave a different package")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.pkg", "1.0.0", "test.pkg.1.0.0.nupkg")); err != nil {
+		t.Errorf("package not cached: %v", err)
+	}
+	if owners, _ := fs.GetPackageOwners(); owners["test.pkg"] != upstreamOwner {
+		t.Errorf("cached package owner is %q", owners["test.pkg"])
+	}
+	downloads := tf.Requests("/v3/flat/test.pkg/1.0.0/test.pkg.1.0.0.nupkg")
+	if f, _, err := fs.GetPackageFile("Test.Pkg", "1.0.0", true); err != nil {
+		t.Errorf("GetPackageFile of a cached package error: %v", err)
+	} else {
+		f.Close()
+	}
+	if n := tf.Requests("/v3/flat/test.pkg/1.0.0/test.pkg.1.0.0.nupkg"); n != downloads {
+		t.Errorf("cached package downloaded again")
+	}
+
+	// Files within a package cache it, with or without a leading slash
+	for _, name := range []string{"/test.pkg/2.0.0-beta/Test.Pkg.nuspec", "Test.Pkg/3.0/Test.Pkg.nuspec"} {
+		f, _, err := fs.GetFile(name)
+		if err != nil {
+			t.Errorf("GetFile(%q) error: %v", name, err)
+			continue
+		}
+		f.Close()
+	}
+	if entries, _, _ := fs.fileStore.GetPackageFeedEntries("test.pkg", "", 0); len(entries) != 3 {
+		t.Errorf("store has %d versions, want 3", len(entries))
+	}
+
+	// The store's own files are never looked up upstream, nor are unknown versions cached
+	requests := tf.Requests("/v3/registration/_state/index.json") + tf.Requests("/v3/registration/test.pkg/index.json")
+	for _, name := range []string{"_state/test.pkg/1.0.0", "/_static/test.pkg/x", "test.pkg/9.0.0/test.pkg.nuspec"} {
+		if _, _, err := fs.GetFile(name); err != ErrFileNotFound {
+			t.Errorf("GetFile(%q) gave %v, want not found", name, err)
+		}
+	}
+	if n := tf.Requests("/v3/registration/_state/index.json") + tf.Requests("/v3/registration/test.pkg/index.json"); n != requests {
+		t.Errorf("store files looked up upstream")
+	}
+	if _, err := fs.GetPackageEntry("Test.Pkg", "9.0.0"); err != ErrFileNotFound {
+		t.Errorf("GetPackageEntry of an unknown version gave %v", err)
+	}
+}
+
+func TestProxyTTL(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0")
+	defer tf.Close()
+	fs, dir := testProxy(t, tf.URL+"/v2", nil, nil)
+	defer os.RemoveAll(dir)
+	listings := func() int { return tf.Requests("/v2/FindPackagesById()") }
+
+	// Listings are kept until they expire
+	if p := fs.upstreamPackages("Test.Pkg", nil); len(p) != 1 {
+		t.Fatalf("upstreamPackages gave %d versions", len(p))
+	}
+	tf.Add("Test.Pkg", "2.0.0")
+	if p := fs.upstreamPackages("test.pkg", nil); len(p) != 1 || listings() != 1 {
+		t.Errorf("listing not kept, %d versions from %d requests", len(p), listings())
+	}
+
+	// Expired listings are fetched again
+	fs.listings["test.pkg"].fetched = time.Now().Add(-fs.ttl)
+	if p := fs.upstreamPackages("Test.Pkg", nil); len(p) != 2 || listings() == 1 {
+		t.Errorf("expired listing gave %d versions from %d requests", len(p), listings())
+	}
+
+	// The last listing is used while the upstream is down, until then IDs have no versions
+	n := listings()
+	fs.listings["test.pkg"].fetched = time.Now().Add(-fs.ttl)
+	tf.SetDown(true)
+	if p := fs.upstreamPackages("Test.Pkg", nil); len(p) != 2 || listings() == n {
+		t.Errorf("listing with the upstream down gave %d versions from %d requests", len(p), listings())
+	}
+	if p := fs.upstreamPackages("Other.Pkg", nil); len(p) != 0 {
+		t.Errorf("unlisted ID with the upstream down gave %d versions", len(p))
+	}
+}
+
+func TestProxyAllowDeny(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Denied", "1.0.0", "Other.Pkg", "1.0.0", "Mine.Pkg", "1.0.0", "Reserved.Pkg", "1.0.0")
+	defer tf.Close()
+	fs, dir := testProxy(t, tf.URL+"/v3/index.json", []string{"Test.*", "Mine.*", "Reserved.*"}, []string{"*.Denied"})
+	defer os.RemoveAll(dir)
+
+	// IDs pushed to the store, or reserved by someone else, are not proxied
+	tmp, err := ioutil.TempFile(dir, "push-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Write(testPackage("Mine.Pkg", "2.0.0"))
+	_, err = fs.StorePackage(tmp, "me")
+	tmp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetReservedPrefix("Reserved.", "me"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id       string
+		versions int
+	}{
+		{"Test.Pkg", 1},
+		{"test.pkg", 1},
+		{"Test.Denied", 0},
+		{"Other.Pkg", 0},
+		{"Mine.Pkg", 1},
+		{"Reserved.Pkg", 0},
+	}
+	for _, tt := range tests {
+		entries, _, err := fs.GetPackageFeedEntries(tt.id, "", 0)
+		if err != nil || len(entries) != tt.versions {
+			t.Errorf("GetPackageFeedEntries(%q) gave %d versions, %v, want %d", tt.id, len(entries), err, tt.versions)
+		}
+		f, _, err := fs.GetPackageFile(tt.id, "1.0.0", false)
+		if (err == nil) != (tt.versions == 1 && tt.id != "Mine.Pkg") {
+			t.Errorf("GetPackageFile(%q) gave %v", tt.id, err)
+		}
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	// Invalid patterns are an error
+	server.config.Upstream.Deny = []string{"["}
+	if err := (&fileStoreProxy{fileStore: &fileStoreLocal{}}).Init(server); err == nil {
+		t.Errorf("invalid pattern: expected an error")
+	}
+}
+
+func TestProxyConcurrentRequests(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0")
+	defer tf.Close()
+	fs, dir := testProxy(t, tf.URL+"/v3/index.json", nil, nil)
+	defer os.RemoveAll(dir)
+
+	// Requests for a version being fetched wait for it rather than fetching it again
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, _, err := fs.GetPackageFile("Test.Pkg", "1.0.0", true)
+			if err != nil {
+				t.Errorf("GetPackageFile error: %v", err)
+				return
+			}
+			f.Close()
+		}()
+	}
+	wg.Wait()
+	if n := tf.Requests("/v3/flat/test.pkg/1.0.0/test.pkg.1.0.0.nupkg"); n != 1 {
+		t.Errorf("package downloaded %d times", n)
+	}
+	if n := tf.Requests("/v3/registration/test.pkg/index.json"); n != 1 {
+		t.Errorf("versions listed %d times", n)
+	}
+}
+
+func TestProxyListings(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0")
+	defer tf.Close()
+	fs, dir := testProxy(t, tf.URL+"/v2", nil, nil)
+	defer os.RemoveAll(dir)
+	fs.max = 2
+
+	// IDs with no versions upstream are looked up once until their listing expires
+	for i := 0; i < 3; i++ {
+		if p := fs.upstreamPackages("Unknown.Pkg", nil); len(p) != 0 {
+			t.Errorf("unknown ID gave %d versions", len(p))
+		}
+	}
+	if n := tf.Requests("/v2/FindPackagesById()"); n != 1 {
+		t.Errorf("unknown ID listed %d times", n)
+	}
+
+	// Listings are dropped to keep to the limit, expired ones first then the oldest
+	fs.upstreamPackages("Test.Pkg", nil)
+	fs.listings["unknown.pkg"].fetched = time.Now().Add(-fs.ttl)
+	fs.upstreamPackages("Other.Pkg", nil)
+	if _, ok := fs.listings["unknown.pkg"]; ok || len(fs.listings) != 2 {
+		t.Errorf("expired listing kept, %d listings", len(fs.listings))
+	}
+	fs.upstreamPackages("Third.Pkg", nil)
+	if _, ok := fs.listings["test.pkg"]; ok || len(fs.listings) != 2 {
+		t.Errorf("oldest listing kept, %d listings", len(fs.listings))
+	}
+
+	// Invalid IDs are never looked up
+	n := tf.Requests("/v2/FindPackagesById()")
+	for _, id := range []string{"../../x", "Test/Pkg", "..", "", "Test..Pkg", "Test Pkg"} {
+		if _, _, err := fs.GetPackageFile(id, "1.0.0", true); err != ErrFileNotFound {
+			t.Errorf("GetPackageFile(%q) gave %v, want not found", id, err)
+		}
+		if _, err := fs.GetPackageEntry(id, "1.0.0"); err != ErrFileNotFound {
+			t.Errorf("GetPackageEntry(%q) gave %v, want not found", id, err)
+		}
+	}
+	for _, name := range []string{"Test..Pkg/1.0.0/test.pkg.nuspec", "Test Pkg/1.0.0/test.pkg.nuspec"} {
+		if _, _, err := fs.GetFile(name); err != ErrFileNotFound {
+			t.Errorf("GetFile(%q) gave %v, want not found", name, err)
+		}
+	}
+	if tf.Requests("/v2/FindPackagesById()") != n {
+		t.Errorf("invalid IDs looked up upstream")
+	}
+}
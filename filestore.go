@@ -2,9 +2,14 @@ package main
 
 import (
 	"archive/zip"
-	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"path"
+	"regexp"
+	"time"
 
 	nuspec "github.com/soloworks/go-nuspec"
 )
@@ -12,61 +17,219 @@ import (
 // Global Constant for formatting time strings
 const zuluTimeLayout = "2006-01-02T15:04:05Z"
 
+// Published time given to unlisted packages, used by clients to detect them
+const unlistedPublishedTime = "1900-01-01T00:00:00Z"
+
 type fileStore interface {
 	Init(c *Server) error
 	GetPackageEntry(id string, ver string) (*NugetPackageEntry, error)
 	GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error)
-	StorePackage(pkg []byte) (bool, error)
-	GetFile(f string) ([]byte, string, error)
-	GetPackageFile(id string, ver string) ([]byte, string, error)
-	GetAccessLevel(key string) (access, error)
+	StorePackage(pkg packageReader, owner string) (bool, error)
+	StoreSymbolPackage(pkg packageReader, owner string) (bool, error)
+	GetFile(f string) (storeFile, string, error)
+	GetPackageFile(id string, ver string, download bool) (storeFile, string, error)
+	RemovePackage(id string, ver string) error
+	SetPackageListed(id string, ver string, listed bool) error
+	GetPackageOwners() (map[string]string, error)
+	SetPackageOwner(id string, owner string) error
+	GetReservedPrefixes() (map[string]string, error)
+	SetReservedPrefix(prefix string, owner string) error
+}
+
+// packageReader is a package being stored, uploads are spooled to a temp file to provide one
+type packageReader interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// storeFile is a file being read from the store, it must be closed after use
+type storeFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+	ModTime() time.Time
+	ETag() string // Strong validator for the contents, unquoted
+}
+
+// Longest package ID accepted, as on nuget.org
+const maxPackageIDLength = 100
+
+// packageIDPattern is the grammar of a NuGet package ID, dot or hyphen separated words
+var packageIDPattern = regexp.MustCompile(`^\w+([.-]\w+)*$`)
+
+// isValidPackageID returns true if id is a NuGet package ID
+func isValidPackageID(id string) bool {
+	return len(id) <= maxPackageIDLength && packageIDPattern.MatchString(id)
+}
+
+// checkPackageIdentity returns ErrInvalidPackage unless a package's ID and version are valid, stores call it
+// before building any path from them as both come from the package being stored
+func checkPackageIdentity(id string, ver string) error {
+	if !isValidPackageID(id) {
+		return ErrInvalidPackage
+	}
+	if _, err := ParseNugetVersion(ver); err != nil {
+		return ErrInvalidPackage
+	}
+	return nil
+}
+
+// packageName returns {id}.{version} with the version normalized, naming a package in skip tokens, where the
+// stores resume listings from
+func packageName(id string, ver string) string {
+	return id + "." + normalizeVersion(ver)
 }
 
-func extractPackage(pkg []byte) (*nuspec.NuSpec, map[string][]byte, error) {
+// packageStoreDir returns the slash separated directory a package's files are stored in, {id}/{version},
+// the version is normalized so every form of it (1.0, 1.0.0.0) is stored where the flat container expects
+func packageStoreDir(id string, ver string) string {
+	return path.Join(id, normalizeVersion(ver))
+}
+
+// packageStoreFile returns the path of a package's .nupkg or .snupkg (given by ext) in its store directory
+func packageStoreFile(id string, ver string, ext string) string {
+	return path.Join(packageStoreDir(id, ver), id+"."+normalizeVersion(ver)+ext)
+}
+
+// packageArchive is an opened package, files are read from the zip as they are needed
+type packageArchive struct {
+	nsf   *nuspec.NuSpec
+	ne    *nuspecExtra
+	zip   *zip.Reader
+	names []string
+}
+
+// openPackage reads the .nuspec from a package leaving the other files to be read from the zip
+func openPackage(pkg packageReader) (*packageArchive, error) {
+
+	// Get the size of the package
+	size, err := pkg.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
 
 	// Open package data as zipfile
-	zipReader, err := zip.NewReader(bytes.NewReader(pkg), int64(len(pkg)))
+	zipReader, err := zip.NewReader(pkg, size)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// values to be returned
-	var nsf *nuspec.NuSpec
-	files := make(map[string][]byte)
+	pa := packageArchive{zip: zipReader}
 
 	// Find and Process the .nuspec file within the zip
 	for _, zippedFile := range zipReader.File {
+		pa.names = append(pa.names, zippedFile.Name)
 		// If this is the root .nuspec file read it into a NewspecFile structure
 		if path.Dir(zippedFile.Name) == "." && path.Ext(zippedFile.Name) == ".nuspec" {
 			// Get a reader for this file
 			rc, err := zippedFile.Open()
 			if err != nil {
-				return nil, nil, err
+				return nil, err
+			}
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			// Read into nuspec.File structure and the extra metadata
+			if pa.nsf, err = nuspec.FromBytes(b); err != nil {
+				return nil, err
+			}
+			if pa.ne, err = parseNuspecExtra(b); err != nil {
+				return nil, err
 			}
-			// Read into nuspec.File structure
-			nsf, err = nuspec.FromReader(rc)
 		}
 	}
+	if pa.nsf == nil {
+		return nil, ErrNoNuspec
+	}
 
-	// Extract contents to files
-	for _, zipFile := range zipReader.File {
+	// Find the icon and readme within the package
+	pa.ne.ResolveFiles(pa.names)
 
-		// Open file to be extracted
-		r, err := zipFile.Open()
-		if err != nil {
-			return nil, nil, err
-		}
-		// Read all bytes
-		b, err := ioutil.ReadAll(r)
-		if err != nil {
-			return nil, nil, err
-		}
-		// Store in map with filename
-		files[zipFile.Name] = b
+	// return elements
+	return &pa, nil
+}
+
+// IsSymbolPackage returns true if this is a symbol package (.snupkg) rather than a .nupkg
+func (pa *packageArchive) IsSymbolPackage() bool {
+	return pa.ne.HasPackageType(symbolsPackageType)
+}
+
+// hashPackage returns the hex encoded SHA512 hash and size of a package
+func hashPackage(pkg io.ReadSeeker) (string, int64, error) {
+	if _, err := pkg.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha512.New()
+	n, err := io.Copy(h, pkg)
+	if err != nil {
+		return "", 0, err
 	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
 
-	// return elements
-	return nsf, files, nil
+// copyPackage streams a whole package to w
+func copyPackage(w io.Writer, pkg io.ReadSeeker) error {
+	if _, err := pkg.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, pkg)
+	return err
+}
+
+// copyZipFile streams a file out of a package to w
+func copyZipFile(w io.Writer, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// sniffContentType works out a file's content type from its first bytes, leaving it at the start
+func sniffContentType(f io.ReadSeeker) (string, error) {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(b[:n]), nil
+}
+
+// packagesExtra holds the values shared by all versions of an ID
+type packagesExtra struct {
+	Downloads      int
+	Latest         string // Latest stable version
+	AbsoluteLatest string // Latest version including prereleases
+}
+
+// Update checks a version against the latest values, replacing them if higher
+func (pe *packagesExtra) Update(ver string) {
+	if !isPrereleaseVersion(ver) && (pe.Latest == "" || compareVersions(ver, pe.Latest) > 0) {
+		pe.Latest = ver
+	}
+	if pe.AbsoluteLatest == "" || compareVersions(ver, pe.AbsoluteLatest) > 0 {
+		pe.AbsoluteLatest = ver
+	}
+}
+
+// Apply sets the download count and latest flags on an entry
+func (pe *packagesExtra) Apply(npe *NugetPackageEntry) {
+	npe.Properties.DownloadCount.Value = pe.Downloads
+	npe.Properties.IsLatestVersion.Value = pe.Latest != "" && sameVersion(pe.Latest, npe.Properties.Version)
+	// Extras saved before AbsoluteLatest was tracked only hold Latest
+	abs := pe.AbsoluteLatest
+	if abs == "" {
+		abs = pe.Latest
+	}
+	npe.Properties.IsAbsoluteLatestVersion.Value = abs != "" && sameVersion(abs, npe.Properties.Version)
 }
 
 // FileStoreError represents a FileStore Error
@@ -81,16 +244,8 @@ func (fse *FileStoreError) Error() string {
 var (
 	// ErrFileNotFound is returned when request file is not found in the store
 	ErrFileNotFound = &FileStoreError{"File Not Found"}
-)
-
-// Access Types for ease of reference
-type access int
-
-const (
-	// AccessDenied returned when no access to resource is granted
-	accessDenied access = iota
-	// AccessReadOnly returned when Read access to resouce is granted
-	accessReadOnly
-	// AccessReadWrite returned when Read and Write to resouce is granted
-	accessReadWrite
+	// ErrInvalidPackage is returned when storing a package without a valid ID and version
+	ErrInvalidPackage = &FileStoreError{"Package has an invalid ID or version"}
+	// ErrNoNuspec is returned when a package has no .nuspec in its root
+	ErrNoNuspec = &FileStoreError{"Package has no .nuspec"}
 )
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPackageIdentity(t *testing.T) {
+	tests := []struct {
+		id    string
+		ver   string
+		valid bool
+	}{
+		{"Test.Pkg", "1.0.0", true},
+		{"test-pkg_2", "1.0.0-beta.1+abc", true},
+		{strings.Repeat("a", 100), "1.0", true},
+		{strings.Repeat("a", 101), "1.0", false},
+		{"", "1.0.0", false},
+		{"../../x", "1.0.0", false},
+		{"Test/Pkg", "1.0.0", false},
+		{"Test..Pkg", "1.0.0", false},
+		{".Test", "1.0.0", false},
+		{"Test.", "1.0.0", false},
+		{"Test Pkg", "1.0.0", false},
+		{"Test.Pkg", "", false},
+		{"Test.Pkg", "../1.0.0", false},
+		{"Test.Pkg", "1.0.0/..", false},
+		{"Test.Pkg", "1.0.0+../x", false},
+	}
+	for _, tt := range tests {
+		err := checkPackageIdentity(tt.id, tt.ver)
+		if (err == nil) != tt.valid {
+			t.Errorf("checkPackageIdentity(%q, %q) gave %v", tt.id, tt.ver, err)
+		}
+	}
+}
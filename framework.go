@@ -0,0 +1,284 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// targetFramework is a parsed target framework moniker
+type targetFramework struct {
+	family   string
+	version  []int
+	platform string
+}
+
+// Long framework identifiers mapped to their short family name
+var frameworkFamilies = map[string]string{
+	".netframework":      "net",
+	".netstandard":       "netstandard",
+	".netcoreapp":        "netcoreapp",
+	".netcore":           "netcore",
+	".netportable":       "portable",
+	".netplatform":       "dotnet",
+	"uap":                "uap",
+	"monoandroid":        "monoandroid",
+	"xamarin.ios":        "xamarinios",
+	"windowsphoneapp":    "wpa",
+	"windows":            "win",
+	"silverlight":        "sl",
+	"windowsphone":       "wp",
+	"tizen":              "tizen",
+	"native":             "native",
+	"any":                "any",
+	"agnostic":           "any",
+	".netmicroframework": "netmf",
+}
+
+// Lowest .NET Framework and .NET Core versions supporting each .NET Standard version
+var netStandardSupport = []struct {
+	standard []int
+	net      []int
+	core     []int
+}{
+	{[]int{1, 0}, []int{4, 5}, []int{1, 0}},
+	{[]int{1, 1}, []int{4, 5}, []int{1, 0}},
+	{[]int{1, 2}, []int{4, 5, 1}, []int{1, 0}},
+	{[]int{1, 3}, []int{4, 6}, []int{1, 0}},
+	{[]int{1, 4}, []int{4, 6, 1}, []int{1, 0}},
+	{[]int{1, 5}, []int{4, 6, 1}, []int{1, 0}},
+	{[]int{1, 6}, []int{4, 6, 1}, []int{1, 0}},
+	{[]int{2, 0}, []int{4, 6, 1}, []int{2, 0}},
+	{[]int{2, 1}, nil, []int{3, 0}},
+}
+
+// parseFramework parses a short (net45, netstandard2.0, net6.0-windows) or long
+// (.NETFramework,Version=v4.5) framework name, returning nil if it can't be understood
+func parseFramework(s string) *targetFramework {
+
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return nil
+	}
+	tf := targetFramework{}
+
+	if i := strings.Index(s, ",version="); i >= 0 {
+		// Long form
+		family, ok := frameworkFamilies[s[:i]]
+		if !ok {
+			family = s[:i]
+		}
+		tf.family = family
+		v := strings.TrimPrefix(s[i+len(",version="):], "v")
+		if j := strings.Index(v, ","); j >= 0 {
+			v = v[:j]
+		}
+		tf.version = parseFrameworkVersion(v, true)
+	} else {
+		// Short form, split off any platform
+		if i := strings.Index(s, "-"); i >= 0 {
+			tf.platform = s[i+1:]
+			s = s[:i]
+		}
+		if family, ok := frameworkFamilies[s]; ok {
+			s = family
+		}
+		// Split the family from the version digits
+		i := len(s)
+		for i > 0 && (s[i-1] == '.' || (s[i-1] >= '0' && s[i-1] <= '9')) {
+			i--
+		}
+		tf.family = s[:i]
+		if family, ok := frameworkFamilies[tf.family]; ok {
+			tf.family = family
+		}
+		tf.version = parseFrameworkVersion(s[i:], strings.Contains(s[i:], "."))
+		// net5.0 and later are .NET Core
+		if tf.family == "net" && len(tf.version) > 0 && tf.version[0] >= 5 {
+			tf.family = "netcoreapp"
+		}
+	}
+
+	if tf.family == "" {
+		return nil
+	}
+	return &tf
+}
+
+// parseFrameworkVersion parses either dotted (4.6.1) or packed (461) version digits
+func parseFrameworkVersion(v string, dotted bool) []int {
+	var parts []int
+	if dotted {
+		for _, p := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(p)
+			parts = append(parts, n)
+		}
+	} else {
+		for _, c := range v {
+			parts = append(parts, int(c-'0'))
+		}
+	}
+	// Trim trailing zeros so 4.5 and 4.5.0 compare equal
+	for len(parts) > 1 && parts[len(parts)-1] == 0 {
+		parts = parts[:len(parts)-1]
+	}
+	return parts
+}
+
+// Families whose short names use packed version digits (net45 rather than net4.5)
+var packedFrameworkFamilies = map[string]bool{
+	"net": true, "netcore": true, "win": true, "wp": true, "wpa": true, "sl": true, "netmf": true,
+}
+
+// String returns the short folder name of the framework, such as net45, netstandard2.0 or net6.0-windows
+func (tf *targetFramework) String() string {
+
+	family := tf.family
+	version := tf.version
+	packed := packedFrameworkFamilies[family]
+
+	// .NET Core 5 and later are named net
+	if family == "netcoreapp" && len(version) > 0 && version[0] >= 5 {
+		family = "net"
+	}
+
+	// Dotted versions always have a minor part
+	var parts []string
+	for _, v := range version {
+		parts = append(parts, strconv.Itoa(v))
+	}
+	if !packed && len(parts) == 1 {
+		parts = append(parts, "0")
+	}
+
+	s := family
+	if packed {
+		s += strings.Join(parts, "")
+	} else {
+		s += strings.Join(parts, ".")
+	}
+	if tf.platform != "" {
+		s += "-" + tf.platform
+	}
+	return s
+}
+
+// shortFrameworkName returns the short folder name for any framework name, or the name lowercased if not understood
+func shortFrameworkName(s string) string {
+	if tf := parseFramework(s); tf != nil {
+		return tf.String()
+	}
+	return strings.ToLower(s)
+}
+
+// compareFrameworkVersions compares two parsed framework versions, returning -1, 0 or 1
+func compareFrameworkVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return compareInts(x, y)
+		}
+	}
+	return 0
+}
+
+// CanReference returns true if a project targeting tf can use assets built for pkg
+func (tf *targetFramework) CanReference(pkg *targetFramework) bool {
+
+	// Framework agnostic assets work everywhere
+	if pkg.family == "any" || pkg.family == "dotnet" {
+		return true
+	}
+
+	// Same family, package must not be newer than the project
+	if tf.family == pkg.family {
+		if pkg.platform != "" && pkg.platform != tf.platform {
+			return false
+		}
+		return compareFrameworkVersions(pkg.version, tf.version) <= 0
+	}
+
+	// .NET Standard can be used by supporting implementations
+	if pkg.family == "netstandard" {
+		for _, s := range netStandardSupport {
+			if compareFrameworkVersions(pkg.version, s.standard) > 0 {
+				continue
+			}
+			switch tf.family {
+			case "net":
+				return s.net != nil && compareFrameworkVersions(s.net, tf.version) <= 0
+			case "netcoreapp":
+				return compareFrameworkVersions(s.core, tf.version) <= 0
+			}
+			return false
+		}
+	}
+
+	return false
+}
+
+// parseFrameworkList parses a | separated list of frameworks, ignoring any that can't be understood
+func parseFrameworkList(s string) []*targetFramework {
+	var tfs []*targetFramework
+	for _, f := range strings.Split(s, "|") {
+		if tf := parseFramework(f); tf != nil {
+			tfs = append(tfs, tf)
+		}
+	}
+	return tfs
+}
+
+// supportsFrameworks returns true if the entry can be used by a project targeting any of tfs
+func supportsFrameworks(npe *NugetPackageEntry, tfs []*targetFramework) bool {
+
+	// No filter or no framework specific assets means compatible with everything
+	if len(tfs) == 0 || len(npe.Properties.Frameworks) == 0 {
+		return true
+	}
+
+	for _, f := range npe.Properties.Frameworks {
+		pkg := parseFramework(f)
+		if pkg == nil {
+			continue
+		}
+		for _, tf := range tfs {
+			if tf.CanReference(pkg) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// packageFrameworks returns the frameworks targeted by the lib and ref folders and dependency groups of a package
+func packageFrameworks(files []string, ne *nuspecExtra) []string {
+
+	found := make(map[string]bool)
+	for _, f := range ne.DependencyFrameworks() {
+		found[f] = true
+	}
+	for _, f := range files {
+		x := strings.Split(path.Clean(strings.ReplaceAll(f, `\`, `/`)), "/")
+		if len(x) < 3 {
+			continue
+		}
+		switch strings.ToLower(x[0]) {
+		case "lib", "ref":
+			found[strings.ToLower(x[1])] = true
+		}
+	}
+
+	var tfs []string
+	for f := range found {
+		tfs = append(tfs, f)
+	}
+	sort.Strings(tfs)
+	return tfs
+}
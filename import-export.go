@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Actor recorded in the audit log for packages added by the import subcommand
+const importActor = "import"
+
+// Name of the manifest written by export, describing the packages and ownership of the store
+const storeManifestFile = "manifest.json"
+
+// storeManifest lists the packages exported from a store, with the owners and reserved prefixes
+type storeManifest struct {
+	Packages []*manifestPackage `json:"packages"`
+	Owners   map[string]string  `json:"owners"`   // Owner by lowercase ID
+	Prefixes map[string]string  `json:"prefixes"` // Owner by lowercase reserved ID prefix
+}
+
+// manifestPackage is an exported package, file paths are relative to the export directory
+type manifestPackage struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	File    string `json:"file"`
+	Hash    string `json:"hash"` // Hex encoded SHA512 of the file
+	Size    int64  `json:"size"`
+	Listed  bool   `json:"listed"`
+	Symbols string `json:"symbols,omitempty"`
+}
+
+// ToBytes exports structure as byte array
+func (sm *storeManifest) ToBytes() []byte {
+	b, _ := json.MarshalIndent(sm, "", "  ")
+	return b
+}
+
+// transferCounts totals the outcome of an import or export, safe for use by several workers
+type transferCounts struct {
+	Done    int
+	Skipped int
+	Failed  int
+	mutex   sync.Mutex
+}
+
+// Add counts an outcome, printing any error against the file it was for
+func (tc *transferCounts) Add(name string, skipped bool, err error) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	switch {
+	case err != nil:
+		fmt.Println("Error with", name+":", err)
+		tc.Failed++
+	case skipped:
+		tc.Skipped++
+	default:
+		tc.Done++
+	}
+}
+
+// runParallel calls fn for each item using a number of workers
+func runParallel(items []string, workers int, fn func(string)) {
+	ch := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range ch {
+				fn(item)
+			}
+		}()
+	}
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// runImport is the import subcommand, it returns the process exit code
+func runImport(args []string) int {
+
+	// Read the flags
+	fl := flag.NewFlagSet("import", flag.ContinueOnError)
+	workers := fl.Int("workers", runtime.NumCPU(), "Number of packages stored at once")
+	owner := fl.String("owner", "", "Owner given to new package IDs not in a manifest")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "Usage: "+os.Args[0]+" import [flags] <dir>")
+		fmt.Fprintln(fl.Output(), "Stores every .nupkg and .snupkg under the directory, applying the "+storeManifestFile+" written by export if there is one")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if fl.NArg() != 1 || *workers < 1 {
+		fl.Usage()
+		return 2
+	}
+	dir := fl.Arg(0)
+	fs := commandStore()
+
+	// Read the manifest, directories not written by export won't have one
+	sm := &storeManifest{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, storeManifestFile))
+	if err == nil {
+		err = json.Unmarshal(b, sm)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Error reading manifest:", err)
+		return 1
+	}
+	manifest := make(map[string]*manifestPackage)
+	for _, mp := range sm.Packages {
+		manifest[filepath.FromSlash(mp.File)] = mp
+		if mp.Symbols != "" {
+			manifest[filepath.FromSlash(mp.Symbols)] = mp
+		}
+	}
+
+	// Find the packages, symbols are stored after the packages they belong to
+	var packages, symbols []string
+	err = filepath.Walk(dir, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(fp)) {
+		case ".nupkg":
+			packages = append(packages, fp)
+		case ".snupkg":
+			symbols = append(symbols, fp)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error reading directory:", err)
+		return 1
+	}
+
+	// Store each file, skipping those already in the store
+	tc := &transferCounts{}
+	store := func(fp string) {
+		rel, _ := filepath.Rel(dir, fp)
+		mp := manifest[rel]
+		exists, err := importPackage(fs, fp, mp, sm.Owners, *owner)
+		tc.Add(rel, exists, err)
+	}
+	runParallel(packages, *workers, store)
+	runParallel(symbols, *workers, store)
+
+	// Reserve the prefixes last, so they don't stop packages being stored before their owners are set
+	for prefix, o := range sm.Prefixes {
+		if err := fs.SetReservedPrefix(prefix, o); err != nil {
+			fmt.Println("Error reserving prefix", prefix+":", err)
+			tc.Failed++
+		}
+	}
+
+	fmt.Printf("Imported %d, skipped %d already stored, %d failed\n", tc.Done, tc.Skipped, tc.Failed)
+	if tc.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// importPackage stores a package file, checking it against its manifest entry if it has one,
+// and returns true if it was already stored
+func importPackage(fs fileStore, fp string, mp *manifestPackage, owners map[string]string, owner string) (bool, error) {
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	pa, err := openPackage(f)
+	if err != nil {
+		return false, err
+	}
+	id, ver := pa.nsf.Meta.ID, pa.nsf.Meta.Version
+
+	// Skip files already stored, before the store checks the owner
+	if pa.IsSymbolPackage() {
+		if sf, _, err := fs.GetFile(packageStoreFile(id, ver, ".snupkg")); err == nil {
+			sf.Close()
+			return true, nil
+		}
+	} else if _, err := fs.GetPackageEntry(id, ver); err == nil {
+		return true, nil
+	}
+
+	// Check the file is the one exported, and give the ID the owner it had
+	if mp != nil && !pa.IsSymbolPackage() {
+		h, _, err := hashPackage(f)
+		if err != nil {
+			return false, err
+		}
+		if h != mp.Hash {
+			return false, &FileStoreError{"Package hash does not match the manifest"}
+		}
+	}
+	if o, ok := owners[strings.ToLower(id)]; ok {
+		owner = o
+	}
+
+	exists, err := storeCommandPackage(fs, f, owner, importActor)
+	if err != nil || exists {
+		return exists, err
+	}
+
+	// Keep versions unlisted in the store exported from unlisted
+	if mp != nil && !mp.Listed && !pa.IsSymbolPackage() {
+		return false, fs.SetPackageListed(id, ver, false)
+	}
+	return false, nil
+}
+
+// runExport is the export subcommand, it returns the process exit code
+func runExport(args []string) int {
+
+	// Read the flags
+	fl := flag.NewFlagSet("export", flag.ContinueOnError)
+	workers := fl.Int("workers", runtime.NumCPU(), "Number of packages read at once")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "Usage: "+os.Args[0]+" export [flags] <dir>")
+		fmt.Fprintln(fl.Output(), "Writes every package in the store to the directory, with a "+storeManifestFile+" of their metadata")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if fl.NArg() != 1 || *workers < 1 {
+		fl.Usage()
+		return 2
+	}
+	dir := fl.Arg(0)
+	fs := commandStore()
+
+	// List the store
+	entries, _, err := fs.GetPackageFeedEntries("", "", 0)
+	if err != nil {
+		log.Println("Error listing packages:", err)
+		return 1
+	}
+	sm := &storeManifest{}
+	if sm.Owners, err = fs.GetPackageOwners(); err != nil {
+		log.Println("Error listing owners:", err)
+		return 1
+	}
+	if sm.Prefixes, err = fs.GetReservedPrefixes(); err != nil {
+		log.Println("Error listing reserved prefixes:", err)
+		return 1
+	}
+
+	// Write each package, files already exported are kept so an interrupted export can be rerun
+	tc := &transferCounts{}
+	byFile := make(map[string]*NugetPackageEntry)
+	var names []string
+	for _, e := range entries {
+		byFile[e.Filename()] = e
+		names = append(names, e.Filename())
+	}
+	mutex := sync.Mutex{}
+	runParallel(names, *workers, func(name string) {
+		mp, skipped, err := exportPackage(fs, dir, byFile[name])
+		if err == nil {
+			mutex.Lock()
+			sm.Packages = append(sm.Packages, mp)
+			mutex.Unlock()
+		}
+		tc.Add(name, skipped, err)
+	})
+
+	// Write the manifest in a stable order
+	sort.Slice(sm.Packages, func(i, j int) bool {
+		return sm.Packages[i].File < sm.Packages[j].File
+	})
+	if err := ioutil.WriteFile(filepath.Join(dir, storeManifestFile), sm.ToBytes(), 0644); err != nil {
+		log.Println("Error writing manifest:", err)
+		return 1
+	}
+
+	fmt.Printf("Exported %d, skipped %d already exported, %d failed\n", tc.Done, tc.Skipped, tc.Failed)
+	if tc.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// exportPackage writes a package and its symbols to {id}/{version}/{id}.{version}.nupkg in lowercase, with the
+// version normalized as in the store, returning its manifest entry and true if it was already exported
+func exportPackage(fs fileStore, dir string, npe *NugetPackageEntry) (*manifestPackage, bool, error) {
+
+	id, ver := npe.Properties.ID, npe.Properties.Version
+	mp := &manifestPackage{
+		ID:      id,
+		Version: ver,
+		File:    strings.ToLower(packageStoreFile(id, ver, ".nupkg")),
+		Listed:  npe.IsListed(),
+	}
+
+	// Write the package unless a previous export did
+	fp := filepath.Join(dir, filepath.FromSlash(mp.File))
+	_, err := os.Stat(fp)
+	skipped := err == nil
+	if !skipped {
+		f, _, err := fs.GetPackageFile(id, ver, false)
+		if err != nil {
+			return nil, false, err
+		}
+		err = writeExportFile(fp, f)
+		f.Close()
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Hash the file written
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	if mp.Hash, mp.Size, err = hashPackage(f); err != nil {
+		return nil, false, err
+	}
+
+	// Write the symbol package if there is one
+	sf, _, err := fs.GetFile(packageStoreFile(id, ver, ".snupkg"))
+	if err == ErrFileNotFound {
+		return mp, skipped, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer sf.Close()
+	mp.Symbols = strings.ToLower(packageStoreFile(id, ver, ".snupkg"))
+	sp := filepath.Join(dir, filepath.FromSlash(mp.Symbols))
+	if _, err := os.Stat(sp); err == nil {
+		return mp, skipped, nil
+	}
+	return mp, skipped, writeExportFile(sp, sf)
+}
+
+// writeExportFile writes a file through a temp file, so an interrupted export never leaves a partial one
+func writeExportFile(fp string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fp), ".export-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fp)
+}
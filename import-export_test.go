@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testLocalStore starts a local store in a directory, recording audit events in it
+func testLocalStore(t *testing.T, dir string) *fileStoreLocal {
+	server.config.FileStore.RepoDIR = dir
+	fs := &fileStoreLocal{}
+	if err := fs.Init(server); err != nil {
+		t.Fatal(err)
+	}
+	server.as = &auditStoreLocal{fs: fs}
+	return fs
+}
+
+// testStorePackage pushes a package built for an ID and version to a store
+func testStorePackage(t *testing.T, fs fileStore, dir string, id string, ver string, owner string) {
+	fp := filepath.Join(dir, id+"."+ver+".nupkg")
+	if err := ioutil.WriteFile(fp, testPackage(id, ver), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fs.StorePackage(f, owner); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testFeedServer()
+	exportDir := filepath.Join(dir, "export")
+
+	// A store with a version to normalize and an unlisted version
+	from := testLocalStore(t, filepath.Join(dir, "from"))
+	testStorePackage(t, from, dir, "Test.Pkg", "1.0", "team")
+	testStorePackage(t, from, dir, "Test.Pkg", "2.0.0-Beta", "team")
+	if err := from.SetPackageListed("Test.Pkg", "2.0.0-Beta", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packages are exported under their normalized versions, and kept on a rerun
+	entries, _, err := from.GetPackageFeedEntries("", "", 0)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("store has %d packages, %v", len(entries), err)
+	}
+	files := []string{"test.pkg/1.0.0/test.pkg.1.0.0.nupkg", "test.pkg/2.0.0-beta/test.pkg.2.0.0-beta.nupkg"}
+	var manifest []*manifestPackage
+	for i, e := range entries {
+		mp, skipped, err := exportPackage(from, exportDir, e)
+		if err != nil || skipped {
+			t.Fatalf("exportPackage(%s) gave %v, %v", e.Filename(), skipped, err)
+		}
+		if mp.File != files[i] || mp.Hash != e.Properties.PackageHash || mp.Listed != (i == 0) || mp.Symbols != "" {
+			t.Errorf("exportPackage(%s) gave %+v", e.Filename(), mp)
+		}
+		if _, skipped, err := exportPackage(from, exportDir, e); err != nil || !skipped {
+			t.Errorf("exportPackage(%s) rerun gave %v, %v", e.Filename(), skipped, err)
+		}
+		manifest = append(manifest, mp)
+	}
+	owners, _ := from.GetPackageOwners()
+
+	// Importing keeps the listing and owner, and skips versions already stored
+	to := testLocalStore(t, filepath.Join(dir, "to"))
+	for _, mp := range manifest {
+		fp := filepath.Join(exportDir, filepath.FromSlash(mp.File))
+		if exists, err := importPackage(to, fp, mp, owners, "other"); err != nil || exists {
+			t.Errorf("importPackage(%s) gave %v, %v", mp.File, exists, err)
+		}
+		if exists, err := importPackage(to, fp, mp, owners, "other"); err != nil || !exists {
+			t.Errorf("importPackage(%s) rerun gave %v, %v", mp.File, exists, err)
+		}
+	}
+	if e, err := to.GetPackageEntry("Test.Pkg", "2.0.0-beta"); err != nil || e.IsListed() {
+		t.Errorf("imported unlisted package gave %v", err)
+	}
+	if o, _ := to.GetPackageOwners(); o["test.pkg"] != "team" {
+		t.Errorf("imported package owner %q", o["test.pkg"])
+	}
+
+	// Packages that don't match the manifest aren't stored
+	testStorePackage(t, from, dir, "Other.Pkg", "1.0.0", "")
+	fp := filepath.Join(dir, "Other.Pkg.1.0.0.nupkg")
+	if _, err := importPackage(to, fp, &manifestPackage{Hash: manifest[0].Hash, Listed: true}, nil, ""); err == nil {
+		t.Errorf("importPackage with a mismatched hash: expected an error")
+	}
+	if _, err := to.GetPackageEntry("Other.Pkg", "1.0.0"); err != ErrFileNotFound {
+		t.Errorf("package with a mismatched hash stored")
+	}
+
+	// Packages with IDs that would escape the store aren't stored
+	fp = filepath.Join(dir, "evil.nupkg")
+	if err := ioutil.WriteFile(fp, testPackage("../../evil", "1.0.0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importPackage(to, fp, &manifestPackage{Listed: true}, nil, ""); err == nil {
+		t.Errorf("importPackage with an invalid ID: expected an error")
+	}
+	for _, p := range []string{filepath.Join(dir, "evil"), filepath.Join(dir, "to", "evil"), filepath.Join(filepath.Dir(dir), "evil")} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("package with an invalid ID stored at %s", p)
+		}
+	}
+}
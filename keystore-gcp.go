@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+type keyStoreGCP struct {
+	fs     *fileStoreGCP // Holds the Firestore connection
+	tokens bool          // OIDC issuers are configured, so the server is not open without keys
+}
+
+func (ks *keyStoreGCP) Init(s *Server) error {
+	ks.tokens = len(s.config.OIDC.Issuers) > 0
+	return nil
+}
+
+// FirestoreAPIKey represents a ApiKey as stored in Firebase before keys were hashed, named by the key itself
+type FirestoreAPIKey struct {
+	Reference string
+	Access    string
+}
+
+func (ks *keyStoreGCP) GetAccessLevel(key string) (*access, error) {
+
+	// Check for case where no keys or issuers are declared yet - dev mode
+	iter := ks.fs.firestore.Collection("Nuget-APIKeys").Limit(1).Documents(ks.fs.ctx)
+	_, err := iter.Next()
+	if err == iterator.Done && !ks.tokens {
+		return keyAccess(nil, false, false), nil
+	} else if err != nil && err != iterator.Done {
+		return nil, err
+	}
+
+	// Check for keys with the read scope, which close the feed to anonymous reads
+	private := false
+	for _, q := range []firestore.Query{
+		ks.fs.firestore.Collection("Nuget-APIKeys").Where("Scopes", "array-contains", scopeRead),
+		ks.fs.firestore.Collection("Nuget-APIKeys").Where("Access", "==", "ReadOnly"),
+	} {
+		iter := q.Limit(1).Documents(ks.fs.ctx)
+		_, err := iter.Next()
+		if err == nil {
+			private = true
+			break
+		} else if err != iterator.Done {
+			return nil, err
+		}
+	}
+
+	// Get specific APIKey entry by its hash
+	k, err := ks.getAPIKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyAccess(k, true, private), nil
+}
+
+// getAPIKey returns the stored key matching a key, or nil if there is none
+func (ks *keyStoreGCP) getAPIKey(key string) (*apiKey, error) {
+
+	// Keys are stored by their hash
+	hash := hashAPIKey(key)
+	d, err := ks.fs.firestore.Collection("Nuget-APIKeys").Doc(hash).Get(ks.fs.ctx)
+	if err == nil {
+		var k *apiKey
+		if err := d.DataTo(&k); err != nil {
+			return nil, err
+		}
+		return k, nil
+	} else if grpc.Code(err) != codes.NotFound {
+		return nil, err
+	}
+
+	// Fall back to a key stored before hashing, named by the key itself
+	if key == "" || strings.Contains(key, "/") {
+		return nil, nil
+	}
+	d, err = ks.fs.firestore.Collection("Nuget-APIKeys").Doc(key).Get(ks.fs.ctx)
+	if grpc.Code(err) == codes.NotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	lk := FirestoreAPIKey{}
+	if err := d.DataTo(&lk); err != nil {
+		return nil, err
+	}
+	k := &apiKey{Hash: hash, Description: lk.Reference}
+	switch lk.Access {
+	case "ReadWrite":
+		k.Scopes = readWriteScopes
+	case "ReadOnly":
+		k.Scopes = []string{scopeRead}
+	default:
+		return nil, nil
+	}
+
+	// Replace it with the hashed key
+	log.Println("Hashing API key", k.Reference(), lk.Reference)
+	if _, err := ks.fs.firestore.Collection("Nuget-APIKeys").Doc(hash).Set(ks.fs.ctx, k); err != nil {
+		return nil, err
+	}
+	if _, err := d.Ref.Delete(ks.fs.ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (ks *keyStoreGCP) ListAPIKeys() ([]*apiKey, error) {
+
+	// Cycle through all keys
+	var keys []*apiKey
+	iter := ks.fs.firestore.Collection("Nuget-APIKeys").Documents(ks.fs.ctx)
+	for {
+		d, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var k *apiKey
+		if err := d.DataTo(&k); err != nil {
+			return nil, err
+		}
+		// Keys stored before hashing are named by the key, hashing them as they are found
+		if k.Hash == "" {
+			if k, err = ks.getAPIKey(d.Ref.ID); err != nil {
+				return nil, err
+			}
+			if k == nil {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, nil
+}
+
+func (ks *keyStoreGCP) CreateAPIKey(k *apiKey) error {
+
+	// Create fails if the document already exists
+	_, err := ks.fs.firestore.Collection("Nuget-APIKeys").Doc(k.Hash).Create(ks.fs.ctx, k)
+	if grpc.Code(err) == codes.AlreadyExists {
+		return ErrAPIKeyExists
+	}
+	return err
+}
+
+func (ks *keyStoreGCP) RevokeAPIKey(ref string) (*apiKey, error) {
+
+	// Find the key
+	keys, err := ks.ListAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+	k, err := findAPIKey(keys, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the document
+	if _, err := ks.fs.firestore.Collection("Nuget-APIKeys").Doc(k.Hash).Delete(ks.fs.ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// Name of the file used to persist keys created through the admin API in the state directory
+const localAPIKeysFile = "apikeys.json"
+
+type keyStoreLocal struct {
+	fs         *fileStoreLocal    // Holds the repo the keys are saved in
+	configKeys map[string]*apiKey // Keys from the config file, keyed by hash
+	keys       map[string]*apiKey // Keys from the admin API, keyed by hash
+	tokens     bool               // OIDC issuers are configured, so the server is not open without keys
+	mutex      sync.RWMutex
+}
+
+func (ks *keyStoreLocal) Init(s *Server) error {
+
+	// Load the hard coded API keys from the config, hashing any plaintext ones
+	ks.configKeys = make(map[string]*apiKey)
+	for _, k := range s.config.FileStore.APIKeys.ReadOnly {
+		ks.configKeys[hashAPIKey(k)] = &apiKey{Hash: hashAPIKey(k), Scopes: []string{scopeRead}}
+	}
+	for _, k := range s.config.FileStore.APIKeys.ReadWrite {
+		ks.configKeys[hashAPIKey(k)] = &apiKey{Hash: hashAPIKey(k), Scopes: readWriteScopes}
+	}
+	if len(ks.configKeys) > 0 {
+		log.Println("Warning: api-keys read-only and read-write are plaintext, move them to api-keys keys")
+	}
+	for i := range s.config.FileStore.APIKeys.Keys {
+		k := &s.config.FileStore.APIKeys.Keys[i]
+		k.Hash = strings.ToLower(k.Hash)
+		if err := k.Validate(); err != nil {
+			return err
+		}
+		ks.configKeys[k.Hash] = k
+	}
+
+	ks.tokens = len(s.config.OIDC.Issuers) > 0
+
+	// Load the keys created through the admin API (file will not exist on a fresh repo)
+	var keys []*apiKey
+	if err := ks.fs.readState(localAPIKeysFile, &keys); err != nil {
+		return err
+	}
+	ks.keys = make(map[string]*apiKey)
+	for _, k := range keys {
+		ks.keys[k.Hash] = k
+	}
+
+	return nil
+}
+
+func (ks *keyStoreLocal) GetAccessLevel(key string) (*access, error) {
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	// Find the key by its hash
+	h := hashAPIKey(key)
+	k, ok := ks.keys[h]
+	if !ok {
+		k = ks.configKeys[h]
+	}
+
+	keys := ks.allKeys()
+	return keyAccess(k, len(keys) > 0 || ks.tokens, privateFeed(keys)), nil
+}
+
+func (ks *keyStoreLocal) ListAPIKeys() ([]*apiKey, error) {
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	return ks.allKeys(), nil
+}
+
+func (ks *keyStoreLocal) CreateAPIKey(k *apiKey) error {
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// Test for the key, if present bail
+	if _, ok := ks.keys[k.Hash]; ok {
+		return ErrAPIKeyExists
+	}
+	if _, ok := ks.configKeys[k.Hash]; ok {
+		return ErrAPIKeyExists
+	}
+
+	// Add and persist the keys
+	ks.keys[k.Hash] = k
+	return ks.save()
+}
+
+func (ks *keyStoreLocal) RevokeAPIKey(ref string) (*apiKey, error) {
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	// Find the key, those in the config can only be removed from the config
+	k, err := findAPIKey(ks.allKeys(), ref)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ks.keys[k.Hash]; !ok {
+		return nil, ErrAPIKeyInConfig
+	}
+
+	// Remove and persist the keys
+	delete(ks.keys, k.Hash)
+	return k, ks.save()
+}
+
+// allKeys returns the config and admin API keys together, caller must hold the lock
+func (ks *keyStoreLocal) allKeys() []*apiKey {
+	var keys []*apiKey
+	for _, k := range ks.configKeys {
+		keys = append(keys, k)
+	}
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// save persists the admin API keys, caller must hold the lock
+func (ks *keyStoreLocal) save() error {
+	keys := []*apiKey{}
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	return ks.fs.writeState(localAPIKeysFile, keys)
+}
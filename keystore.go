@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+)
+
+type keyStore interface {
+	Init(s *Server) error
+	GetAccessLevel(key string) (*access, error)
+	ListAPIKeys() ([]*apiKey, error)
+	CreateAPIKey(k *apiKey) error
+	RevokeAPIKey(ref string) (*apiKey, error)
+}
+
+var (
+	// ErrAPIKeyNotFound is returned when no key has the requested reference
+	ErrAPIKeyNotFound = &APIKeyError{"API Key Not Found"}
+	// ErrAPIKeyExists is returned when creating a key that is already stored
+	ErrAPIKeyExists = &APIKeyError{"API Key Already Exists"}
+	// ErrAPIKeyInConfig is returned when changing a key that is set in the config file
+	ErrAPIKeyInConfig = &APIKeyError{"API Key Is Set In The Config File"}
+)
+
+// findAPIKey returns the key with a reference, references are the start of the hash so a longer prefix also matches
+func findAPIKey(keys []*apiKey, ref string) (*apiKey, error) {
+	var found *apiKey
+	for _, k := range keys {
+		if len(ref) >= len(k.Reference()) && strings.HasPrefix(k.Hash, strings.ToLower(ref)) {
+			if found != nil {
+				return nil, ErrAPIKeyNotFound
+			}
+			found = k
+		}
+	}
+	if found == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	return found, nil
+}
+
+// privateFeed returns true if any key has the read scope, which closes the feed to anonymous reads
+func privateFeed(keys []*apiKey) bool {
+	for _, k := range keys {
+		for _, s := range k.Scopes {
+			if s == scopeRead {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -1,29 +1,33 @@
 package main
 
 import (
-	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 // Global Variables
 var server *Server
 
-func init() {
+func main() {
+
 	// Loan config and init server
 	server = InitServer("nuget-server-config-gcp.json")
-}
 
-func main() {
+	// Run a subcommand instead of the server if one is given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 
 	// Handling Routing
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -31,7 +35,7 @@ func main() {
 		// Local Varibles
 		var err error                                                          // Reusable error
 		apiKey := ""                                                           // APIKey (populated if found in headers)
-		accessLevel := accessDenied                                            // Access Level (defaults to denied)
+		var accessLevel *access                                                // Access granted (from the key or server defaults)
 		altFilePath := path.Join(`/F`, server.URL.Path, `api`, `v2`, `browse`) // Alternative API called by client
 
 		// Create new statusWriter
@@ -47,9 +51,9 @@ func main() {
 			goto End
 		}
 
-		// Open Access Routes (No ApiKey needed)
+		// Open Access Routes (No ApiKey needed), HEAD is routed as GET with the body discarded
 		switch r.Method {
-		case http.MethodGet:
+		case http.MethodGet, http.MethodHead:
 			switch {
 			case r.URL.String() == server.URL.Path:
 				serveRoot(&sw, r)
@@ -57,59 +61,108 @@ func main() {
 			case r.URL.String() == server.URL.Path+`$metadata`:
 				serveMetaData(&sw, r)
 				goto End
+			case r.URL.String() == server.URL.Path+`index.json`:
+				serveServiceIndex(&sw, r)
+				goto End
 			}
 		}
 
-		// Process Headers looking for API key (can't access direct as case may not match)
-		for name, headers := range r.Header {
-			// Grab ApiKey as it passes
-			if strings.ToLower(name) == "x-nuget-apikey" {
-				apiKey = headers[0]
+		// Find the API key
+		apiKey = requestAPIKey(r)
+		// CI systems can send an OIDC token instead, invalid tokens are treated as no key
+		if token := bearerToken(r); token != "" && server.tv != nil {
+			accessLevel = server.tv.GetAccessLevel(token)
+		}
+		if accessLevel == nil {
+			accessLevel, err = server.ks.GetAccessLevel(apiKey)
+			if err != nil {
+				sw.WriteHeader(http.StatusInternalServerError)
+				goto End
 			}
 		}
-		accessLevel, err = server.fs.GetAccessLevel(apiKey)
-		if err != nil {
-			sw.WriteHeader(http.StatusInternalServerError)
+		// Bounce any unauthorised requests
+		if !accessLevel.Can(scopeRead) {
+			denyAccess(&sw, accessLevel)
+			recordRefused(r, accessLevel, sw.Status())
 			goto End
 		}
-		// Bounce any unauthorised requests
-		if accessLevel == accessDenied {
-			sw.WriteHeader(http.StatusForbidden)
+
+		// Admin API, routed on its own methods
+		if strings.HasPrefix(r.URL.Path, server.URL.Path+`admin/`) {
+			serveAdmin(&sw, r, accessLevel)
 			goto End
 		}
 
 		// Restricted Routes
 		switch r.Method {
-		case http.MethodGet:
+		case http.MethodGet, http.MethodHead:
 			// Perform Routing
 			switch {
 			case strings.HasPrefix(r.URL.String(), server.URL.Path+`Packages`):
 				servePackageFeed(&sw, r)
 			case strings.HasPrefix(r.URL.String(), server.URL.Path+`FindPackagesById`):
 				servePackageFeed(&sw, r)
+			case strings.HasPrefix(r.URL.String(), server.URL.Path+`Search`):
+				serveSearchFeed(&sw, r)
+			case strings.HasPrefix(r.URL.String(), server.URL.Path+`GetUpdates`):
+				serveUpdatesFeed(&sw, r)
 			case strings.HasPrefix(r.URL.String(), server.URL.Path+`nupkg`):
-				servePackageFile(&sw, r)
+				// get the last two parts of the URL
+				x := strings.Split(r.URL.Path, `/`)
+				servePackageFile(&sw, r, x[len(x)-2], x[len(x)-1])
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3-flatcontainer/`):
+				serveFlatContainer(&sw, r)
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3/registration/`):
+				serveRegistration(&sw, r)
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3/query`):
+				serveSearch(&sw, r)
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`v3/autocomplete`):
+				serveAutocomplete(&sw, r)
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`symbols/`):
+				serveSymbolFile(&sw, r)
+			case strings.HasPrefix(r.URL.Path, server.URL.Path+`icon/`), strings.HasPrefix(r.URL.Path, server.URL.Path+`readme/`):
+				servePackageAssetRoute(&sw, r)
 			case strings.HasPrefix(r.URL.String(), server.URL.Path+`files`):
 				serveStaticFile(&sw, r, r.URL.String()[len(server.URL.Path+`files`):])
 			case strings.HasPrefix(r.URL.String(), altFilePath):
 				serveStaticFile(&sw, r, r.URL.String()[len(altFilePath):])
 			}
 		case http.MethodPut:
-			// Bounce any request without write accees
-			if accessLevel != accessReadWrite {
-				sw.WriteHeader(http.StatusForbidden)
-				return
+			// Bounce any request without push access (IDs are checked once the package is read)
+			if !accessLevel.Can(scopePush) {
+				denyAccess(&sw, accessLevel)
+				recordRefused(r, accessLevel, sw.Status())
+				goto End
 			}
 
 			// Route
 			switch {
 			case r.URL.String() == server.URL.Path:
 				// Process Request
-				uploadPackage(&sw, r)
+				uploadPackage(&sw, r, accessLevel)
 			default:
 				sw.WriteHeader(http.StatusNotFound)
 				goto End
 			}
+		case http.MethodDelete, http.MethodPost:
+			// Route {id}/{version} (nuget.org clients use api/v2/package/{id}/{version})
+			id, ver, ok := packagePathParams(r.URL.Path)
+			if !ok {
+				sw.WriteHeader(http.StatusNotFound)
+				goto End
+			}
+
+			// Bounce any request without unlist access to this ID
+			if !accessLevel.CanPackage(scopeUnlist, id) {
+				denyAccess(&sw, accessLevel)
+				recordRefused(r, accessLevel, sw.Status())
+				goto End
+			}
+			if r.Method == http.MethodDelete {
+				deletePackage(&sw, r, accessLevel, id, ver)
+			} else {
+				relistPackage(&sw, r, accessLevel, id, ver)
+			}
 		default:
 			sw.WriteHeader(http.StatusNotFound)
 			goto End
@@ -157,6 +210,19 @@ func main() {
 		p = ":" + os.Getenv("PORT")
 	}
 
+	// Save the local store's download counts before stopping
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		if fs, ok := commandStore().(*fileStoreLocal); ok {
+			if err := fs.Close(); err != nil {
+				log.Println("Error saving download counts:", err)
+			}
+		}
+		os.Exit(0)
+	}()
+
 	// Log and Start server
 	log.Println("Starting Server on ", server.URL.String()+p)
 	log.Fatal(http.ListenAndServe(p, nil))
@@ -186,10 +252,48 @@ func serveMetaData(w http.ResponseWriter, r *http.Request) {
 	w.Write(server.MetaDataResponse)
 }
 
+// requestAPIKey returns the API key sent with a request, clients using packageSourceCredentials send the
+// key as the Basic auth password
+func requestAPIKey(r *http.Request) string {
+	// Process Headers looking for API key (can't access direct as case may not match)
+	for name, headers := range r.Header {
+		// Grab ApiKey as it passes
+		if strings.ToLower(name) == "x-nuget-apikey" && headers[0] != "" {
+			return headers[0]
+		}
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// bearerToken returns the token from an Authorization: Bearer header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// denyAccess responds to a request without the access it needs, asking for credentials if none were given
+func denyAccess(w http.ResponseWriter, a *access) {
+	if a.Actor == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="NuGet"`)
+		if server.tv != nil {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="NuGet"`)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusForbidden)
+}
+
 func serveStaticFile(w http.ResponseWriter, r *http.Request, fn string) {
 
 	// Get the file from the FileStore
-	b, c, err := server.fs.GetFile(fn)
+	f, c, err := server.fs.GetFile(fn)
 	if err == ErrFileNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -197,22 +301,35 @@ func serveStaticFile(w http.ResponseWriter, r *http.Request, fn string) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer f.Close()
 
 	// Set Headers
 	w.Header().Set("Content-Type", c)
-	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 
-	// Output Xml
-	w.Write(b)
+	// Output the file
+	serveStoreFile(w, r, f)
+}
+
+// serveStoreFile streams a file from the store, handling HEAD, Range and conditional requests
+func serveStoreFile(w http.ResponseWriter, r *http.Request, f storeFile) {
+	if etag := f.ETag(); etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	http.ServeContent(w, r, "", f.ModTime(), f)
 }
 
-func servePackageFile(w http.ResponseWriter, r *http.Request) {
+// isPackageDownload returns true if a request fetches a whole package, HEAD, ranged and conditional requests are not counted
+func isPackageDownload(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		r.Header.Get("Range") == "" &&
+		r.Header.Get("If-None-Match") == "" &&
+		r.Header.Get("If-Modified-Since") == ""
+}
 
-	// get the last two parts of the URL
-	x := strings.Split(r.URL.String(), `/`)
+func servePackageFile(w http.ResponseWriter, r *http.Request, id string, ver string) {
 
 	// Get the file
-	b, t, err := server.fs.GetPackageFile(x[len(x)-2], x[len(x)-1])
+	f, t, err := server.fs.GetPackageFile(id, ver, isPackageDownload(r))
 	if err == ErrFileNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -221,22 +338,83 @@ func servePackageFile(w http.ResponseWriter, r *http.Request) {
 		return
 
 	}
+	defer f.Close()
 
 	// Set header to fix filename on client side
 	w.Header().Set("Cache-Control", "max-age=3600")
-	w.Header().Set("Content-Disposition", `filename=`+x[len(x)-2]+x[len(x)-1]+".nupkg")
+	w.Header().Set("Content-Disposition", `filename=`+id+ver+".nupkg")
 	w.Header().Set("Content-Type", t)
 	// Serve up the file
-	w.Write(b)
+	serveStoreFile(w, r, f)
+}
+
+func servePackageAssetRoute(w http.ResponseWriter, r *http.Request) {
+
+	// Split the path into {icon|readme}/{id}/{ver}
+	x := strings.Split(strings.TrimPrefix(r.URL.Path, server.URL.Path), `/`)
+	if len(x) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Find the entry required
+	npe, err := server.fs.GetPackageEntry(x[1], x[2])
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if x[0] == "icon" {
+		servePackageAsset(w, r, npe, npe.Properties.IconFile)
+	} else {
+		servePackageAsset(w, r, npe, npe.Properties.ReadmeFile)
+	}
+}
+
+// servePackageAsset serves a file embedded in a package such as its icon or readme
+func servePackageAsset(w http.ResponseWriter, r *http.Request, npe *NugetPackageEntry, name string) {
+
+	// Not all packages have one
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Get the file from the package directory
+	f, c, err := server.fs.GetFile(path.Join(packageStoreDir(npe.Properties.ID, npe.Properties.Version), name))
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Readmes are markdown, stores may not know the type of anything else so sniff it
+	if strings.EqualFold(path.Ext(name), ".md") {
+		c = "text/markdown;charset=utf-8"
+	} else if c == "" || strings.HasSuffix(c, "/octet-stream") {
+		if c, err = sniffContentType(f); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Set Headers
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("Content-Type", c)
+	serveStoreFile(w, r, f)
 }
 
 func servePackageFeed(w http.ResponseWriter, r *http.Request) {
 
 	// Local Variables
 	var err error
-	var b []byte
 	var params = &packageParams{}
-	var isMore bool
 
 	// Identify & process function parameters if they exist
 	if i := strings.Index(r.URL.Path, "("); i >= 0 { // Find opening bracket
@@ -245,121 +423,369 @@ func servePackageFeed(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Read the OData query options, bouncing anything malformed
+	fq, err := newFeedQuery(r.URL.Query())
+	if err != nil {
+		log.Println("Bad Query:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	// For /Packages() Route
 	if strings.HasPrefix(r.URL.String(), server.URL.Path+`Packages`) {
 		// If params are populated then this is a single entry requests
 		if params.ID != "" && params.Version != "" {
 			// Find the entry required
 			npe, err := server.fs.GetPackageEntry(params.ID, params.Version)
-			if err != nil {
+			if err == ErrFileNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
 
 			// Convert it to Bytes
-			b = npe.ToBytes()
-		} else {
-			// Create a new Service Struct
-			nf := NewNugetFeed("Packages", server.URL.String())
-
-			// Split out weird filter formatting
-			s := strings.SplitAfterN(r.URL.Query().Get("$filter"), " ", 3)
-
-			// Create empty id string
-			id := ""
+			b := npe.ToBytes()
 
-			// If relevant, repopulate id with
-			if strings.TrimSpace(s[0]) == "tolower(Id)" && strings.TrimSpace(s[1]) == "eq" {
-				id = s[2]              // Assign to id
-				id = id[1 : len(id)-1] // Remove quote marks
-			}
+			// Set Headers
+			w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+			w.Write(b)
+			return
+		}
 
-			// If $skiptoke is supplied, form it into a package name
-			startAfter := r.URL.Query().Get("$skiptoken")
-			startAfter = strings.ReplaceAll(startAfter, `'`, ``)
-			startAfter = strings.ReplaceAll(startAfter, `,`, `.`)
+		// Unlisted packages can only be found by ID
+		listed := func(e *NugetPackageEntry) bool { return e.IsListed() }
 
-			// Populate Packages from FileStore (100 max)
-			nf.Packages, isMore, err = server.fs.GetPackageFeedEntries(id, startAfter, 100)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+		// Read just enough of the store for the page unless the query needs every entry
+		id := fq.filter.IDHint()
+		if id == "" && fq.InStoreOrder() && !isCountRequest(r) {
+			entries, err := readFeedPage(fq, listed)
+			if _, ok := err.(*ODataError); ok {
+				log.Println("Bad Query:", err)
+				w.WriteHeader(http.StatusBadRequest)
 				return
-			}
-
-			// Add link to next page if relevant
-			if r.URL.Query().Get("$top") != "" && isMore {
-				// Get the current $top, cast to Int
-				t, err := strconv.Atoi(r.URL.Query().Get("$top"))
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				// Get a copy of the request URL
-				u, err := url.Parse(r.URL.String())
-				u.Host = server.URL.Hostname()
-				u.Scheme = server.URL.Scheme
-				// Get working copy of Query
-				q := u.Query()
-				// Update Values
-				q.Del("$skip")
-				q.Set("$top", strconv.Itoa(t-100))
-				q.Set("$skiptoken", fmt.Sprintf(`'%s','%s'`, nf.Packages[len(nf.Packages)-1].Properties.ID, nf.Packages[len(nf.Packages)-1].Properties.Version))
-				//Re-assign
-				u.RawQuery = q.Encode()
-				// Get un-encoded URL
-				cleanURL, err := url.PathUnescape(u.String())
-				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				log.Println()
-				// Add to feed
-				nf.Link = append(nf.Link, &NugetLink{
-					Rel:  "next",
-					Href: cleanURL,
-				})
-			}
-
-			if err != nil {
+			} else if err != nil {
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			serveFeedPage(w, r, "Packages", entries, fq)
+			return
+		}
 
-			// Output Xml
-			b = nf.ToBytes()
+		// Get candidates from FileStore (narrowed to an ID if the filter allows)
+		entries, _, err := server.fs.GetPackageFeedEntries(id, "", 0)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
+		entries = listedEntries(entries)
+
+		// Default to filename order to match the skip token
+		sortByFilename(entries)
+		serveFeed(w, r, "Packages", entries, fq)
 	} else if strings.HasPrefix(r.URL.String(), server.URL.Path+`FindPackagesById`) {
 
 		// Get ID from query
-		id := r.URL.Query().Get("id") // Get Value
-		id = id[1 : len(id)-1]        // Remove Quotes
-
-		// Create a new Service Struct
-		nf := NewNugetFeed("FindPackagesById", server.URL.String())
+		id := odataStringParam(r.URL.Query().Get("id"))
 
 		// Populate Packages from FileStore
-		nf.Packages, isMore, err = server.fs.GetPackageFeedEntries(id, "", 100)
+		entries, _, err := server.fs.GetPackageFeedEntries(id, "", 0)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		// Output Xml
-		b = nf.ToBytes()
+		// Default to filename order to match the skip token
+		sortByFilename(entries)
+		serveFeed(w, r, "FindPackagesById", entries, fq)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
 	}
+}
+
+func serveSearchFeed(w http.ResponseWriter, r *http.Request) {
+
+	// Read the search parameters
+	q := r.URL.Query()
+	sq := newSearchQuery(odataStringParam(q.Get("searchTerm")))
+	tfs := parseFrameworkList(odataStringParam(q.Get("targetFramework")))
+	prerelease := q.Get("includePrerelease") == "true"
+
+	// Read the OData query options, bouncing anything malformed
+	fq, err := newFeedQuery(q)
+	if err != nil {
+		log.Println("Bad Query:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Entries shown in search results
+	shown := func(e *NugetPackageEntry) bool {
+		return e.IsListed() && (prerelease || !isPrereleaseVersion(e.Properties.Version)) && supportsFrameworks(e, tfs)
+	}
+
+	// Without a search term every entry has the same relevance, so read just enough of the store for
+	// the page unless the query needs every entry
+	if len(sq.terms) == 0 && fq.InStoreOrder() && !isCountRequest(r) {
+		entries, err := readFeedPage(fq, shown)
+		if _, ok := err.(*ODataError); ok {
+			log.Println("Bad Query:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		serveFeedPage(w, r, "Search", entries, fq)
+		return
+	}
+
+	// Get all entries from FileStore
+	entries, _, err := server.fs.GetPackageFeedEntries("", "", 0)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Keep matching entries with their relevance
+	scores := make(map[*NugetPackageEntry]int)
+	var matched []*NugetPackageEntry
+	for _, e := range entries {
+		if !shown(e) {
+			continue
+		}
+		if score := sq.Score(e); score > 0 {
+			scores[e] = score
+			matched = append(matched, e)
+		}
+	}
+
+	// Default to relevance order, then downloads, then filename
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if a.Properties.DownloadCount.Value != b.Properties.DownloadCount.Value {
+			return a.Properties.DownloadCount.Value > b.Properties.DownloadCount.Value
+		}
+		return a.Filename() < b.Filename()
+	})
+
+	serveFeed(w, r, "Search", matched, fq)
+}
+
+func serveUpdatesFeed(w http.ResponseWriter, r *http.Request) {
+
+	// Read the parameters, lists are | separated
+	q := r.URL.Query()
+	ids := strings.Split(odataStringParam(q.Get("packageIds")), "|")
+	vers := strings.Split(odataStringParam(q.Get("versions")), "|")
+	tfs := parseFrameworkList(odataStringParam(q.Get("targetFrameworks")))
+	prerelease := q.Get("includePrerelease") == "true"
+	allVersions := q.Get("includeAllVersions") == "true"
+
+	// Ids and versions must pair up
+	if len(ids) != len(vers) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Constraints are optional but must also pair up if supplied
+	constraints := make([]*versionRange, len(ids))
+	if c := odataStringParam(q.Get("versionConstraints")); c != "" {
+		x := strings.Split(c, "|")
+		if len(x) != len(ids) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for i := range x {
+			vr, err := parseVersionRange(x[i])
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			constraints[i] = vr
+		}
+	}
+
+	// Read the OData query options, bouncing anything malformed
+	fq, err := newFeedQuery(q)
+	if err != nil {
+		log.Println("Bad Query:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Find the newer versions for each ID
+	var updates []*NugetPackageEntry
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		entries, err := getPackageVersions(id)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var newer []*NugetPackageEntry
+		for _, e := range entries {
+			if !e.IsListed() || compareVersions(e.Properties.Version, vers[i]) <= 0 {
+				continue
+			}
+			if !prerelease && isPrereleaseVersion(e.Properties.Version) {
+				continue
+			}
+			if constraints[i] != nil && !constraints[i].Satisfies(e.Properties.Version) {
+				continue
+			}
+			if !supportsFrameworks(e, tfs) {
+				continue
+			}
+			newer = append(newer, e)
+		}
+		// Entries are in version order so the last is the newest
+		if !allVersions && len(newer) > 0 {
+			newer = newer[len(newer)-1:]
+		}
+		updates = append(updates, newer...)
+	}
+
+	serveFeed(w, r, "GetUpdates", updates, fq)
+}
+
+// serveFeed applies the query options to entries and outputs a feed page, or the count for /$count
+func serveFeed(w http.ResponseWriter, r *http.Request, title string, entries []*NugetPackageEntry, fq *feedQuery) {
+
+	// Filter and order the entries
+	entries, err := fq.Filter(entries)
+	if err != nil {
+		log.Println("Bad Query:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	serveFeedPage(w, r, title, entries, fq)
+}
+
+// serveFeedPage outputs the page of filtered and ordered entries selected by $skip and $top, or the count for /$count
+func serveFeedPage(w http.ResponseWriter, r *http.Request, title string, entries []*NugetPackageEntry, fq *feedQuery) {
+
+	// Output just the number of entries if requested
+	if isCountRequest(r) {
+		page, _ := fq.Page(entries, 0)
+		b := []byte(strconv.Itoa(len(page)))
 
-	if len(b) == 0 {
-		w.WriteHeader(404)
-	} else {
 		// Set Headers
-		w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
 		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
 		w.Write(b)
+		return
+	}
+
+	// Create a new Feed Struct
+	nf := NewNugetFeed(title, server.URL.String())
+
+	// Add the total count if requested
+	if fq.inlineCount {
+		c := len(entries)
+		nf.Count = &c
 	}
 
+	// Populate Packages with the requested page
+	var isMore bool
+	nf.Packages, isMore = fq.Page(entries, feedPageSize)
+
+	// Add link to next page if relevant
+	if isMore {
+		next, err := fq.NextLink(r.URL, nf.Packages)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Add to feed
+		nf.Link = append(nf.Link, &NugetLink{
+			Rel:  "next",
+			Href: next,
+		})
+	}
+
+	// Output Xml
+	b := nf.ToBytes()
+
+	// Set Headers
+	w.Header().Set("Content-Type", "application/atom+xml;type=feed;charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Write(b)
+}
+
+// isCountRequest returns true for a request for the number of entries in a feed
+func isCountRequest(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, `/$count`)
 }
 
-func uploadPackage(w http.ResponseWriter, r *http.Request) {
+// readFeedPage reads entries matching a query in the store's order, a store page at a time from its
+// $skiptoken, until there are enough for the page it asks for, keep drops entries the feed doesn't show
+func readFeedPage(fq *feedQuery, keep func(*NugetPackageEntry) bool) ([]*NugetPackageEntry, error) {
+
+	// Enough for $skip and a page, plus one to tell if there is another
+	need := fq.skip + feedPageSize + 1
+	if fq.top >= 0 && fq.top <= feedPageSize {
+		need = fq.skip + fq.top
+	}
+
+	var f []*NugetPackageEntry
+	startAfter := fq.startAfter
+	for len(f) < need {
+		entries, more, err := server.fs.GetPackageFeedEntries("", startAfter, feedPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			ok, err := fq.Match(e)
+			if err != nil {
+				return nil, err
+			}
+			if ok && keep(e) {
+				f = append(f, e)
+			}
+		}
+		if !more || len(entries) == 0 {
+			break
+		}
+		last := entries[len(entries)-1]
+		startAfter = packageName(last.Properties.ID, last.Properties.Version)
+	}
+
+	return f, nil
+}
+
+// sortByFilename sorts entries into the order used by the stores
+func sortByFilename(entries []*NugetPackageEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Filename() < entries[j].Filename() })
+}
+
+// listedEntries returns the entries which have not been unlisted
+func listedEntries(entries []*NugetPackageEntry) []*NugetPackageEntry {
+	var f []*NugetPackageEntry
+	for _, e := range entries {
+		if e.IsListed() {
+			f = append(f, e)
+		}
+	}
+	return f
+}
+
+// odataStringParam removes the quotes from an OData string parameter such as 'Foo'
+func odataStringParam(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `'`) && strings.HasSuffix(s, `'`) {
+		s = s[1 : len(s)-1]
+	}
+	return strings.ReplaceAll(s, `''`, `'`)
+}
+
+func uploadPackage(w http.ResponseWriter, r *http.Request, a *access) {
 
 	log.Println("Putting Package into FileStore")
 
@@ -367,10 +793,12 @@ func uploadPackage(w http.ResponseWriter, r *http.Request) {
 	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		recordAudit(newAuditEvent(r, a, auditPush), http.StatusBadRequest)
 		return
 	}
 
-	// Detect and Decode based on mime type
+	// Detect and Decode based on mime type, the status of the last part stored is written once at the end
+	status := 0
 	if strings.HasPrefix(mediaType, "multipart/form-data") {
 		// Get a multipart.Reader
 		mr := multipart.NewReader(r.Body, params["boundary"])
@@ -381,26 +809,160 @@ func uploadPackage(w http.ResponseWriter, r *http.Request) {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			// Store the package file in byte array for use
-			pkgFile, err := ioutil.ReadAll(p)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			// Store the file
-			exists, err := server.fs.StorePackage(pkgFile)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				// Malformed or truncated body
+				log.Println("Error reading upload:", err)
+				status = http.StatusBadRequest
+				recordAudit(newAuditEvent(r, a, auditPush), status)
+				break
 			}
-			if exists == true {
-				w.WriteHeader(http.StatusConflict)
-				return
+			// Store the package, stopping at the first part that fails
+			e := newAuditEvent(r, a, auditPush)
+			status = storeUploadedPackage(p, a, e)
+			recordAudit(e, status)
+			if status != http.StatusCreated {
+				break
 			}
-			w.WriteHeader(http.StatusCreated)
 		}
 	}
+
+	// Requests without a package are bad requests
+	if status == 0 {
+		status = http.StatusBadRequest
+		recordAudit(newAuditEvent(r, a, auditPush), status)
+	}
+	w.WriteHeader(status)
+}
+
+// storeUploadedPackage spools an uploaded package to a temp file and stores it, returning the status for the
+// response and filling in the package on its audit event
+func storeUploadedPackage(p io.Reader, a *access, e *auditEvent) int {
+
+	// Spool the package to disk rather than holding it in memory
+	tmp, err := ioutil.TempFile("", "nuget-upload-*")
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Read one byte over the limit to detect packages that are too large
+	max := server.config.MaxPackageSizeMB << 20
+	n, err := io.Copy(tmp, io.LimitReader(p, max+1))
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	if n > max {
+		return http.StatusRequestEntityTooLarge
+	}
+
+	// Symbol packages are pushed to the same endpoint, tell them apart by their package type
+	pa, err := openPackage(tmp)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	e.ID, e.Version = pa.nsf.Meta.ID, pa.nsf.Meta.Version
+	if pa.IsSymbolPackage() {
+		e.Action = auditPushSymbols
+	}
+	if e.Hash, _, err = hashPackage(tmp); err != nil {
+		return http.StatusInternalServerError
+	}
+
+	// Check the key can push this ID, new IDs need push-new-id (symbols always belong to an existing ID)
+	scope := scopePush
+	if !pa.IsSymbolPackage() {
+		entries, _, err := server.fs.GetPackageFeedEntries(pa.nsf.Meta.ID, "", 1)
+		if err != nil {
+			return http.StatusInternalServerError
+		}
+		if len(entries) == 0 {
+			scope = scopePushNewID
+		}
+	}
+	if !a.CanPackage(scope, pa.nsf.Meta.ID) {
+		return http.StatusForbidden
+	}
+
+	// Store the file
+	var exists bool
+	if pa.IsSymbolPackage() {
+		exists, err = server.fs.StoreSymbolPackage(tmp, a.Owner)
+	} else {
+		exists, err = server.fs.StorePackage(tmp, a.Owner)
+	}
+	if err == ErrFileNotFound {
+		// Symbols pushed before their package
+		return http.StatusNotFound
+	} else if err == ErrNotOwner {
+		return http.StatusForbidden
+	} else if err == ErrInvalidPackage {
+		return http.StatusBadRequest
+	} else if _, ok := err.(*SymbolError); ok {
+		// Symbol packages holding malformed PDBs
+		return http.StatusBadRequest
+	} else if err != nil {
+		return http.StatusInternalServerError
+	}
+	if exists {
+		return http.StatusConflict
+	}
+	return http.StatusCreated
+}
+
+// packagePathParams splits a {id}/{version} push API path into its parts
+func packagePathParams(p string) (string, string, bool) {
+	p = strings.TrimPrefix(p, server.URL.Path)
+	p = strings.TrimPrefix(p, `api/v2/package/`)
+	x := strings.Split(strings.Trim(p, `/`), `/`)
+	if len(x) != 2 || x[0] == "" || x[1] == "" {
+		return "", "", false
+	}
+	return x[0], x[1], true
+}
+
+func deletePackage(w http.ResponseWriter, r *http.Request, a *access, id string, ver string) {
+
+	// Record the outcome
+	e := newAuditEvent(r, a, auditDeleteAction())
+	e.ID, e.Version = id, ver
+	status := http.StatusNoContent
+	defer func() { recordAudit(e, status) }()
+
+	// Remove or hide the package depending on the configured mode
+	var err error
+	if server.config.DeleteMode == "delete" {
+		log.Println("Deleting Package from FileStore")
+		err = server.fs.RemovePackage(id, ver)
+	} else {
+		log.Println("Unlisting Package in FileStore")
+		err = server.fs.SetPackageListed(id, ver, false)
+	}
+	if err == ErrFileNotFound {
+		status = http.StatusNotFound
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+
+	w.WriteHeader(status)
+}
+
+func relistPackage(w http.ResponseWriter, r *http.Request, a *access, id string, ver string) {
+
+	log.Println("Relisting Package in FileStore")
+
+	// Record the outcome
+	e := newAuditEvent(r, a, auditRelist)
+	e.ID, e.Version = id, ver
+	status := http.StatusOK
+	defer func() { recordAudit(e, status) }()
+
+	// Relist the package
+	err := server.fs.SetPackageListed(id, ver, true)
+	if err == ErrFileNotFound {
+		status = http.StatusNotFound
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+
+	w.WriteHeader(status)
 }
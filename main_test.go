@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		key    string
+		token  string
+	}{
+		{"none", nil, "", ""},
+		{"api key", map[string]string{"X-NuGet-ApiKey": "key"}, "key", ""},
+		{"api key lowercase", map[string]string{"x-nuget-apikey": "key"}, "key", ""},
+		{"basic", map[string]string{"Authorization": "Basic bnVnZXQ6a2V5"}, "key", ""},
+		{"basic without username", map[string]string{"Authorization": "Basic OmtleQ=="}, "key", ""},
+		{"basic password with colon", map[string]string{"Authorization": "Basic dXNlcjprOmV5"}, "k:ey", ""},
+		{"basic lowercase scheme", map[string]string{"Authorization": "basic bnVnZXQ6a2V5"}, "key", ""},
+		{"basic not base64", map[string]string{"Authorization": "Basic !!!"}, "", ""},
+		{"basic without colon", map[string]string{"Authorization": "Basic a2V5"}, "", ""},
+		{"api key before basic", map[string]string{"X-NuGet-ApiKey": "key", "Authorization": "Basic bnVnZXQ6b3RoZXI="}, "key", ""},
+		{"empty api key uses basic", map[string]string{"X-NuGet-ApiKey": "", "Authorization": "Basic bnVnZXQ6a2V5"}, "key", ""},
+		{"bearer", map[string]string{"Authorization": "Bearer tok"}, "", "tok"},
+		{"bearer lowercase scheme", map[string]string{"Authorization": "bearer  tok "}, "", "tok"},
+		{"bearer without token", map[string]string{"Authorization": "Bearer "}, "", ""},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodGet, "https://nuget.example.com/feed/Packages()", nil)
+		for k, v := range tt.header {
+			r.Header[k] = []string{v}
+		}
+		if key := requestAPIKey(r); key != tt.key {
+			t.Errorf("%s: requestAPIKey gave %q, want %q", tt.name, key, tt.key)
+		}
+		if token := bearerToken(r); token != tt.token {
+			t.Errorf("%s: bearerToken gave %q, want %q", tt.name, token, tt.token)
+		}
+	}
+}
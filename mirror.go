@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Actor recorded in the audit log for packages imported by the mirror
+const mirrorActor = "mirror"
+
+// mirrorTarget is a package ID and the range of its versions to mirror
+type mirrorTarget struct {
+	ID        string
+	RangeText string
+	Range     *versionRange
+}
+
+// mirrorProgress records the versions mirrored so far, so an interrupted run can be resumed and
+// versions removed from the store since aren't imported again
+type mirrorProgress struct {
+	Imported map[string][]string `json:"imported"` // Versions keyed by lowercase ID
+	file     string
+}
+
+// mirrorJob is a run of the mirror against the store
+type mirrorJob struct {
+	feed       *upstreamFeed
+	fs         fileStore
+	progress   *mirrorProgress
+	owner      string
+	dryRun     bool
+	prerelease bool
+}
+
+// mirrorCounts totals the outcome of mirroring a target
+type mirrorCounts struct {
+	InRange    int
+	Present    int
+	Imported   int
+	Unverified int // Imported without a hash from the feed to check them against
+	Failed     int
+}
+
+// runMirror is the mirror subcommand, it returns the process exit code
+func runMirror(args []string) int {
+
+	// Read the flags
+	fl := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	source := fl.String("source", "", "Feed to mirror from, the root of a V2 feed or a V3 service index ending in .json")
+	progressFile := fl.String("progress", "mirror-progress.json", "File recording the versions mirrored so far")
+	owner := fl.String("owner", upstreamOwner, "Owner given to new package IDs")
+	dryRun := fl.Bool("dry-run", false, "Report the versions that would be imported without importing them")
+	prerelease := fl.Bool("prerelease", false, "Include prerelease versions")
+	interval := fl.Duration("interval", 0, "Repeat the mirror at this interval rather than running once")
+	fl.Usage = func() {
+		fmt.Fprintln(fl.Output(), "Usage: "+os.Args[0]+" mirror -source <url> [flags] <list>")
+		fmt.Fprintln(fl.Output(), "The list has a package ID and optional version range per line, # starts a comment")
+		fl.PrintDefaults()
+	}
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+	if *source == "" || fl.NArg() != 1 {
+		fl.Usage()
+		return 2
+	}
+	targets, err := readMirrorList(fl.Arg(0))
+	if err != nil {
+		log.Println("Error reading mirror list:", err)
+		return 1
+	}
+
+	job := &mirrorJob{fs: commandStore(), owner: *owner, dryRun: *dryRun, prerelease: *prerelease}
+
+	for {
+		code := job.Run(*source, targets, *progressFile)
+		if *interval <= 0 {
+			return code
+		}
+		log.Println("Next mirror run in", *interval)
+		time.Sleep(*interval)
+	}
+}
+
+// readMirrorList reads a list of package IDs, each optionally followed by a version range
+func readMirrorList(fn string) ([]*mirrorTarget, error) {
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	targets := []*mirrorTarget{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// Ranges may contain spaces after the comma
+		t := &mirrorTarget{ID: fields[0], RangeText: strings.Join(fields[1:], "")}
+		if !isValidPackageID(t.ID) {
+			return nil, fmt.Errorf("line %d: invalid package ID '%s'", n, t.ID)
+		}
+		if t.Range, err = parseVersionRange(t.RangeText); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		targets = append(targets, t)
+	}
+	return targets, s.Err()
+}
+
+// Run mirrors each target once, printing a report, and returns the process exit code
+func (job *mirrorJob) Run(source string, targets []*mirrorTarget, progressFile string) int {
+
+	// Load the progress of earlier runs
+	var err error
+	if job.progress, err = readMirrorProgress(progressFile); err != nil {
+		log.Println("Error reading mirror progress:", err)
+		return 1
+	}
+
+	// Connect to the feed
+	if job.feed, err = newUpstreamFeed(source); err != nil {
+		log.Println("Error reading feed:", err)
+		return 1
+	}
+
+	// Mirror each target, reporting as we go
+	if job.dryRun {
+		fmt.Println("Dry run, nothing will be imported")
+	}
+	total := mirrorCounts{}
+	for _, t := range targets {
+		c := job.Mirror(t)
+		fmt.Printf("%s %s: %s\n", t.ID, t.RangeText, c)
+		total.InRange += c.InRange
+		total.Present += c.Present
+		total.Imported += c.Imported
+		total.Unverified += c.Unverified
+		total.Failed += c.Failed
+	}
+	fmt.Printf("Total: %s\n", total)
+
+	if total.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Mirror imports the versions of a target missing from the store
+func (job *mirrorJob) Mirror(t *mirrorTarget) mirrorCounts {
+
+	c := mirrorCounts{}
+
+	// List the versions on the feed and in the store
+	packages, err := job.feed.Packages(t.ID)
+	if err != nil {
+		fmt.Println("  Error listing feed:", err)
+		c.Failed++
+		return c
+	}
+	entries, _, err := job.fs.GetPackageFeedEntries(t.ID, "", 0)
+	if err != nil {
+		fmt.Println("  Error listing store:", err)
+		c.Failed++
+		return c
+	}
+
+	// IDs pushed to the store by another owner are left alone, as they are by the proxy
+	if len(entries) > 0 {
+		owners, err := job.fs.GetPackageOwners()
+		if err != nil {
+			fmt.Println("  Error listing owners:", err)
+			c.Failed++
+			return c
+		}
+		if owners[strings.ToLower(t.ID)] != job.owner {
+			fmt.Println("  Skipped, the ID is in the store with another owner")
+			c.Failed++
+			return c
+		}
+	}
+
+	for _, p := range packages {
+
+		// Only listed versions in range, and prereleases if asked for
+		if !p.Entry.IsListed() || !t.Range.Satisfies(p.Version) {
+			continue
+		}
+		if isPrereleaseVersion(p.Version) && !job.prerelease {
+			continue
+		}
+		c.InRange++
+
+		// Skip versions in the store or mirrored before
+		present := job.progress.Has(p.ID, p.Version)
+		for _, e := range entries {
+			if sameVersion(e.Properties.Version, p.Version) {
+				present = true
+			}
+		}
+		if present {
+			c.Present++
+			continue
+		}
+
+		if job.dryRun {
+			fmt.Println("  Would import", p.ID, p.Version)
+			c.Imported++
+			continue
+		}
+		verified, err := job.Import(p)
+		if err != nil {
+			fmt.Println("  Error importing", p.ID, p.Version+":", err)
+			c.Failed++
+			continue
+		}
+		if verified {
+			fmt.Println("  Imported", p.ID, p.Version)
+		} else {
+			fmt.Println("  Imported", p.ID, p.Version, "unverified, the feed gave no hash")
+			c.Unverified++
+		}
+		c.Imported++
+	}
+
+	return c
+}
+
+// String reports the counts, unverified imports are only mentioned if there were any
+func (c mirrorCounts) String() string {
+	imported := fmt.Sprintf("%d imported", c.Imported)
+	if c.Unverified > 0 {
+		imported += fmt.Sprintf(" (%d unverified)", c.Unverified)
+	}
+	return fmt.Sprintf("%d in range, %d present, %s, %d failed", c.InRange, c.Present, imported, c.Failed)
+}
+
+// Import downloads a package, checking it against the feed's hash, and stores it, returning
+// false if the feed gave no hash to check it against
+func (job *mirrorJob) Import(p *upstreamPackage) (bool, error) {
+
+	tmp, verified, err := job.feed.Download(p, server.config.MaxPackageSizeMB<<20)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// Store it, another process may have got there first
+	if _, err := storeCommandPackage(job.fs, tmp, job.owner, mirrorActor); err != nil {
+		return false, err
+	}
+
+	// Save progress after each package so an interrupted run picks up here
+	return verified, job.progress.Add(p.ID, p.Version)
+}
+
+// readMirrorProgress loads a progress file, a missing file is a first run
+func readMirrorProgress(fn string) (*mirrorProgress, error) {
+	mp := &mirrorProgress{Imported: make(map[string][]string), file: fn}
+	b, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return mp, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, mp); err != nil {
+		return nil, err
+	}
+	if mp.Imported == nil {
+		mp.Imported = make(map[string][]string)
+	}
+	return mp, nil
+}
+
+// Has returns true if a version has been mirrored before
+func (mp *mirrorProgress) Has(id string, ver string) bool {
+	for _, v := range mp.Imported[strings.ToLower(id)] {
+		if sameVersion(v, ver) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records a mirrored version, replacing the file so it is never left half written
+func (mp *mirrorProgress) Add(id string, ver string) error {
+	mp.Imported[strings.ToLower(id)] = append(mp.Imported[strings.ToLower(id)], ver)
+	b, err := json.MarshalIndent(mp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(mp.file+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(mp.file+".tmp", mp.file)
+}
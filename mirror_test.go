@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMirrorJob returns a mirror of a feed into a local store in a temp directory, the caller must remove the directory
+func testMirrorJob(t *testing.T, source string, dryRun bool) (*mirrorJob, string) {
+	dir, err := ioutil.TempDir("", "mirror-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFeedServer()
+	server.config.FileStore.RepoDIR = filepath.Join(dir, "store")
+	fs := &fileStoreLocal{}
+	if err := fs.Init(server); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	server.fs, server.as = fs, &auditStoreLocal{fs: fs}
+
+	job := &mirrorJob{fs: fs, owner: upstreamOwner, dryRun: dryRun}
+	if job.feed, err = newUpstreamFeed(source); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if job.progress, err = readMirrorProgress(filepath.Join(dir, "progress.json")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return job, dir
+}
+
+// testMirrorTarget returns a target for an ID and version range
+func testMirrorTarget(t *testing.T, id string, vr string) *mirrorTarget {
+	r, err := parseVersionRange(vr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mirrorTarget{ID: id, RangeText: vr, Range: r}
+}
+
+func TestMirror(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Pkg", "1.1.0", "Test.Pkg", "1.2.0-beta", "Test.Pkg", "2.0.0")
+	defer tf.Close()
+	target := testMirrorTarget(t, "Test.Pkg", "[1.0,2.0)")
+
+	for _, source := range []string{tf.URL + "/v2", tf.URL + "/v3/index.json"} {
+		job, dir := testMirrorJob(t, source, true)
+		defer os.RemoveAll(dir)
+		stored := func() int {
+			entries, _, _ := job.fs.GetPackageFeedEntries("Test.Pkg", "", 0)
+			return len(entries)
+		}
+
+		// A dry run imports nothing
+		if c := job.Mirror(target); c != (mirrorCounts{InRange: 2, Imported: 2}) {
+			t.Errorf("%s: dry run counts %+v", source, c)
+		}
+		if stored() != 0 || len(job.progress.Imported) != 0 {
+			t.Errorf("%s: dry run imported %d versions", source, stored())
+		}
+
+		// The versions in range are imported and recorded
+		job.dryRun = false
+		if c := job.Mirror(target); c != (mirrorCounts{InRange: 2, Imported: 2}) {
+			t.Errorf("%s: counts %+v", source, c)
+		}
+		if stored() != 2 {
+			t.Errorf("%s: store has %d versions, want 2", source, stored())
+		}
+		progress, err := readMirrorProgress(job.progress.file)
+		if err != nil || !progress.Has("test.pkg", "1.0") || !progress.Has("TEST.PKG", "1.1.0") {
+			t.Errorf("%s: progress %+v, %v", source, progress, err)
+		}
+
+		// Versions mirrored before aren't imported again, even if they have been removed from the store
+		if err := job.fs.RemovePackage("Test.Pkg", "1.0.0"); err != nil {
+			t.Fatal(err)
+		}
+		job.progress = progress
+		if c := job.Mirror(target); c != (mirrorCounts{InRange: 2, Present: 2}) {
+			t.Errorf("%s: rerun counts %+v", source, c)
+		}
+
+		// Prereleases are only mirrored if asked for
+		job.prerelease = true
+		if c := job.Mirror(target); c != (mirrorCounts{InRange: 3, Present: 2, Imported: 1}) {
+			t.Errorf("%s: prerelease counts %+v", source, c)
+		}
+	}
+}
+
+func TestMirrorResume(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Pkg", "1.1.0")
+	defer tf.Close()
+	job, dir := testMirrorJob(t, tf.URL+"/v3/index.json", false)
+	defer os.RemoveAll(dir)
+
+	// A run interrupted after the first version carries on from the second
+	if err := job.progress.Add("Test.Pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	list := filepath.Join(dir, "list.txt")
+	if err := ioutil.WriteFile(list, []byte("Test.Pkg  # every version\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := readMirrorList(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := job.Run(tf.URL+"/v3/index.json", targets, job.progress.file); code != 0 {
+		t.Errorf("Run gave %d", code)
+	}
+	entries, _, _ := job.fs.GetPackageFeedEntries("Test.Pkg", "", 0)
+	if len(entries) != 1 || entries[0].Properties.Version != "1.1.0" {
+		t.Errorf("resumed run stored %d versions", len(entries))
+	}
+	if !job.progress.Has("Test.Pkg", "1.0.0") || !job.progress.Has("Test.Pkg", "1.1.0") {
+		t.Errorf("progress %+v", job.progress.Imported)
+	}
+}
+
+func TestMirrorHash(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Pkg", "1.1.0", "Test.Pkg", "1.2.0")
+	defer tf.Close()
+	target := testMirrorTarget(t, "Test.Pkg", "")
+
+	// The second version's hash is another package's, the third has none
+	tf.packages[1].Hash = tf.packages[0].Hash
+	tf.packages[2].Hash = ""
+
+	for _, source := range []string{tf.URL + "/v2", tf.URL + "/v3/index.json"} {
+		job, dir := testMirrorJob(t, source, false)
+		defer os.RemoveAll(dir)
+
+		if c := job.Mirror(target); c != (mirrorCounts{InRange: 3, Imported: 2, Unverified: 1, Failed: 1}) {
+			t.Errorf("%s: counts %+v", source, c)
+		}
+		if _, err := job.fs.GetPackageEntry("Test.Pkg", "1.1.0"); err != ErrFileNotFound {
+			t.Errorf("%s: package with a mismatched hash stored", source)
+		}
+		if job.progress.Has("Test.Pkg", "1.1.0") {
+			t.Errorf("%s: package with a mismatched hash recorded", source)
+		}
+	}
+
+	// Failures fail the run
+	job, dir := testMirrorJob(t, tf.URL+"/v2", false)
+	defer os.RemoveAll(dir)
+	if code := job.Run(tf.URL+"/v2", []*mirrorTarget{target}, job.progress.file); code != 1 {
+		t.Errorf("Run gave %d, want 1", code)
+	}
+}
+
+func TestMirrorInvalidVersion(t *testing.T) {
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Pkg", "1.0.0-a..b")
+	defer tf.Close()
+	target := testMirrorTarget(t, "Test.Pkg", "")
+
+	// Versions the store can't hold are never imported
+	for _, source := range []string{tf.URL + "/v2", tf.URL + "/v3/index.json"} {
+		job, dir := testMirrorJob(t, source, false)
+		defer os.RemoveAll(dir)
+		c := job.Mirror(target)
+		entries, _, _ := job.fs.GetPackageFeedEntries("Test.Pkg", "", 0)
+		if c.Imported != 1 || len(entries) != 1 || job.progress.Has("Test.Pkg", "1.0.0-a..b") {
+			t.Errorf("%s: counts %+v, store has %d versions", source, c, len(entries))
+		}
+	}
+}
+
+func TestReadMirrorList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "list.txt")
+
+	tests := []struct {
+		list    string
+		targets int
+		valid   bool
+	}{
+		{"# Packages\nTest.Pkg\n\nOther.Pkg [1.0, 2.0)  # a range\n", 2, true},
+		{"Test.Pkg [1.0,2.0\n", 0, false},
+		{"../../x\n", 0, false},
+		{"Test/Pkg 1.0\n", 0, false},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(list, []byte(tt.list), 0644); err != nil {
+			t.Fatal(err)
+		}
+		targets, err := readMirrorList(list)
+		if (err == nil) != tt.valid || len(targets) != tt.targets {
+			t.Errorf("readMirrorList(%q) gave %d targets, %v", tt.list, len(targets), err)
+		}
+	}
+}
+
+func TestMirrorCountsString(t *testing.T) {
+	tests := []struct {
+		c mirrorCounts
+		s string
+	}{
+		{mirrorCounts{InRange: 3, Present: 1, Imported: 2}, "3 in range, 1 present, 2 imported, 0 failed"},
+		{mirrorCounts{InRange: 3, Imported: 2, Unverified: 1, Failed: 1}, "3 in range, 0 present, 2 imported (1 unverified), 1 failed"},
+	}
+	for _, tt := range tests {
+		if s := tt.c.String(); s != tt.s {
+			t.Errorf("%+v gave %q, want %q", tt.c, s, tt.s)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/xml"
+	"path"
+	"strings"
+)
+
+// nuspecPackageType is a single package type declared in a .nuspec
+type nuspecPackageType struct {
+	Name    string `xml:"name,attr"`
+	Version string `xml:"version,attr"`
+}
+
+// nuspecDependency is a single dependency declared in a .nuspec
+type nuspecDependency struct {
+	ID      string `xml:"id,attr"`
+	Version string `xml:"version,attr"`
+}
+
+// nuspecDependencyGroup is a set of dependencies for a target framework
+type nuspecDependencyGroup struct {
+	TargetFramework string             `xml:"targetFramework,attr"`
+	Dependency      []nuspecDependency `xml:"dependency"`
+}
+
+// nuspecExtra holds the .nuspec metadata not read by go-nuspec
+type nuspecExtra struct {
+	XMLName xml.Name `xml:"package"`
+	Meta    struct {
+		MinClientVersion string `xml:"minClientVersion,attr"`
+		Icon             string `xml:"icon"`
+		Readme           string `xml:"readme"`
+		Repository       struct {
+			Type   string `xml:"type,attr"`
+			URL    string `xml:"url,attr"`
+			Branch string `xml:"branch,attr"`
+			Commit string `xml:"commit,attr"`
+		} `xml:"repository"`
+		PackageTypes struct {
+			PackageType []nuspecPackageType `xml:"packageType"`
+		} `xml:"packageTypes"`
+		Dependencies struct {
+			Group      []nuspecDependencyGroup `xml:"group"`
+			Dependency []nuspecDependency      `xml:"dependency"`
+		} `xml:"dependencies"`
+	} `xml:"metadata"`
+}
+
+// parseNuspecExtra reads the additional metadata from .nuspec contents
+func parseNuspecExtra(b []byte) (*nuspecExtra, error) {
+	ne := nuspecExtra{}
+	if err := xml.Unmarshal(b, &ne); err != nil {
+		return nil, err
+	}
+	return &ne, nil
+}
+
+// HasPackageType returns true if the package declares the named package type
+func (ne *nuspecExtra) HasPackageType(name string) bool {
+	for _, pt := range ne.Meta.PackageTypes.PackageType {
+		if strings.EqualFold(pt.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveFiles matches the icon and readme paths to the files in the package, clearing any not present
+func (ne *nuspecExtra) ResolveFiles(names []string) {
+	ne.Meta.Icon = resolvePackageFile(ne.Meta.Icon, names)
+	ne.Meta.Readme = resolvePackageFile(ne.Meta.Readme, names)
+}
+
+// resolvePackageFile returns the name of the package file matching a nuspec path, or an empty string if there is none
+func resolvePackageFile(p string, names []string) string {
+	p = strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(strings.TrimSpace(p), `\`, `/`)), "/")
+	if p == "" || p == "." {
+		return ""
+	}
+	for _, name := range names {
+		if strings.EqualFold(name, p) {
+			return name
+		}
+	}
+	return ""
+}
+
+// V2Dependencies returns the dependencies in the V2 feed format of id:range:framework separated by |
+func (ne *nuspecExtra) V2Dependencies() string {
+
+	var deps []string
+
+	// Dependencies outside of a group apply to all frameworks
+	for _, d := range ne.Meta.Dependencies.Dependency {
+		deps = append(deps, d.ID+":"+d.Version+":")
+	}
+
+	// Grouped dependencies, an empty group is written as ::framework
+	for _, g := range ne.Meta.Dependencies.Group {
+		tf := shortFrameworkName(g.TargetFramework)
+		if len(g.Dependency) == 0 {
+			deps = append(deps, "::"+tf)
+		}
+		for _, d := range g.Dependency {
+			deps = append(deps, d.ID+":"+d.Version+":"+tf)
+		}
+	}
+
+	return strings.Join(deps, "|")
+}
+
+// DependencyFrameworks returns the short names of the frameworks with a dependency group
+func (ne *nuspecExtra) DependencyFrameworks() []string {
+	var tfs []string
+	for _, g := range ne.Meta.Dependencies.Group {
+		if g.TargetFramework != "" {
+			tfs = append(tfs, shortFrameworkName(g.TargetFramework))
+		}
+	}
+	return tfs
+}
+
+// spdxLicenseNames returns the license IDs used in an SPDX license expression, skipping operators and exceptions
+func spdxLicenseNames(expr string) []string {
+	var names []string
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(expr))
+	for i := 0; i < len(fields); i++ {
+		switch strings.ToUpper(fields[i]) {
+		case "AND", "OR":
+		case "WITH":
+			i++
+		default:
+			names = append(names, strings.TrimSuffix(fields[i], "+"))
+		}
+	}
+	return names
+}
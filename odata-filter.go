@@ -0,0 +1,649 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ODataError is returned when an OData expression can't be parsed or evaluated
+type ODataError struct {
+	ErrorString string
+}
+
+func (oe *ODataError) Error() string {
+	return oe.ErrorString
+}
+
+func newODataError(format string, a ...interface{}) *ODataError {
+	return &ODataError{fmt.Sprintf(format, a...)}
+}
+
+// odataExpr is a node in a parsed OData expression
+type odataExpr interface {
+	eval(npe *NugetPackageEntry) (interface{}, error)
+}
+
+// odataLiteral is a constant value (string, bool, float64 or nil)
+type odataLiteral struct {
+	value interface{}
+}
+
+func (l *odataLiteral) eval(npe *NugetPackageEntry) (interface{}, error) {
+	return l.value, nil
+}
+
+// odataMember is a reference to a property of the package entry
+type odataMember struct {
+	name string
+}
+
+func (m *odataMember) eval(npe *NugetPackageEntry) (interface{}, error) {
+	v, ok := odataPropertyValue(npe, m.name)
+	if !ok {
+		return nil, newODataError("unknown property '%s'", m.name)
+	}
+	return v, nil
+}
+
+// odataUnary is a not expression
+type odataUnary struct {
+	op string
+	x  odataExpr
+}
+
+func (u *odataUnary) eval(npe *NugetPackageEntry) (interface{}, error) {
+	x, err := u.x.eval(npe)
+	if err != nil {
+		return nil, err
+	}
+	// Not null is null, as with the comparison operators
+	if x == nil {
+		return nil, nil
+	}
+	b, ok := x.(bool)
+	if !ok {
+		return nil, newODataError("operand of '%s' is not boolean", u.op)
+	}
+	return !b, nil
+}
+
+// odataBinary is a logical or comparison expression
+type odataBinary struct {
+	op string
+	x  odataExpr
+	y  odataExpr
+}
+
+func (b *odataBinary) eval(npe *NugetPackageEntry) (interface{}, error) {
+	x, err := b.x.eval(npe)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short circuit logical operators
+	switch b.op {
+	case "and", "or":
+		xb, ok := x.(bool)
+		if !ok && x != nil {
+			return nil, newODataError("left operand of '%s' is not boolean", b.op)
+		}
+		if b.op == "and" && !xb {
+			return false, nil
+		}
+		if b.op == "or" && xb {
+			return true, nil
+		}
+		y, err := b.y.eval(npe)
+		if err != nil {
+			return nil, err
+		}
+		yb, ok := y.(bool)
+		if !ok && y != nil {
+			return nil, newODataError("right operand of '%s' is not boolean", b.op)
+		}
+		return yb, nil
+	}
+
+	y, err := b.y.eval(npe)
+	if err != nil {
+		return nil, err
+	}
+
+	// Null only equals null
+	if x == nil || y == nil {
+		switch b.op {
+		case "eq":
+			return x == nil && y == nil, nil
+		case "ne":
+			return !(x == nil && y == nil), nil
+		}
+		return false, nil
+	}
+
+	c, err := odataCompare(x, y)
+	if err != nil {
+		return nil, err
+	}
+	switch b.op {
+	case "eq":
+		return c == 0, nil
+	case "ne":
+		return c != 0, nil
+	case "gt":
+		return c > 0, nil
+	case "ge":
+		return c >= 0, nil
+	case "lt":
+		return c < 0, nil
+	case "le":
+		return c <= 0, nil
+	}
+	return nil, newODataError("unknown operator '%s'", b.op)
+}
+
+// odataCall is a call to a built in function
+type odataCall struct {
+	name string
+	args []odataExpr
+}
+
+// Number of arguments taken by each supported function
+var odataFunctions = map[string]int{
+	"tolower":     1,
+	"toupper":     1,
+	"trim":        1,
+	"length":      1,
+	"substringof": 2,
+	"startswith":  2,
+	"endswith":    2,
+	"indexof":     2,
+	"concat":      2,
+}
+
+func (c *odataCall) eval(npe *NugetPackageEntry) (interface{}, error) {
+
+	// Evaluate arguments, all functions take strings
+	var args []string
+	for _, a := range c.args {
+		v, err := a.eval(npe)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			return nil, nil
+		}
+		s, ok := v.(string)
+		if !ok {
+			return nil, newODataError("argument to '%s' is not a string", c.name)
+		}
+		args = append(args, s)
+	}
+
+	switch c.name {
+	case "tolower":
+		return strings.ToLower(args[0]), nil
+	case "toupper":
+		return strings.ToUpper(args[0]), nil
+	case "trim":
+		return strings.TrimSpace(args[0]), nil
+	case "length":
+		return float64(len(args[0])), nil
+	case "substringof":
+		return strings.Contains(args[1], args[0]), nil
+	case "startswith":
+		return strings.HasPrefix(args[0], args[1]), nil
+	case "endswith":
+		return strings.HasSuffix(args[0], args[1]), nil
+	case "indexof":
+		return float64(strings.Index(args[0], args[1])), nil
+	case "concat":
+		return args[0] + args[1], nil
+	}
+	return nil, newODataError("unknown function '%s'", c.name)
+}
+
+// odataCompare compares two non nil values of the same type
+func odataCompare(x interface{}, y interface{}) (int, error) {
+	switch xv := x.(type) {
+	case string:
+		if yv, ok := y.(string); ok {
+			return strings.Compare(xv, yv), nil
+		}
+	case float64:
+		if yv, ok := y.(float64); ok {
+			switch {
+			case xv < yv:
+				return -1, nil
+			case xv > yv:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case bool:
+		if yv, ok := y.(bool); ok {
+			switch {
+			case xv == yv:
+				return 0, nil
+			case yv:
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	return 0, newODataError("cannot compare %v with %v", x, y)
+}
+
+// odataPropertyValue returns the value of a named V2FeedPackage property
+func odataPropertyValue(npe *NugetPackageEntry, name string) (interface{}, bool) {
+	p := &npe.Properties
+	switch name {
+	case "Id":
+		return p.ID, true
+	case "Version":
+		return p.Version, true
+	case "NormalizedVersion":
+		return p.VersionNorm, true
+	case "Title":
+		return p.Title, true
+	case "Summary":
+		return npe.Summary.Text, true
+	case "Description":
+		return p.Description, true
+	case "Authors":
+		return npe.Author.Name, true
+	case "Tags":
+		return p.Tags, true
+	case "Copyright":
+		return odataNullable(p.Copyright.Value, p.Copyright.Null), true
+	case "Dependencies":
+		return p.Dependencies, true
+	case "DownloadCount":
+		return float64(p.DownloadCount.Value), true
+	case "VersionDownloadCount":
+		return float64(p.VersionDownloadCount.Value), true
+	case "PackageSize":
+		return float64(p.PackageSize.Value), true
+	case "PackageHash":
+		return p.PackageHash, true
+	case "PackageHashAlgorithm":
+		return p.PackageHashAlgorithm, true
+	case "IsLatestVersion":
+		return p.IsLatestVersion.Value, true
+	case "IsAbsoluteLatestVersion":
+		return p.IsAbsoluteLatestVersion.Value, true
+	case "IsPrerelease":
+		return p.IsPrerelease.Value, true
+	case "RequireLicenseAcceptance":
+		return p.RequireLicenseAcceptance.Value, true
+	case "Listed":
+		return npe.IsListed(), true
+	case "Created":
+		return p.Created.Value, true
+	case "LastEdited":
+		return p.LastEdited.Value, true
+	case "Published":
+		return p.Published.Value, true
+	case "GalleryDetailsUrl":
+		return p.GalleryDetailsURL, true
+	case "IconUrl":
+		return p.IconURL, true
+	case "ProjectUrl":
+		return p.ProjectURL, true
+	case "ReportAbuseUrl":
+		return p.ReportAbuseURL, true
+	case "LicenseUrl":
+		return odataNullable(p.LicenseURL.Value, p.LicenseURL.Null), true
+	case "LicenseNames":
+		return odataNullable(p.LicenseNames.Value, p.LicenseNames.Null), true
+	case "LicenseReportUrl":
+		return odataNullable(p.LicenseReportURL.Value, p.LicenseReportURL.Null), true
+	case "ReleaseNotes":
+		return odataNullable(p.ReleaseNotes.Value, p.ReleaseNotes.Null), true
+	case "MinClientVersion":
+		return odataNullable(p.MinClientVersion.Value, p.MinClientVersion.Null), true
+	case "Language":
+		return p.Language, true
+	}
+	return nil, false
+}
+
+// odataNullable returns nil for null values so they compare as OData null
+func odataNullable(v string, null bool) interface{} {
+	if null {
+		return nil
+	}
+	return v
+}
+
+// odataFilter is a parsed $filter expression
+type odataFilter struct {
+	expr odataExpr
+}
+
+// parseODataFilter parses a V2 $filter expression, an empty string matches everything
+func parseODataFilter(s string) (*odataFilter, error) {
+	f := odataFilter{}
+	if strings.TrimSpace(s) == "" {
+		return &f, nil
+	}
+	p, err := newODataParser(s)
+	if err != nil {
+		return nil, err
+	}
+	f.expr, err = p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != odataTokenEOF {
+		return nil, newODataError("unexpected '%s' at position %d", p.peek().text, p.peek().pos)
+	}
+	// Evaluate against an empty entry to catch unknown properties and type errors early
+	if _, err := f.Match(&NugetPackageEntry{}); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Match returns true if the entry satisfies the filter
+func (f *odataFilter) Match(npe *NugetPackageEntry) (bool, error) {
+	if f.expr == nil {
+		return true, nil
+	}
+	v, err := f.expr.eval(npe)
+	if err != nil {
+		return false, err
+	}
+	if v == nil {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, newODataError("filter is not a boolean expression")
+	}
+	return b, nil
+}
+
+// IDHint returns the package ID if the filter requires an exact (case insensitive) ID match
+func (f *odataFilter) IDHint() string {
+	return odataIDHint(f.expr)
+}
+
+func odataIDHint(e odataExpr) string {
+	b, ok := e.(*odataBinary)
+	if !ok {
+		return ""
+	}
+	switch b.op {
+	case "and":
+		if id := odataIDHint(b.x); id != "" {
+			return id
+		}
+		return odataIDHint(b.y)
+	case "eq":
+		// Check for a literal on one side and Id (or a case change of it) on the other
+		x, y := b.x, b.y
+		if _, ok := x.(*odataLiteral); ok {
+			x, y = y, x
+		}
+		l, ok := y.(*odataLiteral)
+		if !ok {
+			return ""
+		}
+		s, ok := l.value.(string)
+		if !ok {
+			return ""
+		}
+		if c, ok := x.(*odataCall); ok && (c.name == "tolower" || c.name == "toupper") {
+			x = c.args[0]
+		}
+		if m, ok := x.(*odataMember); ok && m.name == "Id" {
+			return s
+		}
+	}
+	return ""
+}
+
+// Token types produced by the lexer
+type odataTokenKind int
+
+const (
+	odataTokenEOF odataTokenKind = iota
+	odataTokenIdent
+	odataTokenString
+	odataTokenNumber
+	odataTokenOpen
+	odataTokenClose
+	odataTokenComma
+)
+
+type odataToken struct {
+	kind odataTokenKind
+	text string
+	pos  int
+}
+
+// odataParser is a recursive descent parser over a token list
+type odataParser struct {
+	tokens []odataToken
+	pos    int
+}
+
+func newODataParser(s string) (*odataParser, error) {
+	p := odataParser{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			p.tokens = append(p.tokens, odataToken{odataTokenOpen, "(", i})
+			i++
+		case c == ')':
+			p.tokens = append(p.tokens, odataToken{odataTokenClose, ")", i})
+			i++
+		case c == ',':
+			p.tokens = append(p.tokens, odataToken{odataTokenComma, ",", i})
+			i++
+		case c == '\'':
+			// Quoted string, a doubled quote is an escaped quote
+			var sb strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return nil, newODataError("unterminated string at position %d", i)
+				}
+				if s[j] == '\'' {
+					if j+1 < len(s) && s[j+1] == '\'' {
+						sb.WriteByte('\'')
+						j += 2
+						continue
+					}
+					break
+				}
+				sb.WriteByte(s[j])
+				j++
+			}
+			p.tokens = append(p.tokens, odataToken{odataTokenString, sb.String(), i})
+			i = j + 1
+		case c == '-' || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, odataToken{odataTokenNumber, s[i:j], i})
+			// Skip any type suffix (L, M, D, F)
+			if j < len(s) && strings.ContainsRune("LMDFlmdf", rune(s[j])) {
+				j++
+			}
+			i = j
+		case c == '_' || unicode.IsLetter(c):
+			j := i + 1
+			for j < len(s) && (s[j] == '_' || s[j] == '/' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			p.tokens = append(p.tokens, odataToken{odataTokenIdent, s[i:j], i})
+			i = j
+		default:
+			return nil, newODataError("unexpected '%c' at position %d", c, i)
+		}
+	}
+	p.tokens = append(p.tokens, odataToken{odataTokenEOF, "end of filter", len(s)})
+	return &p, nil
+}
+
+func (p *odataParser) peek() odataToken {
+	return p.tokens[p.pos]
+}
+
+func (p *odataParser) next() odataToken {
+	t := p.tokens[p.pos]
+	if t.kind != odataTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the supplied operator keyword
+func (p *odataParser) keyword(k string) bool {
+	if t := p.peek(); t.kind == odataTokenIdent && t.text == k {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *odataParser) expect(kind odataTokenKind, text string) error {
+	if t := p.next(); t.kind != kind {
+		return newODataError("expected '%s' at position %d but found '%s'", text, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *odataParser) parseExpr() (odataExpr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &odataBinary{"or", x, y}
+	}
+	return x, nil
+}
+
+func (p *odataParser) parseAnd() (odataExpr, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = &odataBinary{"and", x, y}
+	}
+	return x, nil
+}
+
+func (p *odataParser) parseNot() (odataExpr, error) {
+	if p.keyword("not") {
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &odataUnary{"not", x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *odataParser) parseComparison() (odataExpr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"eq", "ne", "gt", "ge", "lt", "le"} {
+		if p.keyword(op) {
+			y, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &odataBinary{op, x, y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *odataParser) parsePrimary() (odataExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case odataTokenOpen:
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(odataTokenClose, ")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case odataTokenString:
+		return &odataLiteral{t.text}, nil
+	case odataTokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, newODataError("invalid number '%s' at position %d", t.text, t.pos)
+		}
+		return &odataLiteral{f}, nil
+	case odataTokenIdent:
+		switch t.text {
+		case "true":
+			return &odataLiteral{true}, nil
+		case "false":
+			return &odataLiteral{false}, nil
+		case "null":
+			return &odataLiteral{nil}, nil
+		case "datetime", "guid":
+			// Typed literals are compared as their string form
+			if s := p.peek(); s.kind == odataTokenString && s.pos == t.pos+len(t.text) {
+				p.next()
+				return &odataLiteral{s.text}, nil
+			}
+		}
+		// Function call
+		if p.peek().kind == odataTokenOpen {
+			n, ok := odataFunctions[t.text]
+			if !ok {
+				return nil, newODataError("unknown function '%s' at position %d", t.text, t.pos)
+			}
+			p.next()
+			c := &odataCall{name: t.text}
+			for len(c.args) < n {
+				if len(c.args) > 0 {
+					if err := p.expect(odataTokenComma, ","); err != nil {
+						return nil, err
+					}
+				}
+				a, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				c.args = append(c.args, a)
+			}
+			if err := p.expect(odataTokenClose, ")"); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+		// Property reference
+		if _, ok := odataPropertyValue(&NugetPackageEntry{}, t.text); !ok {
+			return nil, newODataError("unknown property '%s' at position %d", t.text, t.pos)
+		}
+		return &odataMember{t.text}, nil
+	}
+	return nil, newODataError("unexpected '%s' at position %d", t.text, t.pos)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+)
+
+// testFilterEntry returns an entry for the filter tests, with a null Copyright
+func testFilterEntry() *NugetPackageEntry {
+	e := &NugetPackageEntry{}
+	e.Properties.ID = "Test.Package"
+	e.Properties.Version = "1.2.0-Beta"
+	e.Properties.VersionNorm = "1.2.0-Beta"
+	e.Properties.Tags = "json serializer"
+	e.Properties.Copyright.Null = true
+	e.Properties.DownloadCount.Value = 42
+	e.Properties.IsPrerelease.Value = true
+	e.Properties.IsLatestVersion.Value = false
+	e.SetListed(true)
+	return e
+}
+
+func TestODataFilterMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{"", true},
+		{"Id eq 'Test.Package'", true},
+		{"Id eq 'test.package'", false},
+		{"tolower(Id) eq 'test.package'", true},
+		{"toupper(Id) eq 'TEST.PACKAGE'", true},
+		{"Id ne 'Other'", true},
+		{"DownloadCount gt 40", true},
+		{"DownloadCount ge 42", true},
+		{"DownloadCount lt 42", false},
+		{"DownloadCount le 42L", true},
+		{"IsPrerelease", true},
+		{"IsPrerelease eq false", false},
+		{"not IsPrerelease", false},
+		{"not not IsPrerelease", true},
+		{"IsLatestVersion or IsPrerelease", true},
+		{"IsLatestVersion and IsPrerelease", false},
+		{"(IsLatestVersion or IsPrerelease) and Listed", true},
+		{"IsLatestVersion or IsPrerelease and DownloadCount eq 0", false},
+		{"substringof('json', Tags)", true},
+		{"startswith(Id, 'Test.')", true},
+		{"endswith(Id, '.Other')", false},
+		{"indexof(Id, 'Package') eq 5", true},
+		{"length(Id) eq 12", true},
+		{"concat(Id, '|') eq 'Test.Package|'", true},
+		{"trim(' x ') eq 'x'", true},
+		{"Id eq 'It''s'", false},
+
+		// Null only equals null, and is not true or false
+		{"Copyright eq null", true},
+		{"Copyright ne null", false},
+		{"Copyright eq 'x'", false},
+		{"Copyright gt 'x'", false},
+		{"null", false},
+		{"not null", false},
+		{"startswith(Copyright, 'x')", false},
+		{"not startswith(Copyright, 'x')", false},
+		{"not startswith(Copyright, 'x') or Listed", true},
+	}
+	e := testFilterEntry()
+	for _, tt := range tests {
+		f, err := parseODataFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseODataFilter(%q) error: %v", tt.filter, err)
+			continue
+		}
+		m, err := f.Match(e)
+		if err != nil {
+			t.Errorf("Match(%q) error: %v", tt.filter, err)
+			continue
+		}
+		if m != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.filter, m, tt.match)
+		}
+	}
+}
+
+func TestODataFilterErrors(t *testing.T) {
+	tests := []string{
+		"Id eq",
+		"Id eq 'x",
+		"Nope eq 'x'",
+		"nope(Id)",
+		"tolower(Id, 'x')",
+		"(Id eq 'x'",
+		"Id eq 'x')",
+		"Id eq 'x' Version",
+		"Id eq 1",
+		"not Id",
+		"Id and Listed",
+		"length(DownloadCount) eq 1",
+		"Id # 'x'",
+	}
+	for _, filter := range tests {
+		if _, err := parseODataFilter(filter); err == nil {
+			t.Errorf("parseODataFilter(%q) expected an error", filter)
+		} else if _, ok := err.(*ODataError); !ok {
+			t.Errorf("parseODataFilter(%q) error %T, want *ODataError", filter, err)
+		}
+	}
+}
+
+func TestODataFilterIDHint(t *testing.T) {
+	tests := []struct {
+		filter string
+		id     string
+	}{
+		{"", ""},
+		{"Id eq 'A.B'", "A.B"},
+		{"'A.B' eq Id", "A.B"},
+		{"tolower(Id) eq 'a.b'", "a.b"},
+		{"IsLatestVersion and Id eq 'A.B'", "A.B"},
+		{"Id eq 'A.B' or Id eq 'C.D'", ""},
+		{"Id ne 'A.B'", ""},
+		{"not (Id eq 'A.B')", ""},
+		{"Title eq 'A.B'", ""},
+	}
+	for _, tt := range tests {
+		f, err := parseODataFilter(tt.filter)
+		if err != nil {
+			t.Errorf("parseODataFilter(%q) error: %v", tt.filter, err)
+			continue
+		}
+		if id := f.IDHint(); id != tt.id {
+			t.Errorf("IDHint(%q) = %q, want %q", tt.filter, id, tt.id)
+		}
+	}
+}
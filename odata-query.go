@@ -0,0 +1,275 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of entries returned in a single page of a V2 feed
+const feedPageSize = 100
+
+// odataOrder is a single $orderby clause
+type odataOrder struct {
+	expr odataExpr
+	desc bool
+}
+
+// feedQuery holds the OData query options applied to a V2 feed
+type feedQuery struct {
+	filter      *odataFilter
+	orderBy     []odataOrder
+	skip        int
+	top         int
+	startAfter  string
+	inlineCount bool
+	semVer2     bool
+}
+
+// newFeedQuery reads $filter, $orderby, $skip, $top, $skiptoken and $inlinecount from a request query
+func newFeedQuery(q url.Values) (*feedQuery, error) {
+
+	var err error
+	fq := feedQuery{top: -1}
+
+	// Parse the filter
+	fq.filter, err = parseODataFilter(q.Get("$filter"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the ordering
+	fq.orderBy, err = parseODataOrderBy(q.Get("$orderby"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Read numeric paging values
+	if q.Get("$skip") != "" {
+		if fq.skip, err = strconv.Atoi(q.Get("$skip")); err != nil || fq.skip < 0 {
+			return nil, newODataError("invalid $skip '%s'", q.Get("$skip"))
+		}
+	}
+	if q.Get("$top") != "" {
+		if fq.top, err = strconv.Atoi(q.Get("$top")); err != nil || fq.top < 0 {
+			return nil, newODataError("invalid $top '%s'", q.Get("$top"))
+		}
+	}
+
+	// If $skiptoken is supplied, form it into a package name
+	fq.startAfter = q.Get("$skiptoken")
+	fq.startAfter = strings.ReplaceAll(fq.startAfter, `'`, ``)
+	fq.startAfter = strings.ReplaceAll(fq.startAfter, `,`, `.`)
+
+	// Check for a total count request
+	switch q.Get("$inlinecount") {
+	case "", "none":
+	case "allpages":
+		fq.inlineCount = true
+	default:
+		return nil, newODataError("invalid $inlinecount '%s'", q.Get("$inlinecount"))
+	}
+
+	// SemVer 2.0 packages are hidden from older clients
+	fq.semVer2 = allowsSemVer2(q.Get("semVerLevel"))
+
+	return &fq, nil
+}
+
+// parseODataOrderBy parses a comma separated list of expressions each optionally followed by asc or desc
+func parseODataOrderBy(s string) ([]odataOrder, error) {
+
+	var orders []odataOrder
+	if strings.TrimSpace(s) == "" {
+		return orders, nil
+	}
+
+	p, err := newODataParser(s)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		o := odataOrder{expr: x}
+		if p.keyword("desc") {
+			o.desc = true
+		} else {
+			p.keyword("asc")
+		}
+		orders = append(orders, o)
+		if p.peek().kind == odataTokenEOF {
+			break
+		}
+		if err := p.expect(odataTokenComma, ","); err != nil {
+			return nil, err
+		}
+	}
+
+	return orders, nil
+}
+
+// InStoreOrder returns true if the query can be answered a page at a time in the store's order, a
+// $orderby or a total count needs every entry
+func (fq *feedQuery) InStoreOrder() bool {
+	return len(fq.orderBy) == 0 && !fq.inlineCount
+}
+
+// Match returns true if the entry matches the $filter and can be shown to the client
+func (fq *feedQuery) Match(e *NugetPackageEntry) (bool, error) {
+	if !fq.semVer2 && isSemVer2Version(e.Properties.Version) {
+		return false, nil
+	}
+	return fq.filter.Match(e)
+}
+
+// Filter returns the entries matching the $filter in the requested order
+func (fq *feedQuery) Filter(entries []*NugetPackageEntry) ([]*NugetPackageEntry, error) {
+
+	var f []*NugetPackageEntry
+	for _, e := range entries {
+		ok, err := fq.Match(e)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f = append(f, e)
+		}
+	}
+
+	// Evaluate order keys up front so errors can be returned
+	keys := make(map[*NugetPackageEntry][]interface{})
+	for _, e := range f {
+		for _, o := range fq.orderBy {
+			v, err := o.expr.eval(e)
+			if err != nil {
+				return nil, err
+			}
+			// Versions are ordered by precedence rather than as strings
+			if m, ok := o.expr.(*odataMember); ok && (m.name == "Version" || m.name == "NormalizedVersion") {
+				if nv, err := ParseNugetVersion(e.Properties.Version); err == nil {
+					v = nv
+				}
+			}
+			keys[e] = append(keys[e], v)
+		}
+	}
+
+	// Sort by the requested keys, otherwise entries stay in the order supplied
+	if len(fq.orderBy) > 0 {
+		sort.SliceStable(f, func(i, j int) bool {
+			for k, o := range fq.orderBy {
+				c := odataOrderCompare(keys[f[i]][k], keys[f[j]][k])
+				if c != 0 {
+					return (c < 0) != o.desc
+				}
+			}
+			return f[i].Filename() < f[j].Filename()
+		})
+	}
+
+	// Skip forward past the skip token if supplied, resuming after the entry it names if present
+	if fq.startAfter != "" {
+		i := 0
+		for j, e := range f {
+			if strings.EqualFold(packageName(e.Properties.ID, e.Properties.Version), fq.startAfter) ||
+				strings.EqualFold(e.Filename(), fq.startAfter+".nupkg") {
+				i = j + 1
+				break
+			}
+		}
+		if i == 0 {
+			for i < len(f) && f[i].Filename() <= fq.startAfter+".nupkg" {
+				i++
+			}
+		}
+		f = f[i:]
+	}
+
+	return f, nil
+}
+
+// Page returns the slice of entries selected by $skip and $top, capped at max, and if more remain
+func (fq *feedQuery) Page(entries []*NugetPackageEntry, max int) ([]*NugetPackageEntry, bool) {
+
+	// Apply skip
+	if fq.skip >= len(entries) {
+		return []*NugetPackageEntry{}, false
+	}
+	entries = entries[fq.skip:]
+
+	// Apply top
+	if fq.top >= 0 && fq.top < len(entries) {
+		entries = entries[:fq.top]
+	}
+
+	// Apply page size
+	if max > 0 && len(entries) > max {
+		return entries[:max], true
+	}
+	return entries, false
+}
+
+// NextLink returns the URL of the page following the one supplied, continuing from the last
+// entry of the page if the request used a $skiptoken
+func (fq *feedQuery) NextLink(r *url.URL, page []*NugetPackageEntry) (string, error) {
+
+	// Get a copy of the request URL
+	u, err := url.Parse(r.String())
+	if err != nil {
+		return "", err
+	}
+	u.Host = server.URL.Host
+	u.Scheme = server.URL.Scheme
+	// Get working copy of Query
+	q := u.Query()
+	// Update Values
+	n := len(page)
+	if fq.startAfter != "" && n > 0 {
+		last := page[n-1]
+		q.Set("$skiptoken", "'"+last.Properties.ID+"','"+normalizeVersion(last.Properties.Version)+"'")
+		q.Del("$skip")
+	} else {
+		q.Del("$skiptoken")
+		q.Set("$skip", strconv.Itoa(fq.skip+n))
+	}
+	if fq.top >= 0 {
+		q.Set("$top", strconv.Itoa(fq.top-n))
+	}
+	//Re-assign
+	u.RawQuery = q.Encode()
+	// Keep it encoded, filters may hold &, +, = or # which would otherwise change the query
+	return u.String(), nil
+}
+
+// odataOrderCompare compares two order keys, nulls and mismatched types sort first
+func odataOrderCompare(x interface{}, y interface{}) int {
+	switch {
+	case x == nil && y == nil:
+		return 0
+	case x == nil:
+		return -1
+	case y == nil:
+		return 1
+	}
+	// Versions are ordered by precedence
+	if xv, ok := x.(*NugetVersion); ok {
+		if yv, ok := y.(*NugetVersion); ok {
+			return xv.Compare(yv)
+		}
+	}
+	// Strings are ordered case insensitively as per the NuGet gallery
+	if xs, ok := x.(string); ok {
+		if ys, ok := y.(string); ok {
+			return strings.Compare(strings.ToLower(xs), strings.ToLower(ys))
+		}
+	}
+	c, err := odataCompare(x, y)
+	if err != nil {
+		return 0
+	}
+	return c
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testQueryEntries returns entries for the query tests, in the order the store lists them
+func testQueryEntries() []*NugetPackageEntry {
+	var entries []*NugetPackageEntry
+	for _, v := range []struct{ id, ver string }{
+		{"A", "1.0.0"}, {"A", "2.0.0"}, {"B", "1.0.0"}, {"C", "1.0.0"}, {"C", "10.0.0"},
+	} {
+		e := &NugetPackageEntry{}
+		e.Properties.ID = v.id
+		e.Properties.Version = v.ver
+		e.Properties.VersionNorm = v.ver
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// testPageNames returns the file names of a page of entries
+func testPageNames(page []*NugetPackageEntry) []string {
+	names := []string{}
+	for _, e := range page {
+		names = append(names, e.Filename())
+	}
+	return names
+}
+
+func TestFeedQueryNextLink(t *testing.T) {
+	server = &Server{URL: &url.URL{Scheme: "https", Host: "nuget.example.com", Path: "/feed/"}}
+
+	tests := []struct {
+		query string
+		max   int
+		page  []string
+		next  string
+	}{
+		{"", 2, []string{"A.1.0.0.nupkg", "A.2.0.0.nupkg"}, "$skip=2"},
+		{"$skip=2", 2, []string{"B.1.0.0.nupkg", "C.1.0.0.nupkg"}, "$skip=4"},
+		{"$skip=1&$top=3", 2, []string{"A.2.0.0.nupkg", "B.1.0.0.nupkg"}, "$skip=3&$top=1"},
+		{"$skiptoken='A','1.0.0'", 2, []string{"A.2.0.0.nupkg", "B.1.0.0.nupkg"}, "$skiptoken='B','1.0.0'"},
+		{"$skiptoken='A','2.0.0'&$top=3", 2, []string{"B.1.0.0.nupkg", "C.1.0.0.nupkg"}, "$skiptoken='C','1.0.0'&$top=1"},
+		// Ordered by version, C 10.0.0 is after C 1.0.0 rather than in name order
+		{"$orderby=Version desc&$skiptoken='A','2.0.0'", 2, []string{"A.1.0.0.nupkg", "B.1.0.0.nupkg"}, "$orderby=Version desc&$skiptoken='B','1.0.0'"},
+		// Filter values holding query characters are kept encoded
+		{"$filter=Id ne 'x%26y%2B1%3D2%23''z'", 2, []string{"A.1.0.0.nupkg", "A.2.0.0.nupkg"}, "$filter=Id+ne+'x%26y%2B1%3D2%23''z'&$skip=2"},
+		{"$skiptoken='A','1.0.0'", 10, []string{"A.2.0.0.nupkg", "B.1.0.0.nupkg", "C.1.0.0.nupkg", "C.10.0.0.nupkg"}, ""},
+	}
+	for _, tt := range tests {
+		r, _ := url.Parse("http://localhost/feed/Packages()?" + tt.query)
+		fq, err := newFeedQuery(r.Query())
+		if err != nil {
+			t.Errorf("newFeedQuery(%q) error: %v", tt.query, err)
+			continue
+		}
+		entries, err := fq.Filter(testQueryEntries())
+		if err != nil {
+			t.Errorf("Filter(%q) error: %v", tt.query, err)
+			continue
+		}
+		page, more := fq.Page(entries, tt.max)
+		if got := testPageNames(page); strings.Join(got, " ") != strings.Join(tt.page, " ") {
+			t.Errorf("Page(%q) = %v, want %v", tt.query, got, tt.page)
+		}
+		if more != (tt.next != "") {
+			t.Errorf("Page(%q) more = %v, want %v", tt.query, more, tt.next != "")
+			continue
+		}
+		if !more {
+			continue
+		}
+		next, err := fq.NextLink(r, page)
+		if err != nil {
+			t.Errorf("NextLink(%q) error: %v", tt.query, err)
+			continue
+		}
+		want, _ := url.ParseQuery(tt.next)
+		u, _ := url.Parse(next)
+		got := u.Query()
+		if u.Host != "nuget.example.com" || len(got) != len(want) {
+			t.Errorf("NextLink(%q) = %s, want %s", tt.query, next, tt.next)
+			continue
+		}
+		for k := range want {
+			if got.Get(k) != want.Get(k) {
+				t.Errorf("NextLink(%q) = %s, want %s", tt.query, next, tt.next)
+			}
+		}
+	}
+}
+
+// testCountingStore counts the listings read from a store
+type testCountingStore struct {
+	*fileStoreLocal
+	reads int
+}
+
+func (fs *testCountingStore) GetPackageFeedEntries(id string, startAfter string, max int) ([]*NugetPackageEntry, bool, error) {
+	fs.reads++
+	return fs.fileStoreLocal.GetPackageFeedEntries(id, startAfter, max)
+}
+
+func TestReadFeedPage(t *testing.T) {
+
+	// A store of 250 packages, every tenth unlisted
+	local := &fileStoreLocal{}
+	for i := 0; i < 250; i++ {
+		e := &NugetPackageEntry{}
+		e.Properties.ID = fmt.Sprintf("Pkg%03d", i)
+		e.Properties.IDLowerCase = strings.ToLower(e.Properties.ID)
+		e.Properties.Version = "1.0"
+		e.SetListed(i%10 != 0)
+		local.packages = append(local.packages, e)
+	}
+	fs := &testCountingStore{fileStoreLocal: local}
+	server = &Server{fs: fs}
+	listed := func(e *NugetPackageEntry) bool { return e.IsListed() }
+
+	tests := []struct {
+		query string
+		first string
+		n     int
+		more  bool
+		reads int
+	}{
+		{"", "Pkg001", feedPageSize, true, 2},
+		{"$top=5", "Pkg001", 5, false, 1},
+		{"$skip=100&$top=5", "Pkg112", 5, false, 2},
+		{"$skiptoken='Pkg100','1.0.0'", "Pkg101", feedPageSize, true, 2},
+		{"$skiptoken='Pkg200','1.0'", "Pkg201", 45, false, 1},
+		{"$filter=Id eq 'Pkg249'", "Pkg249", 1, false, 3},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		fq, err := newFeedQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.reads = 0
+		entries, err := readFeedPage(fq, listed)
+		if err != nil {
+			t.Errorf("readFeedPage(%q) error: %v", tt.query, err)
+			continue
+		}
+		page, more := fq.Page(entries, feedPageSize)
+		if len(page) != tt.n || page[0].Properties.ID != tt.first || more != tt.more || fs.reads != tt.reads {
+			t.Errorf("readFeedPage(%q) gave a page of %d from %s, more %v, in %d reads, want %d from %s, more %v, in %d",
+				tt.query, len(page), page[0].Properties.ID, more, fs.reads, tt.n, tt.first, tt.more, tt.reads)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // Hashes used by RS256, ES256 etc.
+	_ "crypto/sha512" // Hashes used by RS384, RS512, ES384 and ES512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcIssuer is an OpenID Connect issuer whose tokens are accepted as bearer tokens
+type oidcIssuer struct {
+	Issuer   string     `json:"issuer"`    // Must match the iss claim
+	Audience string     `json:"audience"`  // Must be in the aud claim, exactly
+	JWKSURL  string     `json:"jwks-url"`  // Signing keys, found through the issuer's discovery document if neither is set
+	JWKSFile string     `json:"jwks-file"` // Signing keys read from a file, for offline use
+	Rules    []oidcRule `json:"rules"`     // Access given by the first rule matching the token's claims
+}
+
+// oidcRule maps the claims of a token onto access
+type oidcRule struct {
+	Claims   map[string]string `json:"claims"`   // Glob patterns every named claim must match
+	Scopes   []string          `json:"scopes"`   // Any of read, push, push-new-id, unlist and admin
+	Packages []string          `json:"packages"` // Glob patterns of the package IDs the token can act on, empty for all
+	Owner    string            `json:"owner"`
+}
+
+// TokenError represents an invalid bearer token or issuer
+type TokenError struct {
+	ErrorString string
+}
+
+func (te *TokenError) Error() string {
+	return te.ErrorString
+}
+
+// Signing keys are refetched after jwksMaxAge, or after jwksMinAge when a token uses a key not yet seen
+const (
+	jwksMaxAge = time.Hour
+	jwksMinAge = time.Minute
+)
+
+// tokenLeeway allows for clock differences when checking exp and nbf
+const tokenLeeway = time.Minute
+
+// tokenVerifier checks bearer tokens against the configured issuers
+type tokenVerifier struct {
+	issuers map[string]*issuerKeys // Keyed by issuer
+	client  *http.Client
+}
+
+// issuerKeys holds an issuer and its current signing keys
+type issuerKeys struct {
+	*oidcIssuer
+	keys    map[string]crypto.PublicKey // Keyed by kid
+	fetched time.Time
+	mutex   sync.Mutex
+}
+
+// jwk is a single key of a JSON Web Key Set, only RSA and EC keys are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwtHeader is the header of a JSON Web Token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// newTokenVerifier checks the issuers, loading the keys of any read from a file
+func newTokenVerifier(issuers []oidcIssuer) (*tokenVerifier, error) {
+	tv := &tokenVerifier{issuers: make(map[string]*issuerKeys), client: &http.Client{Timeout: 10 * time.Second}}
+	for i := range issuers {
+		iss := &issuers[i]
+		if iss.Issuer == "" {
+			return nil, &TokenError{"OIDC issuer has no issuer set"}
+		}
+		// Issuers such as GitHub mint tokens for anyone, the audience keeps out tokens minted for other services
+		if iss.Audience == "" {
+			return nil, &TokenError{"OIDC issuer " + iss.Issuer + " has no audience set"}
+		}
+		for _, r := range iss.Rules {
+			if err := validateScopes(r.Scopes, r.Packages); err != nil {
+				return nil, &TokenError{"OIDC issuer " + iss.Issuer + ": " + err.Error()}
+			}
+			for _, p := range r.Claims {
+				if _, err := path.Match(p, ""); err != nil {
+					return nil, &TokenError{"OIDC issuer " + iss.Issuer + ": Invalid claim pattern: " + p}
+				}
+			}
+		}
+		ik := &issuerKeys{oidcIssuer: iss}
+		if iss.JWKSFile != "" {
+			f, err := os.Open(iss.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			ik.keys, err = readJWKS(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+		tv.issuers[strings.TrimSuffix(iss.Issuer, "/")] = ik
+	}
+	return tv, nil
+}
+
+// GetAccessLevel returns the access given by a token, or nil if it is not valid
+func (tv *tokenVerifier) GetAccessLevel(token string) *access {
+
+	// Check the token
+	claims, err := tv.verify(token)
+	if err != nil {
+		log.Println("Rejected bearer token:", err)
+		return nil
+	}
+
+	// Find the first rule matching the claims
+	ik := tv.issuers[strings.TrimSuffix(fmt.Sprint(claims["iss"]), "/")]
+	for _, r := range ik.Rules {
+		if !claimsMatch(claims, r.Claims) {
+			continue
+		}
+		// Any valid token can read, the subject identifies who used it
+		a := &access{Actor: fmt.Sprint(claims["sub"]), Packages: r.Packages, Owner: r.Owner}
+		a.Scopes = append(append(a.Scopes, r.Scopes...), scopeRead)
+		return a
+	}
+
+	log.Println("Rejected bearer token:", "No rule matches the claims of", claims["sub"])
+	return nil
+}
+
+// verify checks the signature, issuer, audience and lifetime of a token and returns its claims
+func (tv *tokenVerifier) verify(token string) (map[string]interface{}, error) {
+
+	// Split the token into header, claims and signature
+	x := strings.Split(token, ".")
+	if len(x) != 3 {
+		return nil, &TokenError{"Malformed token"}
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(x[0], &header); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(x[1], &claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(x[2])
+	if err != nil {
+		return nil, &TokenError{"Malformed token signature"}
+	}
+
+	// Find the issuer
+	iss, _ := claims["iss"].(string)
+	ik, ok := tv.issuers[strings.TrimSuffix(iss, "/")]
+	if !ok {
+		return nil, &TokenError{"Unknown issuer " + iss}
+	}
+
+	// Check the signature
+	key, err := tv.signingKey(ik, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, x[0]+"."+x[1], sig); err != nil {
+		return nil, err
+	}
+
+	// Check the audience
+	if !claimEquals(claims["aud"], ik.Audience) {
+		return nil, &TokenError{"Token audience does not match"}
+	}
+
+	// Check the token is in date, exp is required
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-tokenLeeway).After(time.Unix(int64(exp), 0)) {
+		return nil, &TokenError{"Token has expired"}
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(tokenLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, &TokenError{"Token is not valid yet"}
+	}
+
+	return claims, nil
+}
+
+// signingKey returns an issuer's key with a kid, fetching the keys if they are stale or the kid is new
+func (tv *tokenVerifier) signingKey(ik *issuerKeys, kid string) (crypto.PublicKey, error) {
+
+	ik.mutex.Lock()
+	defer ik.mutex.Unlock()
+
+	// Keys read from a file are never refreshed
+	if ik.JWKSFile == "" {
+		age := time.Since(ik.fetched)
+		_, known := ik.keys[kid]
+		if age > jwksMaxAge || (!known && age > jwksMinAge) {
+			keys, err := tv.fetchJWKS(ik.oidcIssuer)
+			if err != nil {
+				// Carry on with the keys we have, if any
+				log.Println("Error fetching OIDC keys for", ik.Issuer, err)
+			} else {
+				ik.keys = keys
+			}
+			ik.fetched = time.Now()
+		}
+	}
+
+	// Tokens without a kid can be used when the issuer has a single key
+	if kid == "" && len(ik.keys) == 1 {
+		for _, k := range ik.keys {
+			return k, nil
+		}
+	}
+	if k, ok := ik.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, &TokenError{"Unknown signing key " + kid}
+}
+
+// fetchJWKS gets an issuer's signing keys, from its discovery document if no URL is set
+func (tv *tokenVerifier) fetchJWKS(iss *oidcIssuer) (map[string]crypto.PublicKey, error) {
+
+	u := iss.JWKSURL
+	if u == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := tv.getJSON(strings.TrimSuffix(iss.Issuer, "/")+"/.well-known/openid-configuration", func(r io.Reader) error {
+			return json.NewDecoder(r).Decode(&discovery)
+		}); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, &TokenError{"No jwks_uri in discovery document"}
+		}
+		u = discovery.JWKSURI
+	}
+
+	var keys map[string]crypto.PublicKey
+	err := tv.getJSON(u, func(r io.Reader) error {
+		var err error
+		keys, err = readJWKS(r)
+		return err
+	})
+	return keys, err
+}
+
+// getJSON requests a url and passes a successful response to read
+func (tv *tokenVerifier) getJSON(u string, read func(io.Reader) error) error {
+	resp, err := tv.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &TokenError{"Unexpected status " + resp.Status + " from " + u}
+	}
+	return read(io.LimitReader(resp.Body, 1<<20))
+}
+
+// readJWKS reads the RSA and EC signing keys from a JSON Web Key Set, keyed by kid
+func readJWKS(r io.Reader) (map[string]crypto.PublicKey, error) {
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, &TokenError{"Invalid RSA key " + k.Kid}
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return nil, &TokenError{"Invalid RSA key " + k.Kid}
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, &TokenError{"Unsupported EC curve " + k.Crv}
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, &TokenError{"Invalid EC key " + k.Kid}
+			}
+			pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, &TokenError{"Invalid EC key " + k.Kid}
+			}
+			keys[k.Kid] = pub
+		}
+	}
+	return keys, nil
+}
+
+// decodeJWTPart decodes the base64url JSON header or claims of a token
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return &TokenError{"Malformed token"}
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return &TokenError{"Malformed token"}
+	}
+	return nil
+}
+
+// verifyJWTSignature checks the signature of a token with the RS and ES algorithms, others are refused
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+
+	// Hash the header and claims
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		h = crypto.SHA256
+	case "RS384", "ES384":
+		h = crypto.SHA384
+	case "RS512", "ES512":
+		h = crypto.SHA512
+	default:
+		return &TokenError{"Unsupported token algorithm " + alg}
+	}
+	hasher := h.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	// Check the signature matches the kind of key
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, h, digest, sig) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		// ES signatures are r and s concatenated, each the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(sig) == 2*size &&
+			ecdsa.Verify(k, digest, new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])) {
+			return nil
+		}
+	}
+	return &TokenError{"Invalid token signature"}
+}
+
+// claimsMatch returns true if every claim matches its glob pattern
+func claimsMatch(claims map[string]interface{}, patterns map[string]string) bool {
+	for name, p := range patterns {
+		if !claimContains(claims[name], p) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimEquals returns true if a claim, or any value of an array claim, is exactly value
+func claimEquals(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimContains returns true if a claim, or any value of an array claim, matches a glob pattern
+func claimContains(claim interface{}, pattern string) bool {
+	switch c := claim.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		for _, v := range c {
+			if claimContains(v, pattern) {
+				return true
+			}
+		}
+		return false
+	default:
+		ok, _ := path.Match(pattern, fmt.Sprint(c))
+		return ok
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keys used to sign test tokens, generated once as RSA keys are slow to make
+var (
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testECKey, _    = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testOtherKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+)
+
+// testJWKS returns a key set holding the public halves of the test RSA and EC keys
+func testJWKS() []byte {
+	enc := base64.RawURLEncoding.EncodeToString
+	pad := func(n *big.Int) string {
+		return enc(testPad(n, 32))
+	}
+	b, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "use": "sig", "n": enc(testRSAKey.N.Bytes()), "e": enc(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": pad(testECKey.X), "y": pad(testECKey.Y)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": enc(testOtherKey.N.Bytes()), "e": "AQAB"},
+	}})
+	return b
+}
+
+// testToken signs a token with the given header and claims, using RS or ES as the key requires
+func testToken(alg string, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	h, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	c, _ := json.Marshal(claims)
+	signed := enc(h) + "." + enc(c)
+
+	hasher := crypto.SHA256.New()
+	hasher.Write([]byte(signed))
+	digest := hasher.Sum(nil)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest)
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest)
+		sig = append(testPad(r, 32), testPad(s, 32)...)
+	}
+	return signed + "." + enc(sig)
+}
+
+// testPad returns a number as big endian bytes left padded with zeros to size
+func testPad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// testClaims returns valid claims for the test issuer, with changes applied
+func testClaims(iss string, changes map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss": iss,
+		"aud": "nuget",
+		"sub": "repo:acme/lib:ref:refs/heads/main",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"nbf": time.Now().Add(-time.Minute).Unix(),
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func TestTokenVerifier(t *testing.T) {
+
+	// Serve the discovery document and keys as an issuer would
+	mux := http.NewServeMux()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jwks_uri":"` + ts.URL + `/keys"}`))
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testJWKS())
+	})
+	iss := ts.URL
+
+	tv, err := newTokenVerifier([]oidcIssuer{{
+		Issuer:   iss,
+		Audience: "nuget",
+		Rules: []oidcRule{
+			{Claims: map[string]string{"sub": "repo:acme/*:ref:refs/heads/main"}, Scopes: []string{scopePush}, Packages: []string{"Acme.*"}, Owner: "acme"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hour := time.Hour
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"rs256", testToken("RS256", "rsa", testRSAKey, testClaims(iss, nil)), true},
+		{"es256", testToken("ES256", "ec", testECKey, testClaims(iss, nil)), true},
+		{"audience in list", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"aud": []string{"other", "nuget"}})), true},
+		{"issuer with slash", testToken("RS256", "rsa", testRSAKey, testClaims(iss+"/", nil)), true},
+		{"within leeway", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"exp": time.Now().Add(-30 * time.Second).Unix()})), true},
+
+		{"expired", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"exp": time.Now().Add(-hour).Unix()})), false},
+		{"no expiry", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"exp": nil})), false},
+		{"not yet valid", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"nbf": time.Now().Add(hour).Unix()})), false},
+		{"wrong issuer", testToken("RS256", "rsa", testRSAKey, testClaims("https://evil.example.com", nil)), false},
+		{"no issuer", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"iss": nil})), false},
+		{"wrong audience", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"aud": "other"})), false},
+		{"no audience", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"aud": nil})), false},
+		{"audience in other case", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"aud": "NuGet"})), false},
+		{"audience pattern", testToken("RS256", "rsa", testRSAKey, testClaims(iss, map[string]interface{}{"aud": "nug*"})), false},
+		{"rs alg with ec key", testToken("RS256", "ec", testRSAKey, testClaims(iss, nil)), false},
+		{"es alg with rsa key", testToken("ES256", "rsa", testECKey, testClaims(iss, nil)), false},
+		{"kid of another key", testToken("RS256", "rsa", testOtherKey, testClaims(iss, nil)), false},
+		{"encryption key", testToken("RS256", "enc", testOtherKey, testClaims(iss, nil)), false},
+		{"unknown kid", testToken("RS256", "nope", testRSAKey, testClaims(iss, nil)), false},
+		{"no kid with several keys", testToken("RS256", "", testRSAKey, testClaims(iss, nil)), false},
+		{"hs256", testToken("HS256", "rsa", testRSAKey, testClaims(iss, nil)), false},
+		{"none", testToken("none", "rsa", testRSAKey, testClaims(iss, nil)), false},
+		{"no signature", strings.Join(strings.Split(testToken("RS256", "rsa", testRSAKey, testClaims(iss, nil)), ".")[:2], ".") + ".", false},
+		{"malformed", "not.a-token", false},
+	}
+	for _, tt := range tests {
+		_, err := tv.verify(tt.token)
+		if tt.ok && err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	// Claims are matched against the rules
+	a := tv.GetAccessLevel(testToken("ES256", "ec", testECKey, testClaims(iss, nil)))
+	if a == nil || a.Owner != "acme" || !a.CanPackage(scopePush, "Acme.Lib") || a.CanPackage(scopePush, "Other.Lib") || a.Actor != "repo:acme/lib:ref:refs/heads/main" {
+		t.Errorf("GetAccessLevel gave %+v", a)
+	}
+	if a := tv.GetAccessLevel(testToken("ES256", "ec", testECKey, testClaims(iss, map[string]interface{}{"sub": "repo:acme/lib:ref:refs/heads/dev"}))); a != nil {
+		t.Errorf("GetAccessLevel of unmatched claims gave %+v", a)
+	}
+}
+
+func TestTokenVerifierSingleKeyFile(t *testing.T) {
+
+	// A key set holding only the EC key, tokens without a kid can use it
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	json.Unmarshal(testJWKS(), &set)
+	b, _ := json.Marshal(map[string]interface{}{"keys": set.Keys[1:2]})
+	dir, err := ioutil.TempDir("", "oidc-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(fn, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	iss := "https://token.example.com"
+	tv, err := newTokenVerifier([]oidcIssuer{{Issuer: iss, Audience: "nuget", JWKSFile: fn}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tv.verify(testToken("ES256", "", testECKey, testClaims(iss, nil))); err != nil {
+		t.Errorf("no kid: error: %v", err)
+	}
+	if _, err := tv.verify(testToken("RS256", "", testRSAKey, testClaims(iss, nil))); err == nil {
+		t.Errorf("rsa token with ec key file: expected an error")
+	}
+}
+
+func TestTokenVerifierConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		iss  oidcIssuer
+		ok   bool
+	}{
+		{"valid", oidcIssuer{Issuer: "https://token.example.com", Audience: "nuget"}, true},
+		{"no issuer", oidcIssuer{Audience: "nuget"}, false},
+		{"no audience", oidcIssuer{Issuer: "https://token.example.com"}, false},
+		{"bad scope", oidcIssuer{Issuer: "https://token.example.com", Audience: "nuget", Rules: []oidcRule{{Scopes: []string{"root"}}}}, false},
+		{"bad claim pattern", oidcIssuer{Issuer: "https://token.example.com", Audience: "nuget", Rules: []oidcRule{{Claims: map[string]string{"sub": "["}}}}, false},
+	}
+	for _, tt := range tests {
+		if _, err := newTokenVerifier([]oidcIssuer{tt.iss}); (err == nil) != tt.ok {
+			t.Errorf("%s: newTokenVerifier gave %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+)
+
+// ErrNotOwner is returned when pushing to a package ID owned by, or reserved for, another owner
+var ErrNotOwner = &FileStoreError{"Package ID Belongs To Another Owner"}
+
+// reservedPrefixOwner returns the owner of the longest reserved prefix an ID starts with
+func reservedPrefixOwner(prefixes map[string]string, id string) (string, bool) {
+	owner, found, length := "", false, 0
+	for p, o := range prefixes {
+		if strings.HasPrefix(strings.ToLower(id), p) && len(p) > length {
+			owner, found, length = o, true, len(p)
+		}
+	}
+	return owner, found
+}
+
+// checkPackageOwner returns the owner to record for an ID being pushed by owner, or ErrNotOwner if it
+// belongs to someone else, current is the recorded owner of the ID (empty if it has none)
+func checkPackageOwner(current string, prefixes map[string]string, id string, owner string) (string, error) {
+
+	// IDs with an owner can only be pushed to by that owner
+	if current != "" {
+		if !strings.EqualFold(current, owner) {
+			return "", ErrNotOwner
+		}
+		return current, nil
+	}
+
+	// New owners must match any reserved prefix
+	if po, ok := reservedPrefixOwner(prefixes, id); ok && !strings.EqualFold(po, owner) {
+		return "", ErrNotOwner
+	}
+	return owner, nil
+}
+
+// isVerifiedPackage returns true if an ID is under a reserved prefix and owned by the prefix owner
+func isVerifiedPackage(owners map[string]string, prefixes map[string]string, id string) bool {
+	po, ok := reservedPrefixOwner(prefixes, id)
+	return ok && po != "" && strings.EqualFold(po, owners[strings.ToLower(id)])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckPackageOwner(t *testing.T) {
+	prefixes := map[string]string{"team.": "team", "team.shared.": "shared", "open.": ""}
+	tests := []struct {
+		current string
+		id      string
+		owner   string
+		want    string
+		err     error
+	}{
+		{"", "New.Pkg", "me", "me", nil},
+		{"", "New.Pkg", "", "", nil},
+		{"me", "My.Pkg", "me", "me", nil},
+		{"me", "My.Pkg", "ME", "me", nil},
+		{"me", "My.Pkg", "other", "", ErrNotOwner},
+		{"me", "My.Pkg", "", "", ErrNotOwner},
+		{"", "Team.Pkg", "team", "team", nil},
+		{"", "TEAM.Pkg", "other", "", ErrNotOwner},
+		{"", "Team.Shared.Pkg", "shared", "shared", nil},
+		{"", "Team.Shared.Pkg", "team", "", ErrNotOwner},
+		{"", "Open.Pkg", "", "", nil},
+		{"", "Open.Pkg", "me", "", ErrNotOwner},
+		{"team", "Team.Pkg", "team", "team", nil},
+	}
+	for _, tt := range tests {
+		owner, err := checkPackageOwner(tt.current, prefixes, tt.id, tt.owner)
+		if owner != tt.want || err != tt.err {
+			t.Errorf("checkPackageOwner(%q, %q, %q) gave %q, %v, want %q, %v", tt.current, tt.id, tt.owner, owner, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestIsVerifiedPackage(t *testing.T) {
+	prefixes := map[string]string{"team.": "team", "open.": ""}
+	owners := map[string]string{"team.pkg": "team", "team.other": "other", "open.pkg": ""}
+	tests := []struct {
+		id       string
+		verified bool
+	}{
+		{"Team.Pkg", true},
+		{"Team.Other", false},
+		{"Team.New", false},
+		{"Open.Pkg", false},
+		{"Some.Pkg", false},
+	}
+	for _, tt := range tests {
+		if v := isVerifiedPackage(owners, prefixes, tt.id); v != tt.verified {
+			t.Errorf("isVerifiedPackage(%q) gave %v", tt.id, v)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// searchTerm is a single term from a search query, optionally restricted to a field
+type searchTerm struct {
+	field string
+	value string
+}
+
+// searchQuery represents a parsed free text search
+type searchQuery struct {
+	terms []searchTerm
+}
+
+// newSearchQuery parses a search string such as `logging id:Foo tags:"a b"` into terms
+func newSearchQuery(q string) *searchQuery {
+
+	sq := searchQuery{}
+
+	for q = strings.TrimSpace(q); q != ""; q = strings.TrimSpace(q) {
+		t := searchTerm{}
+		// Check for a field prefix
+		if i := strings.IndexAny(q, `: "`); i > 0 && q[i] == ':' {
+			t.field = strings.ToLower(q[:i])
+			q = q[i+1:]
+		}
+		// Read a quoted or space delimited value
+		if strings.HasPrefix(q, `"`) {
+			q = q[1:]
+			i := strings.Index(q, `"`)
+			if i < 0 {
+				i = len(q)
+			}
+			t.value = q[:i]
+			q = q[i:]
+			q = strings.TrimPrefix(q, `"`)
+		} else {
+			i := strings.Index(q, " ")
+			if i < 0 {
+				i = len(q)
+			}
+			t.value = q[:i]
+			q = q[i:]
+		}
+		t.value = strings.ToLower(strings.TrimSpace(t.value))
+		if t.value != "" {
+			sq.terms = append(sq.terms, t)
+		}
+	}
+
+	return &sq
+}
+
+// Score returns how well the entry matches the query, zero means no match
+func (sq *searchQuery) Score(npe *NugetPackageEntry) int {
+
+	// An empty query matches everything
+	score := 1
+
+	for _, t := range sq.terms {
+		s := 0
+		id := strings.ToLower(npe.Properties.ID)
+		// Weight matches on more significant fields higher
+		if t.field == "" || t.field == "id" || t.field == "packageid" {
+			switch {
+			case id == t.value:
+				s += 100
+			case t.field == "packageid":
+			case strings.HasPrefix(id, t.value):
+				s += 20
+			case strings.Contains(id, t.value):
+				s += 10
+			}
+		}
+		if (t.field == "" || t.field == "title") && strings.Contains(strings.ToLower(npe.Properties.Title), t.value) {
+			s += 5
+		}
+		if t.field == "" || t.field == "tags" || t.field == "tag" {
+			for _, tag := range strings.Fields(strings.ReplaceAll(strings.ToLower(npe.Properties.Tags), ",", " ")) {
+				if tag == t.value {
+					s += 3
+				}
+			}
+		}
+		if (t.field == "" || t.field == "author" || t.field == "authors") && strings.Contains(strings.ToLower(npe.Author.Name), t.value) {
+			s += 2
+		}
+		if (t.field == "" || t.field == "description") && strings.Contains(strings.ToLower(npe.Properties.Description), t.value) {
+			s++
+		}
+		if (t.field == "" || t.field == "summary") && strings.Contains(strings.ToLower(npe.Summary.Text), t.value) {
+			s++
+		}
+		// Every term must match
+		if s == 0 {
+			return 0
+		}
+		score += s
+	}
+
+	return score
+}
+
+// searchResult is the set of versions of a single ID that matched a search
+type searchResult struct {
+	Score    int
+	Latest   *NugetPackageEntry
+	Versions []*NugetPackageEntry
+}
+
+// searchPackages returns matching IDs, best match first, with versions in ascending order
+func searchPackages(q string, prerelease bool, semVer2 bool) ([]*searchResult, error) {
+
+	// Get every entry in the store
+	entries, _, err := server.fs.GetPackageFeedEntries("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the versions by ID
+	var results []*searchResult
+	index := make(map[string]*searchResult)
+	for _, e := range entries {
+		if !e.IsListed() {
+			continue
+		}
+		if !prerelease && isPrereleaseVersion(e.Properties.Version) {
+			continue
+		}
+		if !semVer2 && isSemVer2Version(e.Properties.Version) {
+			continue
+		}
+		sr, ok := index[e.Properties.IDLowerCase]
+		if !ok {
+			sr = &searchResult{}
+			index[e.Properties.IDLowerCase] = sr
+			results = append(results, sr)
+		}
+		sr.Versions = append(sr.Versions, e)
+	}
+
+	// Score each ID on its latest version
+	sq := newSearchQuery(q)
+	matched := results[:0]
+	for _, sr := range results {
+		sort.Slice(sr.Versions, func(i, j int) bool {
+			return compareVersions(sr.Versions[i].Properties.Version, sr.Versions[j].Properties.Version) < 0
+		})
+		sr.Latest = sr.Versions[len(sr.Versions)-1]
+		if sr.Score = sq.Score(sr.Latest); sr.Score > 0 {
+			matched = append(matched, sr)
+		}
+	}
+
+	// Order by score, then downloads, then ID
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Latest.Properties.DownloadCount.Value != b.Latest.Properties.DownloadCount.Value {
+			return a.Latest.Properties.DownloadCount.Value > b.Latest.Properties.DownloadCount.Value
+		}
+		return a.Latest.Properties.IDLowerCase < b.Latest.Properties.IDLowerCase
+	})
+
+	return matched, nil
+}
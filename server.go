@@ -10,8 +10,25 @@ import (
 
 // Config represents the config file
 type Config struct {
-	Loglevel  int    `json:"log-level"`
-	HostURL   string `json:"host-url"`
+	Loglevel   int    `json:"log-level"`
+	HostURL    string `json:"host-url"`
+	DeleteMode string `json:"delete-mode"` // DeleteMode can be 'unlist'|'delete' (Defaults to 'unlist')
+	// Largest package accepted on push in megabytes (Defaults to 250)
+	MaxPackageSizeMB int64 `json:"max-package-size-mb"`
+	// Package values not set by the nuspec
+	ReportAbuseURL  string `json:"report-abuse-url"`
+	DefaultLanguage string `json:"default-language"` // Defaults to 'en-US'
+	// OpenID Connect issuers whose tokens are accepted as bearer tokens
+	OIDC struct {
+		Issuers []oidcIssuer `json:"issuers"`
+	} `json:"oidc"`
+	// Upstream feed that packages missing from the store are fetched from and cached
+	Upstream struct {
+		URL        string   `json:"url"`                  // Root of a V2 feed, or a V3 service index ending in .json
+		Allow      []string `json:"allow"`                // Glob patterns of the IDs fetched, empty for all
+		Deny       []string `json:"deny"`                 // Glob patterns of the IDs never fetched
+		TTLMinutes int      `json:"metadata-ttl-minutes"` // How long upstream version lists are kept (Defaults to 30)
+	} `json:"upstream"`
 	FileStore struct {
 		// Type can be 'gcp'|'local'
 		Type string `json:"type"`
@@ -20,10 +37,11 @@ type Config struct {
 		// Options for 'gcp'
 		BucketName string `json:"storage-bucket"`
 		ProjectID  string `json:"project-id"`
-		// Hard coded API keys
+		// Hard coded API keys, read-only and read-write hold plaintext keys and are replaced by keys
 		APIKeys struct {
 			ReadOnly  []string `json:"read-only"`
 			ReadWrite []string `json:"read-write"`
+			Keys      []apiKey `json:"keys"`
 		} `json:"api-keys"`
 	} `json:"filestore"`
 }
@@ -34,6 +52,9 @@ type Server struct {
 	URL              *url.URL
 	MetaDataResponse []byte
 	fs               fileStore
+	ks               keyStore
+	as               auditStore
+	tv               *tokenVerifier // nil when no OIDC issuers are configured
 }
 
 // InitServer returns a structure with all core config data
@@ -65,27 +86,74 @@ func InitServer(cf string) *Server {
 	u, err := url.Parse(s.config.HostURL)
 	s.URL = u
 
+	// Set the default language
+	if s.config.DefaultLanguage == "" {
+		s.config.DefaultLanguage = "en-US"
+	}
+
+	// Set the default maximum package size
+	if s.config.MaxPackageSizeMB <= 0 {
+		s.config.MaxPackageSizeMB = 250
+	}
+
+	// Set the default upstream metadata lifetime
+	if s.config.Upstream.TTLMinutes <= 0 {
+		s.config.Upstream.TTLMinutes = 30
+	}
+
+	// Check the delete mode
+	switch s.config.DeleteMode {
+	case "":
+		s.config.DeleteMode = "unlist"
+	case "unlist", "delete":
+	default:
+		log.Fatal(`Invalid delete-mode "` + s.config.DeleteMode + `", must be "unlist" or "delete"`)
+	}
+
 	// Init the fileStore
 	switch s.config.FileStore.Type {
 	case "gcp":
-		s.fs = &fileStoreGCP{}
+		fs := &fileStoreGCP{}
+		s.fs, s.ks, s.as = fs, &keyStoreGCP{fs: fs}, &auditStoreGCP{fs: fs}
 	case "local":
-		s.fs = &fileStoreLocal{}
+		fs := &fileStoreLocal{}
+		s.fs, s.ks, s.as = fs, &keyStoreLocal{fs: fs}, &auditStoreLocal{fs: fs}
+	}
+	// Proxy an upstream feed through the store if configured
+	if s.config.Upstream.URL != "" {
+		s.fs = &fileStoreProxy{fileStore: s.fs}
 	}
 	if err := s.fs.Init(s); err != nil {
 		log.Fatal("Error starting FileStore:", err)
 	}
 
+	// Init the keyStore (shares the fileStore's connection or directory)
+	if err := s.ks.Init(s); err != nil {
+		log.Fatal("Error starting KeyStore:", err)
+	}
+
+	// Init the auditStore (also shares the fileStore's connection or directory)
+	if err := s.as.Init(s); err != nil {
+		log.Fatal("Error starting AuditStore:", err)
+	}
+
+	// Load the OIDC issuers
+	if len(s.config.OIDC.Issuers) > 0 {
+		if s.tv, err = newTokenVerifier(s.config.OIDC.Issuers); err != nil {
+			log.Fatal("Error loading OIDC issuers:", err)
+		}
+	}
+
 	// Todo Warn if API Keys not present
-	a, err := s.fs.GetAccessLevel("")
+	a, err := s.ks.GetAccessLevel("")
 	if err != nil {
 		log.Fatal("Error getting AccessLevel", err)
 	}
-	if a == accessReadWrite {
+	if a.Can(scopePush) {
 		log.Println("WARNING: No API Keys defined, server running in development mode")
 		log.Println("WARNING: Anyone can read or write to the server")
-	} else if a == accessReadOnly {
-		log.Println("WARNING: No read-only API Keys defined")
+	} else if a.Can(scopeRead) {
+		log.Println("WARNING: No API Keys with the read scope defined")
 		log.Println("WARNING: Anyone can read from the server")
 	}
 
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Number of versions held in each registration page
+const registrationPageSize = 64
+
+// Largest number of versions that will be inlined in a registration index
+const registrationInlineMax = 128
+
+// NugetServiceResource is a single resource listed in a NugetServiceIndex
+type NugetServiceResource struct {
+	ID      string `json:"@id"`
+	Type    string `json:"@type"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// NugetServiceIndex returned from a V3 index request (/index.json)
+type NugetServiceIndex struct {
+	Version   string                  `json:"version"`
+	Resources []*NugetServiceResource `json:"resources"`
+}
+
+// NewNugetServiceIndex returns a populated service index for a V3 index request (/index.json)
+func NewNugetServiceIndex(baseURL string) *NugetServiceIndex {
+
+	si := NugetServiceIndex{}
+	// Set Default Values
+	si.Version = "3.0.0"
+	si.addResource(baseURL+"v3-flatcontainer/", "Base URL of where NuGet packages are stored", "PackageBaseAddress/3.0.0")
+	si.addResource(baseURL+"v3/registration/", "Base URL of package metadata", "RegistrationsBaseUrl", "RegistrationsBaseUrl/3.0.0-beta", "RegistrationsBaseUrl/3.0.0-rc", "RegistrationsBaseUrl/3.4.0", "RegistrationsBaseUrl/3.6.0")
+	si.addResource(baseURL+"v3/query", "Query endpoint of NuGet Search service", "SearchQueryService", "SearchQueryService/3.0.0-beta", "SearchQueryService/3.0.0-rc", "SearchQueryService/3.5.0")
+	si.addResource(baseURL+"v3/autocomplete", "Autocomplete endpoint of NuGet Search service", "SearchAutocompleteService", "SearchAutocompleteService/3.0.0-beta", "SearchAutocompleteService/3.0.0-rc", "SearchAutocompleteService/3.5.0")
+	si.addResource(baseURL+"v3-flatcontainer/{lower_id}/{lower_version}/readme", "URI template for package readmes", "ReadmeUriTemplate/6.13.0")
+	si.addResource(baseURL, "Push and delete (or unlist) packages", "PackagePublish/2.0.0")
+	si.addResource(baseURL, "Push symbol packages", "SymbolPackagePublish/4.9.0")
+	si.addResource(baseURL, "Legacy OData V2 feed", "LegacyGallery", "LegacyGallery/2.0.0")
+
+	return &si
+}
+
+// addResource adds a resource under each of the supplied types
+func (si *NugetServiceIndex) addResource(id string, comment string, types ...string) {
+	for _, t := range types {
+		si.Resources = append(si.Resources, &NugetServiceResource{
+			ID:      id,
+			Type:    t,
+			Comment: comment,
+		})
+	}
+}
+
+// ToBytes exports structure as byte array
+func (si *NugetServiceIndex) ToBytes() []byte {
+	b, _ := json.MarshalIndent(si, "", "  ")
+	return b
+}
+
+// NugetPackageVersions returned from a V3 flat container version list request (/{id}/index.json)
+type NugetPackageVersions struct {
+	Versions []string `json:"versions"`
+}
+
+// ToBytes exports structure as byte array
+func (pv *NugetPackageVersions) ToBytes() []byte {
+	b, _ := json.Marshal(pv)
+	return b
+}
+
+// NugetSearchResults returned from a V3 search request (/query)
+type NugetSearchResults struct {
+	TotalHits int                  `json:"totalHits"`
+	Data      []*NugetSearchResult `json:"data"`
+}
+
+// NugetSearchResult is a single package ID within NugetSearchResults
+type NugetSearchResult struct {
+	ID             string                      `json:"@id"`
+	Type           string                      `json:"@type"`
+	Registration   string                      `json:"registration"`
+	PackageID      string                      `json:"id"`
+	Version        string                      `json:"version"`
+	Description    string                      `json:"description"`
+	Summary        string                      `json:"summary"`
+	Title          string                      `json:"title"`
+	IconURL        string                      `json:"iconUrl,omitempty"`
+	LicenseURL     string                      `json:"licenseUrl,omitempty"`
+	ProjectURL     string                      `json:"projectUrl,omitempty"`
+	Tags           []string                    `json:"tags"`
+	Authors        []string                    `json:"authors"`
+	TotalDownloads int                         `json:"totalDownloads"`
+	Verified       bool                        `json:"verified"`
+	PackageTypes   []*NugetSearchPackageType   `json:"packageTypes"`
+	Versions       []*NugetSearchResultVersion `json:"versions"`
+}
+
+// NugetSearchPackageType is a package type within a NugetSearchResult
+type NugetSearchPackageType struct {
+	Name string `json:"name"`
+}
+
+// NugetSearchResultVersion is a single version within a NugetSearchResult
+type NugetSearchResultVersion struct {
+	ID        string `json:"@id"`
+	Version   string `json:"version"`
+	Downloads int    `json:"downloads"`
+}
+
+// NewNugetSearchResult returns a search result for an ID from its versions (in version order)
+func NewNugetSearchResult(entries []*NugetPackageEntry, baseURL string) *NugetSearchResult {
+
+	// Metadata is taken from the latest version
+	npe := entries[len(entries)-1]
+
+	sr := NugetSearchResult{}
+	sr.ID = registrationIndexURL(baseURL, npe.Properties.ID)
+	sr.Type = "Package"
+	sr.Registration = sr.ID
+	sr.PackageID = npe.Properties.ID
+	sr.Version = npe.Properties.Version
+	sr.Description = npe.Properties.Description
+	sr.Summary = npe.Summary.Text
+	sr.Title = npe.Properties.Title
+	sr.IconURL = strings.ReplaceAll(npe.Properties.IconURL, "http://hosturl/", baseURL)
+	sr.LicenseURL = strings.ReplaceAll(npe.Properties.LicenseURL.Value, "http://hosturl/", baseURL)
+	sr.ProjectURL = npe.Properties.ProjectURL
+	sr.Tags = strings.Fields(strings.ReplaceAll(npe.Properties.Tags, ",", " "))
+	sr.Authors = strings.Split(npe.Author.Name, ",")
+	for i := range sr.Authors {
+		sr.Authors[i] = strings.TrimSpace(sr.Authors[i])
+	}
+	sr.TotalDownloads = npe.Properties.DownloadCount.Value
+	sr.PackageTypes = []*NugetSearchPackageType{{Name: "Dependency"}}
+	for _, e := range entries {
+		sr.Versions = append(sr.Versions, &NugetSearchResultVersion{
+			ID:        registrationLeafURL(baseURL, e.Properties.ID, e.Properties.Version),
+			Version:   e.Properties.Version,
+			Downloads: e.Properties.VersionDownloadCount.Value,
+		})
+	}
+
+	return &sr
+}
+
+// ToBytes exports structure as byte array
+func (sr *NugetSearchResults) ToBytes() []byte {
+	b, _ := json.Marshal(sr)
+	return b
+}
+
+// NugetAutocompleteResults returned from a V3 autocomplete request (/autocomplete)
+type NugetAutocompleteResults struct {
+	TotalHits int      `json:"totalHits"`
+	Data      []string `json:"data"`
+}
+
+// ToBytes exports structure as byte array
+func (ar *NugetAutocompleteResults) ToBytes() []byte {
+	b, _ := json.Marshal(ar)
+	return b
+}
+
+// NugetRegistrationIndex returned from a V3 registration index request (/{id}/index.json)
+type NugetRegistrationIndex struct {
+	ID    string                   `json:"@id"`
+	Type  []string                 `json:"@type"`
+	Count int                      `json:"count"`
+	Items []*NugetRegistrationPage `json:"items"`
+}
+
+// NugetRegistrationPage is a page of versions within a NugetRegistrationIndex
+type NugetRegistrationPage struct {
+	ID     string                   `json:"@id"`
+	Type   string                   `json:"@type"`
+	Count  int                      `json:"count"`
+	Items  []*NugetRegistrationLeaf `json:"items,omitempty"`
+	Lower  string                   `json:"lower"`
+	Upper  string                   `json:"upper"`
+	Parent string                   `json:"parent,omitempty"`
+}
+
+// NugetRegistrationLeaf is a single version within a NugetRegistrationPage
+type NugetRegistrationLeaf struct {
+	ID             string             `json:"@id"`
+	Type           string             `json:"@type"`
+	CatalogEntry   *NugetCatalogEntry `json:"catalogEntry"`
+	PackageContent string             `json:"packageContent"`
+	Registration   string             `json:"registration"`
+}
+
+// NugetRegistrationLeafIndex returned from a V3 registration leaf request (/{id}/{ver}.json)
+type NugetRegistrationLeafIndex struct {
+	ID             string   `json:"@id"`
+	Type           []string `json:"@type"`
+	CatalogEntry   string   `json:"catalogEntry"`
+	Listed         bool     `json:"listed"`
+	PackageContent string   `json:"packageContent"`
+	Published      string   `json:"published"`
+	Registration   string   `json:"registration"`
+}
+
+// NugetCatalogEntry holds the package metadata used in registration leaves
+type NugetCatalogEntry struct {
+	ID                       string                  `json:"@id"`
+	Type                     string                  `json:"@type"`
+	Authors                  string                  `json:"authors"`
+	DependencyGroups         []*NugetDependencyGroup `json:"dependencyGroups,omitempty"`
+	Description              string                  `json:"description"`
+	IconURL                  string                  `json:"iconUrl,omitempty"`
+	PackageID                string                  `json:"id"`
+	LicenseURL               string                  `json:"licenseUrl,omitempty"`
+	LicenseExpression        string                  `json:"licenseExpression,omitempty"`
+	Language                 string                  `json:"language,omitempty"`
+	Listed                   bool                    `json:"listed"`
+	MinClientVersion         string                  `json:"minClientVersion,omitempty"`
+	PackageContent           string                  `json:"packageContent"`
+	ProjectURL               string                  `json:"projectUrl,omitempty"`
+	Published                string                  `json:"published"`
+	ReadmeURL                string                  `json:"readmeUrl,omitempty"`
+	RequireLicenseAcceptance bool                    `json:"requireLicenseAcceptance"`
+	Summary                  string                  `json:"summary,omitempty"`
+	Tags                     []string                `json:"tags,omitempty"`
+	Title                    string                  `json:"title,omitempty"`
+	Version                  string                  `json:"version"`
+}
+
+// NugetDependencyGroup is the set of dependencies for a target framework
+type NugetDependencyGroup struct {
+	ID              string             `json:"@id,omitempty"`
+	Type            string             `json:"@type"`
+	TargetFramework string             `json:"targetFramework,omitempty"`
+	Dependencies    []*NugetDependency `json:"dependencies,omitempty"`
+}
+
+// NugetDependency is a single package dependency
+type NugetDependency struct {
+	ID           string `json:"@id,omitempty"`
+	Type         string `json:"@type"`
+	PackageID    string `json:"id"`
+	Range        string `json:"range,omitempty"`
+	Registration string `json:"registration,omitempty"`
+}
+
+// ToBytes exports structure as byte array
+func (ri *NugetRegistrationIndex) ToBytes() []byte {
+	b, _ := json.Marshal(ri)
+	return b
+}
+
+// ToBytes exports structure as byte array
+func (rp *NugetRegistrationPage) ToBytes() []byte {
+	b, _ := json.Marshal(rp)
+	return b
+}
+
+// ToBytes exports structure as byte array
+func (rl *NugetRegistrationLeafIndex) ToBytes() []byte {
+	b, _ := json.Marshal(rl)
+	return b
+}
+
+// NewNugetRegistrationIndex returns a registration index for all versions of an ID (in version order)
+func NewNugetRegistrationIndex(entries []*NugetPackageEntry, baseURL string) *NugetRegistrationIndex {
+
+	ri := NugetRegistrationIndex{}
+	ri.ID = registrationIndexURL(baseURL, entries[0].Properties.ID)
+	ri.Type = []string{"catalog:CatalogRoot", "PackageRegistration", "catalog:Permalink"}
+
+	// Inline the leaves if the package has few enough versions
+	inline := len(entries) <= registrationInlineMax
+
+	// Split the versions into pages
+	for _, page := range registrationPages(entries) {
+		rp := NewNugetRegistrationPage(page, baseURL)
+		if inline {
+			rp.ID = ri.ID + "#page/" + rp.Lower + "/" + rp.Upper
+		} else {
+			rp.Items = nil
+			rp.Parent = ""
+		}
+		ri.Items = append(ri.Items, rp)
+	}
+	ri.Count = len(ri.Items)
+
+	return &ri
+}
+
+// NewNugetRegistrationPage returns a registration page holding the supplied versions (in version order)
+func NewNugetRegistrationPage(entries []*NugetPackageEntry, baseURL string) *NugetRegistrationPage {
+
+	rp := NugetRegistrationPage{}
+	id := entries[0].Properties.ID
+	rp.Type = "catalog:CatalogPage"
+	rp.Lower = strings.ToLower(normalizeVersion(entries[0].Properties.Version))
+	rp.Upper = strings.ToLower(normalizeVersion(entries[len(entries)-1].Properties.Version))
+	rp.ID = registrationBaseURL(baseURL, id) + "page/" + rp.Lower + "/" + rp.Upper + ".json"
+	rp.Parent = registrationIndexURL(baseURL, id)
+	rp.Count = len(entries)
+	for _, npe := range entries {
+		rp.Items = append(rp.Items, NewNugetRegistrationLeaf(npe, baseURL))
+	}
+
+	return &rp
+}
+
+// NewNugetRegistrationLeaf returns a registration leaf for use inside a registration page
+func NewNugetRegistrationLeaf(npe *NugetPackageEntry, baseURL string) *NugetRegistrationLeaf {
+
+	rl := NugetRegistrationLeaf{}
+	rl.ID = registrationLeafURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	rl.Type = "Package"
+	rl.CatalogEntry = NewNugetCatalogEntry(npe, baseURL)
+	rl.PackageContent = packageContentURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	rl.Registration = registrationIndexURL(baseURL, npe.Properties.ID)
+
+	return &rl
+}
+
+// NewNugetRegistrationLeafIndex returns a registration leaf for a leaf request
+func NewNugetRegistrationLeafIndex(npe *NugetPackageEntry, baseURL string) *NugetRegistrationLeafIndex {
+
+	rl := NugetRegistrationLeafIndex{}
+	rl.ID = registrationLeafURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	rl.Type = []string{"Package", "http://schema.nuget.org/catalog#Permalink"}
+	rl.CatalogEntry = rl.ID
+	rl.Listed = npe.IsListed()
+	rl.PackageContent = packageContentURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	rl.Published = npe.Properties.Published.Value
+	rl.Registration = registrationIndexURL(baseURL, npe.Properties.ID)
+
+	return &rl
+}
+
+// NewNugetCatalogEntry returns the catalog metadata for a package entry
+func NewNugetCatalogEntry(npe *NugetPackageEntry, baseURL string) *NugetCatalogEntry {
+
+	ce := NugetCatalogEntry{}
+	ce.ID = registrationLeafURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	ce.Type = "PackageDetails"
+	ce.Authors = npe.Author.Name
+	ce.DependencyGroups = parseV2Dependencies(npe.Properties.Dependencies, baseURL)
+	ce.Description = npe.Properties.Description
+	ce.IconURL = strings.ReplaceAll(npe.Properties.IconURL, "http://hosturl/", baseURL)
+	ce.PackageID = npe.Properties.ID
+	ce.LicenseURL = strings.ReplaceAll(npe.Properties.LicenseURL.Value, "http://hosturl/", baseURL)
+	ce.LicenseExpression = npe.Properties.LicenseExpression
+	ce.Language = npe.Properties.Language
+	ce.Listed = npe.IsListed()
+	ce.MinClientVersion = npe.Properties.MinClientVersion.Value
+	ce.PackageContent = packageContentURL(baseURL, npe.Properties.ID, npe.Properties.Version)
+	ce.ProjectURL = npe.Properties.ProjectURL
+	if npe.Properties.ReadmeFile != "" {
+		ce.ReadmeURL = baseURL + "readme/" + npe.Properties.ID + "/" + npe.Properties.Version
+	}
+	ce.Published = npe.Properties.Published.Value
+	ce.RequireLicenseAcceptance = npe.Properties.RequireLicenseAcceptance.Value
+	ce.Summary = npe.Summary.Text
+	ce.Tags = strings.Fields(strings.ReplaceAll(npe.Properties.Tags, ",", " "))
+	ce.Title = npe.Properties.Title
+	ce.Version = npe.Properties.Version
+
+	return &ce
+}
+
+// registrationPages splits entries into registration page sized chunks
+func registrationPages(entries []*NugetPackageEntry) [][]*NugetPackageEntry {
+	var pages [][]*NugetPackageEntry
+	for i := 0; i < len(entries); i += registrationPageSize {
+		j := i + registrationPageSize
+		if j > len(entries) {
+			j = len(entries)
+		}
+		pages = append(pages, entries[i:j])
+	}
+	return pages
+}
+
+// parseV2Dependencies converts a V2 dependency string (id:range:framework|...) into dependency groups
+func parseV2Dependencies(deps string, baseURL string) []*NugetDependencyGroup {
+
+	var groups []*NugetDependencyGroup
+	index := make(map[string]*NugetDependencyGroup)
+
+	for _, d := range strings.Split(deps, "|") {
+		if d == "" {
+			continue
+		}
+		// Split out the parts, framework is optional
+		x := strings.SplitN(d, ":", 3)
+		for len(x) < 3 {
+			x = append(x, "")
+		}
+		// Find or create the group for this framework
+		g, ok := index[strings.ToLower(x[2])]
+		if !ok {
+			g = &NugetDependencyGroup{Type: "PackageDependencyGroup", TargetFramework: x[2]}
+			index[strings.ToLower(x[2])] = g
+			groups = append(groups, g)
+		}
+		// An empty id denotes a framework with no dependencies
+		if x[0] != "" {
+			g.Dependencies = append(g.Dependencies, &NugetDependency{
+				Type:         "PackageDependency",
+				PackageID:    x[0],
+				Range:        x[1],
+				Registration: registrationIndexURL(baseURL, x[0]),
+			})
+		}
+	}
+
+	return groups
+}
+
+// registrationBaseURL returns the registration base for an ID
+func registrationBaseURL(baseURL string, id string) string {
+	return baseURL + "v3/registration/" + strings.ToLower(id) + "/"
+}
+
+// registrationIndexURL returns the registration index URL for an ID
+func registrationIndexURL(baseURL string, id string) string {
+	return registrationBaseURL(baseURL, id) + "index.json"
+}
+
+// registrationLeafURL returns the registration leaf URL for an ID and version
+func registrationLeafURL(baseURL string, id string, ver string) string {
+	return registrationBaseURL(baseURL, id) + strings.ToLower(normalizeVersion(ver)) + ".json"
+}
+
+// packageContentURL returns the flat container download URL for an ID and version
+func packageContentURL(baseURL string, id string, ver string) string {
+	id = strings.ToLower(id)
+	ver = strings.ToLower(normalizeVersion(ver))
+	return baseURL + "v3-flatcontainer/" + id + "/" + ver + "/" + id + "." + ver + ".nupkg"
+}
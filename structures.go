@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/xml"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -71,6 +72,7 @@ type NugetFeed struct {
 	XMLNs   string   `xml:"xmlns,attr"`
 	XMLNsD  string   `xml:"xmlns:d,attr"`
 	XMLNsM  string   `xml:"xmlns:m,attr"`
+	Count   *int     `xml:"m:count,omitempty"`
 	ID      string   `xml:"id"`
 	Title   struct {
 		Text string `xml:",chardata"`
@@ -105,6 +107,9 @@ func NewNugetFeed(title string, baseURL string) *NugetFeed {
 
 // ToBytes exports structure as byte array
 func (nf *NugetFeed) ToBytes() []byte {
+	for _, p := range nf.Packages {
+		p.setServerDefaults()
+	}
 	var b bytes.Buffer
 	// Unmarshal into XML
 	output, err := xml.MarshalIndent(nf, "  ", "    ")
@@ -240,11 +245,22 @@ type NugetPackageEntry struct {
 			Null  bool   `xml:"m:null,attr"`
 		} `xml:"d:MinClientVersion"`
 		Language string `xml:"d:Language"`
+		Listed   struct {
+			Value bool   `xml:",chardata"`
+			Type  string `xml:"m:type,attr"`
+		} `xml:"d:Listed"`
+		// Frameworks targeted by the package contents (not part of the V2 feed)
+		Frameworks []string `xml:"-"`
+		// SPDX license expression (not part of the V2 feed, LicenseNames holds the license IDs)
+		LicenseExpression string `xml:"-"`
+		// Paths of the embedded icon and readme within the package (not part of the V2 feed)
+		IconFile   string `xml:"-"`
+		ReadmeFile string `xml:"-"`
 	} `xml:"m:properties"`
 }
 
 // NewNugetPackageEntry returns a semi populated struct for a Nuget Packages Entry
-func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
+func NewNugetPackageEntry(nsf *nuspec.NuSpec, ne *nuspecExtra) *NugetPackageEntry {
 	// Create new entry
 	e := NugetPackageEntry{}
 	// Set Defaults
@@ -281,20 +297,36 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	e.Properties.ID = nsf.Meta.ID
 	e.Properties.IDLowerCase = strings.ToLower(e.Properties.ID)
 	e.Properties.Version = nsf.Meta.Version
-	e.Properties.VersionNorm = nsf.Meta.Version
+	e.Properties.VersionNorm = normalizeVersion(nsf.Meta.Version)
 	e.Properties.Copyright.Value = nsf.Meta.Copyright
 	if e.Properties.Copyright.Value == "" {
 		e.Properties.Copyright.Null = true
 	}
+	e.Properties.Dependencies = ne.V2Dependencies()
 	e.Properties.Description = nsf.Meta.Description
 	e.Properties.GalleryDetailsURL = nsf.Meta.ProjectURL
+	if e.Properties.GalleryDetailsURL == "" {
+		e.Properties.GalleryDetailsURL = ne.Meta.Repository.URL
+	}
 	e.Properties.IconURL = nsf.Meta.IconURL
+	e.Properties.IsPrerelease.Value = isPrereleaseVersion(nsf.Meta.Version)
 	e.Properties.IsLatestVersion.Type = "Edm.Boolean"
 	e.Properties.IsAbsoluteLatestVersion.Type = "Edm.Boolean"
 	e.Properties.ProjectURL = nsf.Meta.ProjectURL
+	e.Properties.ReleaseNotes.Value = nsf.Meta.ReleaseNotes
 	if e.Properties.ReleaseNotes.Value == "" {
 		e.Properties.ReleaseNotes.Null = true
 	}
+	e.Properties.LicenseURL.Value = nsf.Meta.LicenseURL
+	// A <license> replaces the deprecated <licenseUrl>, pointing it at the expression or the file in the package
+	switch strings.ToLower(nsf.Meta.License.Type) {
+	case "expression":
+		e.Properties.LicenseExpression = strings.TrimSpace(nsf.Meta.License.Text)
+		e.Properties.LicenseNames.Value = strings.Join(spdxLicenseNames(e.Properties.LicenseExpression), ",")
+		e.Properties.LicenseURL.Value = "https://licenses.nuget.org/" + url.PathEscape(e.Properties.LicenseExpression)
+	case "file":
+		e.Properties.LicenseURL.Value = "http://hosturl/" + `files/` + nsf.Meta.ID + `/` + nsf.Meta.Version + `/` + strings.TrimSpace(nsf.Meta.License.Text)
+	}
 	if e.Properties.LicenseURL.Value == "" {
 		e.Properties.LicenseURL.Null = true
 	}
@@ -304,10 +336,11 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	if e.Properties.LicenseReportURL.Value == "" {
 		e.Properties.LicenseReportURL.Null = true
 	}
-	e.Properties.ReportAbuseURL = "http://soloworks.co.uk/"
+	e.Properties.RequireLicenseAcceptance.Value = nsf.Meta.ReqLicenseAccept
 	e.Properties.Tags = nsf.Meta.Tags
 	e.Properties.Title = nsf.Meta.Title
-	e.Properties.Language = "en-US"
+	e.Properties.Language = nsf.Meta.Language
+	e.Properties.MinClientVersion.Value = ne.Meta.MinClientVersion
 	if e.Properties.MinClientVersion.Value == "" {
 		e.Properties.MinClientVersion.Null = true
 	}
@@ -320,10 +353,19 @@ func NewNugetPackageEntry(nsf *nuspec.NuSpec) *NugetPackageEntry {
 	e.Properties.Published.Type = "Edm.DateTime"
 	e.Properties.RequireLicenseAcceptance.Type = "Edm.Boolean"
 	e.Properties.VersionDownloadCount.Type = "Edm.Int32"
+	e.Properties.Listed.Value = true
+	e.Properties.Listed.Type = "Edm.Boolean"
+
+	// Embedded icon and readme are served from their own routes
+	e.Properties.IconFile = ne.Meta.Icon
+	e.Properties.ReadmeFile = ne.Meta.Readme
+	if e.Properties.IconFile != "" {
+		e.Properties.IconURL = "http://hosturl/" + `icon/` + e.Properties.ID + `/` + e.Properties.Version
+	}
 
 	// Replace http://content/ with internal full URLs
-	// pkgURL := "http://hosturl/" + "files/" + e.Properties.ID + `/` + e.Properties.Version + `/content/`
-	// e.Properties.IconURL = strings.ReplaceAll(e.Properties.IconURL, "http://content/", pkgURL)
+	pkgURL := "http://hosturl/" + "files/" + packageStoreDir(e.Properties.ID, e.Properties.Version) + `/content/`
+	e.Properties.IconURL = strings.ReplaceAll(e.Properties.IconURL, "http://content/", pkgURL)
 	// e.Properties.Description = strings.ReplaceAll(e.Properties.Description, "http://content/", pkgURL)
 
 	// Return skeleton
@@ -335,6 +377,32 @@ func (npe *NugetPackageEntry) Filename() string {
 	return npe.Properties.ID + "." + npe.Properties.Version + ".nupkg"
 }
 
+// setServerDefaults fills in the values taken from the server config rather than the package
+func (npe *NugetPackageEntry) setServerDefaults() {
+	if npe.Properties.ReportAbuseURL == "" {
+		npe.Properties.ReportAbuseURL = server.config.ReportAbuseURL
+	}
+	if npe.Properties.Language == "" {
+		npe.Properties.Language = server.config.DefaultLanguage
+	}
+}
+
+// IsListed returns true if the package is listed, entries saved before listing was tracked are listed
+func (npe *NugetPackageEntry) IsListed() bool {
+	return npe.Properties.Listed.Value || npe.Properties.Listed.Type == ""
+}
+
+// SetListed lists or unlists the package, unlisted packages are published in 1900 as per nuget.org
+func (npe *NugetPackageEntry) SetListed(listed bool) {
+	npe.Properties.Listed.Value = listed
+	npe.Properties.Listed.Type = "Edm.Boolean"
+	if listed {
+		npe.Properties.Published.Value = npe.Properties.Created.Value
+	} else {
+		npe.Properties.Published.Value = unlistedPublishedTime
+	}
+}
+
 // ToBytes exports structure as byte array
 func (npe *NugetPackageEntry) ToBytes() []byte {
 
@@ -343,6 +411,7 @@ func (npe *NugetPackageEntry) ToBytes() []byte {
 	npe.XMLNs = "http://www.w3.org/2005/Atom"
 	npe.XMLNsD = "http://schemas.microsoft.com/ado/2007/08/dataservices"
 	npe.XMLNsM = "http://schemas.microsoft.com/ado/2007/08/dataservices/metadata"
+	npe.setServerDefaults()
 
 	var b bytes.Buffer
 	// Unmarshal into XML
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Directory in the store holding symbol files by their SSQP key, underscore keeps it clear of package IDs
+const symbolsDir = "_symbols"
+
+// Package type declared by symbol packages (.snupkg)
+const symbolsPackageType = "SymbolsPackage"
+
+// Longest metadata version string, 255 bytes including the null terminator padded to four bytes
+const portablePDBMaxVersionLength = 256
+
+// SymbolError represents an error reading a symbol file
+type SymbolError struct {
+	ErrorString string
+}
+
+func (se *SymbolError) Error() string {
+	return se.ErrorString
+}
+
+// symbolFiles returns the portable PDBs in a symbol package keyed by their path in the symbol store,
+// and an error naming the first .pdb that can't be read, the readable ones are still returned
+func symbolFiles(pa *packageArchive) (map[string]*zip.File, error) {
+	symbols := make(map[string]*zip.File)
+	var first error
+	for _, f := range pa.zip.File {
+		if !strings.EqualFold(path.Ext(f.Name), ".pdb") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			if first == nil {
+				first = &SymbolError{f.Name + ": " + err.Error()}
+			}
+			continue
+		}
+		id, err := portablePDBID(rc)
+		rc.Close()
+		if err != nil {
+			if first == nil {
+				first = &SymbolError{f.Name + ": " + err.Error()}
+			}
+			continue
+		}
+		fn := strings.ToLower(path.Base(strings.ReplaceAll(f.Name, `\`, `/`)))
+		symbols[path.Join(symbolsDir, fn, portablePDBSignature(id), fn)] = f
+	}
+	return symbols, first
+}
+
+// portablePDBID reads the 20 byte PDB id held at the start of the #Pdb stream of a portable PDB
+func portablePDBID(r io.Reader) ([]byte, error) {
+
+	// Metadata root must start with the BSJB signature
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil || binary.LittleEndian.Uint32(b) != 0x424A5342 {
+		return nil, &SymbolError{"Not a portable PDB"}
+	}
+	read := len(b)
+
+	// Skip the version string to the stream headers, checking its length before trusting it
+	n := binary.LittleEndian.Uint32(b[12:])
+	if n > portablePDBMaxVersionLength {
+		return nil, &SymbolError{"Invalid metadata root"}
+	}
+	b = make([]byte, int(n)+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, &SymbolError{"Invalid metadata root"}
+	}
+	read += len(b)
+	streams := int(binary.LittleEndian.Uint16(b[len(b)-2:]))
+
+	// Find the #Pdb stream
+	for i := 0; i < streams; i++ {
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return nil, &SymbolError{"Invalid stream header"}
+		}
+		read += len(h)
+		// Names are null terminated and padded to four bytes
+		var name []byte
+		for {
+			c := make([]byte, 4)
+			if _, err := io.ReadFull(r, c); err != nil {
+				return nil, &SymbolError{"Invalid stream name"}
+			}
+			read += len(c)
+			if n := bytes.IndexByte(c, 0); n >= 0 {
+				name = append(name, c[:n]...)
+				break
+			}
+			name = append(name, c...)
+		}
+		if string(name) == "#Pdb" {
+			// Streams follow the headers so skip forward to it
+			offset := int(binary.LittleEndian.Uint32(h))
+			size := int(binary.LittleEndian.Uint32(h[4:]))
+			if size < 20 || offset < read {
+				return nil, &SymbolError{"Invalid #Pdb stream"}
+			}
+			if _, err := io.CopyN(ioutil.Discard, r, int64(offset-read)); err != nil {
+				return nil, &SymbolError{"Invalid #Pdb stream"}
+			}
+			id := make([]byte, 20)
+			if _, err := io.ReadFull(r, id); err != nil {
+				return nil, &SymbolError{"Invalid #Pdb stream"}
+			}
+			return id, nil
+		}
+	}
+
+	return nil, &SymbolError{"No #Pdb stream"}
+}
+
+// portablePDBSignature formats a PDB id as the SSQP signature, the GUID followed by FFFFFFFF (lowercase)
+func portablePDBSignature(id []byte) string {
+	return fmt.Sprintf("%08x%04x%04x%x",
+		binary.LittleEndian.Uint32(id[0:4]),
+		binary.LittleEndian.Uint16(id[4:6]),
+		binary.LittleEndian.Uint16(id[6:8]),
+		id[8:16]) + "ffffffff"
+}
+
+func serveSymbolFile(w http.ResponseWriter, r *http.Request) {
+
+	// Split the path into {file}/{signature}/{file}
+	x := strings.Split(strings.TrimPrefix(r.URL.Path, server.URL.Path+`symbols/`), `/`)
+	if len(x) != 3 || !strings.EqualFold(x[0], x[2]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Symbol keys are stored in lowercase
+	f, _, err := server.fs.GetFile(path.Join(symbolsDir, strings.ToLower(x[0]), strings.ToLower(x[1]), strings.ToLower(x[2])))
+	if err == ErrFileNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Set Headers
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	// Output the file
+	serveStoreFile(w, r, f)
+}
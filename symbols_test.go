@@ -0,0 +1,140 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPDB builds the start of a portable PDB with the given version string length field and a #Pdb stream
+func testPDB(versionLength uint32, id []byte) []byte {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+
+	// Metadata root
+	binary.Write(&b, le, uint32(0x424A5342))
+	binary.Write(&b, le, uint16(1))
+	binary.Write(&b, le, uint16(1))
+	binary.Write(&b, le, uint32(0))
+	binary.Write(&b, le, versionLength)
+	b.Write(append([]byte("PDB v1.0"), make([]byte, 4)...))
+	binary.Write(&b, le, uint16(0))
+	binary.Write(&b, le, uint16(1))
+
+	// One stream header, the stream follows straight after it
+	binary.Write(&b, le, uint32(b.Len()+16))
+	binary.Write(&b, le, uint32(len(id)))
+	b.Write([]byte("#Pdb\x00\x00\x00\x00"))
+	b.Write(id)
+	return b.Bytes()
+}
+
+func TestPortablePDBID(t *testing.T) {
+	id := []byte{
+		0x78, 0x56, 0x34, 0x12, 0x34, 0x12, 0x78, 0x56,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x00, 0x00, 0x00, 0x01,
+	}
+	valid := testPDB(12, id)
+
+	tests := []struct {
+		name string
+		pdb  []byte
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"empty", []byte{}, false},
+		{"not bsjb", append([]byte("MZ\x90\x00"), valid[4:]...), false},
+		{"truncated root", valid[:20], false},
+		{"truncated stream", valid[:len(valid)-4], false},
+		{"version too long", testPDB(0x7FFFFFFF, id), false},
+		{"version over 256", testPDB(260, id), false},
+		{"short stream", testPDB(12, id[:8]), false},
+	}
+	for _, tt := range tests {
+		got, err := portablePDBID(bytes.NewReader(tt.pdb))
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			} else if _, ok := err.(*SymbolError); !ok {
+				t.Errorf("%s: error %T, want *SymbolError", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, id) {
+			t.Errorf("%s: id %x, want %x", tt.name, got, id)
+		}
+		if sig := portablePDBSignature(got); sig != "12345678123456780102030405060708ffffffff" {
+			t.Errorf("%s: signature %s", tt.name, sig)
+		}
+	}
+}
+
+// testSymbolPackage returns a .snupkg for an ID and version holding a portable PDB
+func testSymbolPackage(id string, ver string, pdbName string, pdb []byte) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	w, _ := zw.Create(id + ".nuspec")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2013/05/nuspec.xsd">
+  <metadata>
+    <id>%s</id>
+    <version>%s</version>
+    <authors>Test</authors>
+    <description>Test package</description>
+    <packageTypes>
+      <packageType name="SymbolsPackage" />
+    </packageTypes>
+  </metadata>
+</package>`, id, ver)
+	w, _ = zw.Create("lib/netstandard2.0/" + pdbName)
+	w.Write(pdb)
+	zw.Close()
+	return b.Bytes()
+}
+
+func TestSharedSymbolFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "symbols-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testFeedServer()
+	fs := testLocalStore(t, filepath.Join(dir, "store"))
+	defer func() { fs.Close() }()
+
+	// Two versions built from the same source share a PDB
+	pdb := testPDB(12, bytes.Repeat([]byte{1}, 20))
+	symbolPath := filepath.Join(dir, "store", symbolsDir, "test.pdb", portablePDBSignature(bytes.Repeat([]byte{1}, 20)), "test.pdb")
+	for _, ver := range []string{"1.0.0", "1.0.1"} {
+		testStorePackage(t, fs, dir, "Test.Pkg", ver, "")
+		if _, err := fs.StoreSymbolPackage(bytes.NewReader(testSymbolPackage("Test.Pkg", ver, "Test.pdb", pdb)), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The file is kept until the last package using it is removed, including after a restart
+	if err := fs.RemovePackage("Test.Pkg", "1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(symbolPath); err != nil {
+		t.Errorf("symbol file shared with another package removed: %v", err)
+	}
+	fs.Close()
+	fs = testLocalStore(t, filepath.Join(dir, "store"))
+	if err := fs.RemovePackage("Test.Pkg", "1.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(symbolPath); !os.IsNotExist(err) {
+		t.Errorf("symbol file kept after its last package was removed: %v", err)
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	nuspec "github.com/soloworks/go-nuspec"
+)
+
+// upstreamFeed reads packages from another NuGet feed, either a V2 OData feed or a V3 service index
+type upstreamFeed struct {
+	url                  string // Root of a V2 feed, or the V3 service index
+	packageBaseURL       string // V3 flat container
+	registrationsBaseURL string // V3 package metadata, empty for V2 feeds
+	client               *http.Client
+}
+
+// upstreamPackage is a version of a package as listed by an upstream feed
+type upstreamPackage struct {
+	ID            string
+	Version       string
+	ContentURL    string             // Where the .nupkg is downloaded from
+	Hash          string             // Base64 or hex encoded as given by the feed, empty if not given
+	HashAlgorithm string             // SHA512 unless given
+	CatalogURL    string             // V3 catalog leaf holding the hash registrations leave out
+	Entry         *NugetPackageEntry // Upstream metadata, served until the package is cached
+}
+
+// UpstreamError represents an unusable upstream feed or package
+type UpstreamError struct {
+	ErrorString string
+	Status      int // Response status, if the feed responded
+}
+
+func (ue *UpstreamError) Error() string {
+	return ue.ErrorString
+}
+
+// newUpstreamFeed returns a client for a feed, URLs ending in .json are read as V3 service indexes
+func newUpstreamFeed(u string) (*upstreamFeed, error) {
+
+	uf := &upstreamFeed{url: u, client: &http.Client{Timeout: 5 * time.Minute}}
+	if !strings.HasSuffix(strings.ToLower(u), ".json") {
+		// V2 paths are relative to the root
+		if !strings.HasSuffix(uf.url, "/") {
+			uf.url += "/"
+		}
+		return uf, nil
+	}
+
+	// Find the flat container and registrations in the service index, preferring SemVer 2.0 registrations
+	var si struct {
+		Resources []struct {
+			ID   string `json:"@id"`
+			Type string `json:"@type"`
+		} `json:"resources"`
+	}
+	if err := uf.getJSON(u, &si); err != nil {
+		return nil, err
+	}
+	rank := 0
+	for _, r := range si.Resources {
+		switch r.Type {
+		case "PackageBaseAddress/3.0.0":
+			uf.packageBaseURL = r.ID
+		case "RegistrationsBaseUrl/3.6.0":
+			uf.registrationsBaseURL, rank = r.ID, 3
+		case "RegistrationsBaseUrl/3.4.0":
+			if rank < 2 {
+				uf.registrationsBaseURL, rank = r.ID, 2
+			}
+		case "RegistrationsBaseUrl", "RegistrationsBaseUrl/3.0.0-rc", "RegistrationsBaseUrl/3.0.0-beta":
+			if rank < 1 {
+				uf.registrationsBaseURL, rank = r.ID, 1
+			}
+		}
+	}
+	if uf.packageBaseURL == "" || uf.registrationsBaseURL == "" {
+		return nil, &UpstreamError{"Service index has no PackageBaseAddress or RegistrationsBaseUrl: " + u, 0}
+	}
+	if !strings.HasSuffix(uf.packageBaseURL, "/") {
+		uf.packageBaseURL += "/"
+	}
+	if !strings.HasSuffix(uf.registrationsBaseURL, "/") {
+		uf.registrationsBaseURL += "/"
+	}
+	return uf, nil
+}
+
+// Packages returns every version of an ID the upstream feed has, an unknown ID has none
+func (uf *upstreamFeed) Packages(id string) ([]*upstreamPackage, error) {
+	if uf.registrationsBaseURL != "" {
+		return uf.packagesV3(id)
+	}
+	return uf.packagesV2(id)
+}
+
+// Download spools a package to a temp file, checking its size, hash and nuspec, the caller must close and remove it.
+// It returns false if the feed gave no hash to check the package against.
+func (uf *upstreamFeed) Download(p *upstreamPackage, max int64) (*os.File, bool, error) {
+
+	// V3 registrations leave the hash out, look it up in the catalog
+	p, err := uf.catalogHash(p)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Request the package
+	resp, err := uf.client.Get(p.ContentURL)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, &UpstreamError{"Unexpected status " + resp.Status + " from " + p.ContentURL, resp.StatusCode}
+	}
+
+	// Spool it to disk, hashing it on the way if the feed gave a hash
+	tmp, err := ioutil.TempFile("", "nuget-upstream-*")
+	if err != nil {
+		return nil, false, err
+	}
+	fail := func(err error) (*os.File, bool, error) {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, false, err
+	}
+	h := p.NewHash()
+	w := io.Writer(tmp)
+	if h != nil {
+		w = io.MultiWriter(tmp, h)
+	}
+	// Read one byte over the limit to detect packages that are too large
+	n, err := io.Copy(w, io.LimitReader(resp.Body, max+1))
+	if err != nil {
+		return fail(err)
+	}
+	if n > max {
+		return fail(&UpstreamError{"Package too large: " + p.ContentURL, 0})
+	}
+
+	// Check it is the package asked for
+	if h != nil && !p.CheckHash(h.Sum(nil)) {
+		return fail(&UpstreamError{"Package hash does not match the feed: " + p.ContentURL, 0})
+	}
+	pa, err := openPackage(tmp)
+	if err != nil {
+		return fail(err)
+	}
+	if !strings.EqualFold(pa.nsf.Meta.ID, p.ID) || !sameVersion(pa.nsf.Meta.Version, p.Version) {
+		return fail(&UpstreamError{"Package does not match the feed: " + p.ContentURL, 0})
+	}
+
+	return tmp, h != nil, nil
+}
+
+// catalogHash returns a copy of a package with the hash from its catalog leaf, if the feed didn't list
+// one, packages without a leaf are returned as they are
+func (uf *upstreamFeed) catalogHash(p *upstreamPackage) (*upstreamPackage, error) {
+	if p.Hash != "" || p.CatalogURL == "" {
+		return p, nil
+	}
+	var leaf struct {
+		PackageHash          string `json:"packageHash"`
+		PackageHashAlgorithm string `json:"packageHashAlgorithm"`
+	}
+	err := uf.getJSON(p.CatalogURL, &leaf)
+	if ue, ok := err.(*UpstreamError); ok && ue.Status == http.StatusNotFound {
+		return p, nil
+	} else if err != nil {
+		return nil, err
+	}
+	hp := *p
+	hp.Hash, hp.HashAlgorithm = leaf.PackageHash, leaf.PackageHashAlgorithm
+	return &hp, nil
+}
+
+// NewHash returns a hash for checking a download against the hash given by the feed, or nil if none was given
+func (p *upstreamPackage) NewHash() hash.Hash {
+	if p.Hash == "" {
+		return nil
+	}
+	if strings.EqualFold(p.HashAlgorithm, "SHA256") {
+		return sha256.New()
+	}
+	return sha512.New()
+}
+
+// CheckHash returns true if a download's hash matches the feed, feeds give them in base64 or hex
+func (p *upstreamPackage) CheckHash(sum []byte) bool {
+	if b, err := base64.StdEncoding.DecodeString(p.Hash); err == nil && string(b) == string(sum) {
+		return true
+	}
+	b, err := hex.DecodeString(p.Hash)
+	return err == nil && string(b) == string(sum)
+}
+
+// upstreamV2Feed is a page of a V2 feed, matched on local names so any namespace prefixes can be used
+type upstreamV2Feed struct {
+	Entries []struct {
+		Title   string `xml:"title"`
+		Summary string `xml:"summary"`
+		Author  string `xml:"author>name"`
+		Content struct {
+			Src string `xml:"src,attr"`
+		} `xml:"content"`
+		Properties struct {
+			ID                       string `xml:"Id"`
+			Version                  string `xml:"Version"`
+			Title                    string `xml:"Title"`
+			Description              string `xml:"Description"`
+			Summary                  string `xml:"Summary"`
+			Authors                  string `xml:"Authors"`
+			Copyright                string `xml:"Copyright"`
+			Dependencies             string `xml:"Dependencies"`
+			IconURL                  string `xml:"IconUrl"`
+			LicenseURL               string `xml:"LicenseUrl"`
+			ProjectURL               string `xml:"ProjectUrl"`
+			ReleaseNotes             string `xml:"ReleaseNotes"`
+			Tags                     string `xml:"Tags"`
+			Language                 string `xml:"Language"`
+			MinClientVersion         string `xml:"MinClientVersion"`
+			RequireLicenseAcceptance string `xml:"RequireLicenseAcceptance"`
+			Created                  string `xml:"Created"`
+			Published                string `xml:"Published"`
+			Listed                   string `xml:"Listed"`
+			PackageHash              string `xml:"PackageHash"`
+			PackageHashAlgorithm     string `xml:"PackageHashAlgorithm"`
+			PackageSize              string `xml:"PackageSize"`
+		} `xml:"properties"`
+	} `xml:"entry"`
+	Links []struct {
+		Rel  string `xml:"rel,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+}
+
+func (uf *upstreamFeed) packagesV2(id string) ([]*upstreamPackage, error) {
+
+	var packages []*upstreamPackage
+	next := uf.url + "FindPackagesById()?id=" + url.QueryEscape("'"+id+"'") + "&semVerLevel=2.0.0"
+	for page := 0; next != "" && page < 100; page++ {
+
+		// Get the page
+		var f upstreamV2Feed
+		resp, err := uf.client.Get(next)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return packages, nil
+		} else if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, &UpstreamError{"Unexpected status " + resp.Status + " from " + next, resp.StatusCode}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&f)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Convert the entries
+		for _, e := range f.Entries {
+			p := e.Properties
+			m := &upstreamMetadata{
+				ID:                       p.ID,
+				Version:                  p.Version,
+				Title:                    p.Title,
+				Description:              p.Description,
+				Summary:                  p.Summary,
+				Authors:                  p.Authors,
+				Copyright:                p.Copyright,
+				IconURL:                  p.IconURL,
+				LicenseURL:               p.LicenseURL,
+				ProjectURL:               p.ProjectURL,
+				ReleaseNotes:             p.ReleaseNotes,
+				Tags:                     p.Tags,
+				Language:                 p.Language,
+				MinClientVersion:         p.MinClientVersion,
+				RequireLicenseAcceptance: p.RequireLicenseAcceptance == "true",
+				Created:                  p.Created,
+				Published:                p.Published,
+				Listed:                   p.Listed != "false" && !strings.HasPrefix(p.Published, "1900"),
+				Dependencies:             v2DependencyGroups(p.Dependencies),
+			}
+			m.PackageSize, _ = strconv.Atoi(p.PackageSize)
+			// Some feeds only give the ID as the title
+			if m.ID == "" {
+				m.ID = e.Title
+			}
+			if m.Authors == "" {
+				m.Authors = e.Author
+			}
+			if m.Summary == "" {
+				m.Summary = e.Summary
+			}
+			if !strings.EqualFold(m.ID, id) || m.Version == "" {
+				continue
+			}
+			packages = append(packages, &upstreamPackage{
+				ID:            m.ID,
+				Version:       m.Version,
+				ContentURL:    uf.resolve(next, e.Content.Src),
+				Hash:          p.PackageHash,
+				HashAlgorithm: p.PackageHashAlgorithm,
+				Entry:         m.Entry(),
+			})
+		}
+
+		// Follow the next link
+		next = ""
+		for _, l := range f.Links {
+			if l.Rel == "next" {
+				next = uf.resolve(uf.url, l.Href)
+			}
+		}
+	}
+
+	return packages, nil
+}
+
+// upstreamStrings reads a JSON value that may be a string or an array of strings
+type upstreamStrings []string
+
+func (us *upstreamStrings) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*us = upstreamStrings{s}
+		return nil
+	}
+	var a []string
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	}
+	*us = a
+	return nil
+}
+
+// upstreamRegistrationPage is a page of a V3 registration index, items are left out of large indexes
+type upstreamRegistrationPage struct {
+	ID    string `json:"@id"`
+	Items []struct {
+		PackageContent string `json:"packageContent"`
+		CatalogEntry   struct {
+			CatalogURL               string          `json:"@id"`
+			ID                       string          `json:"id"`
+			Version                  string          `json:"version"`
+			Title                    string          `json:"title"`
+			Description              string          `json:"description"`
+			Summary                  string          `json:"summary"`
+			Authors                  upstreamStrings `json:"authors"`
+			IconURL                  string          `json:"iconUrl"`
+			LicenseURL               string          `json:"licenseUrl"`
+			LicenseExpression        string          `json:"licenseExpression"`
+			ProjectURL               string          `json:"projectUrl"`
+			Tags                     upstreamStrings `json:"tags"`
+			Language                 string          `json:"language"`
+			MinClientVersion         string          `json:"minClientVersion"`
+			RequireLicenseAcceptance bool            `json:"requireLicenseAcceptance"`
+			Published                string          `json:"published"`
+			Listed                   *bool           `json:"listed"`
+			PackageHash              string          `json:"packageHash"`
+			PackageHashAlgorithm     string          `json:"packageHashAlgorithm"`
+			PackageSize              int             `json:"packageSize"`
+			DependencyGroups         []struct {
+				TargetFramework string `json:"targetFramework"`
+				Dependencies    []struct {
+					ID    string `json:"id"`
+					Range string `json:"range"`
+				} `json:"dependencies"`
+			} `json:"dependencyGroups"`
+		} `json:"catalogEntry"`
+	} `json:"items"`
+}
+
+func (uf *upstreamFeed) packagesV3(id string) ([]*upstreamPackage, error) {
+
+	// Get the registration index, an unknown ID is a 404
+	var ri struct {
+		Items []*upstreamRegistrationPage `json:"items"`
+	}
+	err := uf.getJSON(uf.registrationsBaseURL+strings.ToLower(id)+"/index.json", &ri)
+	if ue, ok := err.(*UpstreamError); ok && ue.Status == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var packages []*upstreamPackage
+	for _, page := range ri.Items {
+
+		// Fetch pages that aren't inlined
+		if page.Items == nil {
+			if err := uf.getJSON(page.ID, page); err != nil {
+				return nil, err
+			}
+		}
+
+		// Convert the leaves
+		for _, leaf := range page.Items {
+			ce := leaf.CatalogEntry
+			m := &upstreamMetadata{
+				ID:                       ce.ID,
+				Version:                  ce.Version,
+				Title:                    ce.Title,
+				Description:              ce.Description,
+				Summary:                  ce.Summary,
+				Authors:                  strings.Join(ce.Authors, ", "),
+				IconURL:                  ce.IconURL,
+				LicenseURL:               ce.LicenseURL,
+				LicenseExpression:        ce.LicenseExpression,
+				ProjectURL:               ce.ProjectURL,
+				Tags:                     strings.Join(ce.Tags, " "),
+				Language:                 ce.Language,
+				MinClientVersion:         ce.MinClientVersion,
+				RequireLicenseAcceptance: ce.RequireLicenseAcceptance,
+				Published:                ce.Published,
+				Listed:                   (ce.Listed == nil || *ce.Listed) && !strings.HasPrefix(ce.Published, "1900"),
+				PackageSize:              ce.PackageSize,
+			}
+			for _, g := range ce.DependencyGroups {
+				dg := nuspecDependencyGroup{TargetFramework: g.TargetFramework}
+				for _, d := range g.Dependencies {
+					dg.Dependency = append(dg.Dependency, nuspecDependency{ID: d.ID, Version: d.Range})
+				}
+				m.Dependencies = append(m.Dependencies, dg)
+			}
+			if !strings.EqualFold(m.ID, id) || m.Version == "" {
+				continue
+			}
+			// The flat container is the canonical download location
+			lid, lver := strings.ToLower(m.ID), strings.ToLower(normalizeVersion(m.Version))
+			p := &upstreamPackage{
+				ID:            m.ID,
+				Version:       m.Version,
+				ContentURL:    uf.packageBaseURL + lid + "/" + lver + "/" + lid + "." + lver + ".nupkg",
+				Hash:          ce.PackageHash,
+				HashAlgorithm: ce.PackageHashAlgorithm,
+				CatalogURL:    ce.CatalogURL,
+				Entry:         m.Entry(),
+			}
+			packages = append(packages, p)
+		}
+	}
+
+	return packages, nil
+}
+
+// upstreamMetadata is the metadata of an upstream package, gathered from either kind of feed
+type upstreamMetadata struct {
+	ID                       string
+	Version                  string
+	Title                    string
+	Description              string
+	Summary                  string
+	Authors                  string
+	Copyright                string
+	IconURL                  string
+	LicenseURL               string
+	LicenseExpression        string
+	ProjectURL               string
+	ReleaseNotes             string
+	Tags                     string
+	Language                 string
+	MinClientVersion         string
+	RequireLicenseAcceptance bool
+	Created                  string
+	Published                string
+	Listed                   bool
+	Dependencies             []nuspecDependencyGroup
+	PackageSize              int
+}
+
+// Entry returns a feed entry for an upstream package, built as if from its nuspec
+func (m *upstreamMetadata) Entry() *NugetPackageEntry {
+
+	// Fill in a nuspec
+	nsf := nuspec.New()
+	nsf.Meta.ID = m.ID
+	nsf.Meta.Version = m.Version
+	nsf.Meta.Title = m.Title
+	nsf.Meta.Authors = m.Authors
+	nsf.Meta.LicenseURL = m.LicenseURL
+	if m.LicenseExpression != "" {
+		nsf.Meta.License.Type = "expression"
+		nsf.Meta.License.Text = m.LicenseExpression
+	}
+	nsf.Meta.ProjectURL = m.ProjectURL
+	nsf.Meta.IconURL = m.IconURL
+	nsf.Meta.ReqLicenseAccept = m.RequireLicenseAcceptance
+	nsf.Meta.Description = m.Description
+	nsf.Meta.ReleaseNotes = m.ReleaseNotes
+	nsf.Meta.Copyright = m.Copyright
+	nsf.Meta.Summary = m.Summary
+	nsf.Meta.Language = m.Language
+	nsf.Meta.Tags = m.Tags
+	ne := &nuspecExtra{}
+	ne.Meta.MinClientVersion = m.MinClientVersion
+	ne.Meta.Dependencies.Group = m.Dependencies
+
+	// Build the entry, frameworks are only known from the dependency groups until the package is cached
+	e := NewNugetPackageEntry(nsf, ne)
+	e.Properties.Frameworks = packageFrameworks(nil, ne)
+	e.Properties.PackageSize.Value = m.PackageSize
+	e.Properties.PackageSize.Type = "Edm.Int64"
+
+	// Keep the upstream dates, the feed needs them in Zulu time
+	published := upstreamTime(m.Published)
+	created := upstreamTime(m.Created)
+	if created == "" {
+		created = published
+	}
+	e.Properties.Created.Value = created
+	e.Properties.LastEdited.Value = created
+	e.Updated = created
+	e.SetListed(m.Listed)
+
+	return e
+}
+
+// v2DependencyGroups converts a V2 dependency string (id:range:framework|...) into nuspec dependency groups
+func v2DependencyGroups(deps string) []nuspecDependencyGroup {
+	var groups []nuspecDependencyGroup
+	for _, g := range parseV2Dependencies(deps, "") {
+		dg := nuspecDependencyGroup{TargetFramework: g.TargetFramework}
+		for _, d := range g.Dependencies {
+			dg.Dependency = append(dg.Dependency, nuspecDependency{ID: d.PackageID, Version: d.Range})
+		}
+		groups = append(groups, dg)
+	}
+	return groups
+}
+
+// upstreamTime converts a feed's timestamp to Zulu time, V2 feeds leave out the zone
+func upstreamTime(s string) string {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(zuluTimeLayout)
+		}
+	}
+	return ""
+}
+
+// getJSON requests a URL from the feed and decodes the response into v
+func (uf *upstreamFeed) getJSON(u string, v interface{}) error {
+	resp, err := uf.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return &UpstreamError{"Unexpected status " + resp.Status + " from " + u, resp.StatusCode}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// resolve returns a link from a feed as an absolute URL
+func (uf *upstreamFeed) resolve(base string, link string) string {
+	b, err := url.Parse(base)
+	if err != nil {
+		return link
+	}
+	l, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	return b.ResolveReference(l).String()
+}
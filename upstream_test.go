@@ -0,0 +1,399 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testPackage returns a .nupkg holding only a nuspec for an ID and version
+func testPackage(id string, ver string) []byte {
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	w, _ := zw.Create(id + ".nuspec")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<package xmlns="http://schemas.microsoft.com/packaging/2013/05/nuspec.xsd">
+  <metadata>
+    <id>%s</id>
+    <version>%s</version>
+    <authors>Test</authors>
+    <description>Test package</description>
+  </metadata>
+</package>`, id, ver)
+	zw.Close()
+	return b.Bytes()
+}
+
+// testFeedPackage is a version served by a test feed
+type testFeedPackage struct {
+	ID       string
+	Version  string
+	Nupkg    []byte
+	Hash     string // Base64 SHA512 of the package unless changed
+	Unlisted bool
+}
+
+// testFeed serves packages as a V2 feed under /v2/ and a V3 feed from /v3/index.json, as nuget.org does the
+// V3 registrations leave out the hash and link to the catalog leaf holding it
+type testFeed struct {
+	*httptest.Server
+	packages []*testFeedPackage
+	requests map[string]int // Requests by path
+	down     bool           // Fail every request
+	mutex    sync.Mutex
+}
+
+// newTestFeed starts a feed serving the given versions, each an ID and version pair
+func newTestFeed(versions ...string) *testFeed {
+	tf := &testFeed{requests: make(map[string]int)}
+	for i := 0; i+1 < len(versions); i += 2 {
+		tf.Add(versions[i], versions[i+1])
+	}
+	tf.Server = httptest.NewServer(http.HandlerFunc(tf.serve))
+	return tf
+}
+
+// Add adds a version to the feed, returning it so it can be changed
+func (tf *testFeed) Add(id string, ver string) *testFeedPackage {
+	nupkg := testPackage(id, ver)
+	sum := sha512.Sum512(nupkg)
+	p := &testFeedPackage{ID: id, Version: ver, Nupkg: nupkg, Hash: base64.StdEncoding.EncodeToString(sum[:])}
+	tf.mutex.Lock()
+	tf.packages = append(tf.packages, p)
+	tf.mutex.Unlock()
+	return p
+}
+
+// Requests returns the number of requests made for a path
+func (tf *testFeed) Requests(p string) int {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	return tf.requests[p]
+}
+
+// SetDown makes the feed fail every request, or serve them again
+func (tf *testFeed) SetDown(down bool) {
+	tf.mutex.Lock()
+	tf.down = down
+	tf.mutex.Unlock()
+}
+
+// find returns the versions of an ID
+func (tf *testFeed) find(id string) []*testFeedPackage {
+	var found []*testFeedPackage
+	for _, p := range tf.packages {
+		if strings.EqualFold(p.ID, id) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func (tf *testFeed) serve(w http.ResponseWriter, r *http.Request) {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	tf.requests[r.URL.Path]++
+	if tf.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/v2/FindPackagesById()":
+		tf.serveV2(w, r)
+	case parts[0] == "v2" && len(parts) == 4 && parts[1] == "package":
+		tf.serveNupkg(w, parts[2], parts[3])
+	case r.URL.Path == "/v3/index.json":
+		tf.writeJSON(w, map[string]interface{}{"version": "3.0.0", "resources": []map[string]string{
+			{"@id": tf.URL + "/v3/flat/", "@type": "PackageBaseAddress/3.0.0"},
+			{"@id": tf.URL + "/v3/registration-old/", "@type": "RegistrationsBaseUrl"},
+			{"@id": tf.URL + "/v3/registration/", "@type": "RegistrationsBaseUrl/3.6.0"},
+		}})
+	case parts[0] == "v3" && len(parts) == 4 && parts[1] == "registration":
+		tf.serveRegistration(w, parts[2], parts[3])
+	case parts[0] == "v3" && len(parts) == 3 && parts[1] == "catalog":
+		tf.serveCatalogLeaf(w, parts[2])
+	case parts[0] == "v3" && len(parts) == 5 && parts[1] == "flat" && parts[4] == parts[2]+"."+parts[3]+".nupkg":
+		tf.serveNupkg(w, parts[2], parts[3])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveV2 serves FindPackagesById one version per page, to follow the next links
+func (tf *testFeed) serveV2(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	found := tf.find(strings.Trim(q.Get("id"), "'"))
+	skip, _ := strconv.Atoi(q.Get("$skip"))
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="utf-8"?>
+<feed xml:base="` + tf.URL + `/v2/" xmlns="http://www.w3.org/2005/Atom" xmlns:d="http://schemas.microsoft.com/ado/2007/08/dataservices" xmlns:m="http://schemas.microsoft.com/ado/2007/08/dataservices/metadata">`)
+	if skip < len(found) {
+		p := found[skip]
+		published := "2020-01-02T03:04:05.123"
+		if p.Unlisted {
+			published = "1900-01-01T00:00:00"
+		}
+		fmt.Fprintf(&b, `<entry><title type="text">%s</title><content type="application/zip" src="package/%s/%s"/>`, p.ID, p.ID, p.Version)
+		fmt.Fprintf(&b, `<m:properties><d:Version>%s</d:Version><d:Description>From V2</d:Description><d:Published m:type="Edm.DateTime">%s</d:Published>`, p.Version, published)
+		fmt.Fprintf(&b, `<d:PackageHash>%s</d:PackageHash><d:PackageHashAlgorithm>SHA512</d:PackageHashAlgorithm></m:properties></entry>`, p.Hash)
+	}
+	if skip+1 < len(found) {
+		next := "FindPackagesById()?id=" + url.QueryEscape(q.Get("id")) + "&$skip=" + strconv.Itoa(skip+1)
+		fmt.Fprintf(&b, `<link rel="next" href="%s"/>`, strings.Replace(next, "&", "&amp;", -1))
+	}
+	b.WriteString(`</feed>`)
+	w.Header().Set("Content-Type", "application/atom+xml")
+	w.Write([]byte(b.String()))
+}
+
+// serveRegistration serves a registration index with the first version inlined and the rest on a second page
+func (tf *testFeed) serveRegistration(w http.ResponseWriter, id string, page string) {
+	found := tf.find(id)
+	if len(found) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	leaves := []map[string]interface{}{}
+	for _, p := range found {
+		lid, lver := strings.ToLower(p.ID), strings.ToLower(normalizeVersion(p.Version))
+		leaves = append(leaves, map[string]interface{}{
+			"packageContent": tf.URL + "/v3/flat/" + lid + "/" + lver + "/" + lid + "." + lver + ".nupkg",
+			"catalogEntry": map[string]interface{}{
+				"@id":         tf.URL + "/v3/catalog/" + lid + "." + lver + ".json",
+				"id":          p.ID,
+				"version":     p.Version,
+				"description": "From V3",
+				"listed":      !p.Unlisted,
+				"published":   "2020-01-02T03:04:05.123+00:00",
+			},
+		})
+	}
+	pageURL := tf.URL + "/v3/registration/" + id + "/page2.json"
+	switch page {
+	case "index.json":
+		items := []map[string]interface{}{{"@id": tf.URL + "/v3/registration/" + id + "/index.json#page1", "items": leaves[:1]}}
+		if len(leaves) > 1 {
+			items = append(items, map[string]interface{}{"@id": pageURL})
+		}
+		tf.writeJSON(w, map[string]interface{}{"count": len(items), "items": items})
+	case "page2.json":
+		tf.writeJSON(w, map[string]interface{}{"@id": pageURL, "items": leaves[1:]})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// serveCatalogLeaf serves the catalog leaf of a version, named by its lowercase ID and normalized version
+func (tf *testFeed) serveCatalogLeaf(w http.ResponseWriter, name string) {
+	for _, p := range tf.packages {
+		if name == strings.ToLower(p.ID+"."+normalizeVersion(p.Version)+".json") {
+			tf.writeJSON(w, map[string]interface{}{"id": p.ID, "version": p.Version, "packageHash": p.Hash, "packageHashAlgorithm": "SHA512"})
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// serveNupkg serves a version's package from either feed
+func (tf *testFeed) serveNupkg(w http.ResponseWriter, id string, ver string) {
+	for _, p := range tf.find(id) {
+		if sameVersion(p.Version, ver) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(p.Nupkg)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (tf *testFeed) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// testFeedServer sets the global server used to build feed entries
+func testFeedServer() {
+	server = &Server{config: &Config{MaxPackageSizeMB: 1, DefaultLanguage: "en-US"}, URL: &url.URL{Scheme: "https", Host: "nuget.example.com", Path: "/feed/"}}
+}
+
+func TestUpstreamFeed(t *testing.T) {
+	testFeedServer()
+	tf := newTestFeed("Test.Pkg", "1.0", "Test.Pkg", "2.0.0-beta.1+build", "Other.Pkg", "1.0.0")
+	defer tf.Close()
+	tf.packages[1].Unlisted = true
+
+	for _, source := range []string{tf.URL + "/v2", tf.URL + "/v3/index.json"} {
+		uf, err := newUpstreamFeed(source)
+		if err != nil {
+			t.Errorf("%s: error: %v", source, err)
+			continue
+		}
+
+		// Every version of the ID is listed, with the listing and metadata of the feed
+		packages, err := uf.Packages("test.pkg")
+		if err != nil {
+			t.Errorf("%s: Packages error: %v", source, err)
+			continue
+		}
+		if len(packages) != 2 {
+			t.Errorf("%s: Packages gave %d versions, want 2", source, len(packages))
+			continue
+		}
+		for i, p := range packages {
+			want := tf.packages[i]
+			if p.ID != want.ID || p.Version != want.Version {
+				t.Errorf("%s: package %d is %s %s, want %s %s", source, i, p.ID, p.Version, want.ID, want.Version)
+			}
+			// V2 feeds list the hash, V3 registrations link to the catalog leaf holding it
+			if p.Hash != want.Hash && (p.Hash != "" || p.CatalogURL == "") {
+				t.Errorf("%s: package %d hash %q catalog %q", source, i, p.Hash, p.CatalogURL)
+			}
+			if p.Entry.IsListed() == want.Unlisted {
+				t.Errorf("%s: package %d listed %v, want %v", source, i, p.Entry.IsListed(), !want.Unlisted)
+			}
+			if !want.Unlisted && p.Entry.Properties.Created.Value != "2020-01-02T03:04:05Z" {
+				t.Errorf("%s: package %d created %q", source, i, p.Entry.Properties.Created.Value)
+			}
+		}
+
+		// Unknown IDs have no versions
+		if none, err := uf.Packages("Missing.Pkg"); err != nil || len(none) != 0 {
+			t.Errorf("%s: Packages of an unknown ID gave %d, %v", source, len(none), err)
+		}
+
+		// Downloads are checked against the feed
+		hash := tf.packages[0].Hash
+		tests := []struct {
+			name string
+			max  int64
+			hash string
+			ver  string
+			ok   bool
+		}{
+			{"download", 1 << 20, hash, packages[0].Version, true},
+			{"hex hash", 1 << 20, func() string { b, _ := base64.StdEncoding.DecodeString(hash); return fmt.Sprintf("%x", b) }(), packages[0].Version, true},
+			{"too large", 10, hash, packages[0].Version, false},
+			{"hash mismatch", 1 << 20, tf.packages[2].Hash, packages[0].Version, false},
+			{"version mismatch", 1 << 20, hash, "3.0.0", false},
+		}
+		for _, tt := range tests {
+			p := *packages[0]
+			p.Hash, p.Version = tt.hash, tt.ver
+			tmp, verified, err := uf.Download(&p, tt.max)
+			if tmp != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+			}
+			if tt.ok && err == nil && !verified {
+				t.Errorf("%s: %s: not verified", source, tt.name)
+			}
+			if tt.ok && err != nil {
+				t.Errorf("%s: %s: error: %v", source, tt.name, err)
+			} else if !tt.ok && err == nil {
+				t.Errorf("%s: %s: expected an error", source, tt.name)
+			}
+		}
+
+		// Missing packages are an error
+		p := *packages[0]
+		p.ContentURL += ".missing"
+		if _, _, err := uf.Download(&p, 1<<20); err == nil {
+			t.Errorf("%s: download of a missing package: expected an error", source)
+		}
+	}
+}
+
+func TestUpstreamFeedCatalogHash(t *testing.T) {
+	testFeedServer()
+	tf := newTestFeed("Test.Pkg", "1.0.0", "Test.Pkg", "2.0.0")
+	defer tf.Close()
+	tf.packages[1].Hash = tf.packages[0].Hash
+
+	uf, err := newUpstreamFeed(tf.URL + "/v3/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packages, err := uf.Packages("Test.Pkg")
+	if err != nil || len(packages) != 2 {
+		t.Fatalf("Packages gave %d versions, %v", len(packages), err)
+	}
+
+	// The hash is looked up in the catalog leaf, packages without one or with no leaf are unverified
+	tests := []struct {
+		name     string
+		p        upstreamPackage
+		catalog  string
+		verified bool
+		ok       bool
+	}{
+		{"catalog", *packages[0], packages[0].CatalogURL, true, true},
+		{"catalog mismatch", *packages[1], packages[1].CatalogURL, false, false},
+		{"no catalog leaf", *packages[0], packages[0].CatalogURL + ".missing", false, true},
+		{"no catalog", *packages[0], "", false, true},
+	}
+	for _, tt := range tests {
+		tt.p.CatalogURL = tt.catalog
+		tmp, verified, err := uf.Download(&tt.p, 1<<20)
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+		if tt.ok && err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		} else if verified != tt.verified {
+			t.Errorf("%s: verified %v, want %v", tt.name, verified, tt.verified)
+		}
+	}
+
+	// The listed package is left as it was
+	if packages[0].Hash != "" {
+		t.Errorf("catalog hash stored in the listing")
+	}
+
+	// Catalogs that can't be read fail the download
+	tf.SetDown(true)
+	if _, _, err := uf.Download(packages[0], 1<<20); err == nil {
+		t.Errorf("catalog down: expected an error")
+	}
+}
+
+func TestUpstreamFeedServiceIndex(t *testing.T) {
+	tf := newTestFeed()
+	defer tf.Close()
+
+	// The newest registrations are preferred
+	uf, err := newUpstreamFeed(tf.URL + "/v3/index.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uf.registrationsBaseURL != tf.URL+"/v3/registration/" || uf.packageBaseURL != tf.URL+"/v3/flat/" {
+		t.Errorf("service index gave %s and %s", uf.registrationsBaseURL, uf.packageBaseURL)
+	}
+
+	// Indexes without the resources, or that can't be read, are an error
+	for _, u := range []string{tf.URL + "/v2/FindPackagesById()?x=.json", tf.URL + "/missing.json"} {
+		if _, err := newUpstreamFeed(u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+	tf.SetDown(true)
+	if _, err := newUpstreamFeed(tf.URL + "/v3/index.json"); err == nil {
+		t.Errorf("feed down: expected an error")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NugetVersion is a parsed NuGet version (SemVer 2.0 with an optional fourth revision part)
+type NugetVersion struct {
+	Parts    []int
+	Release  []string
+	Metadata string
+}
+
+// ParseNugetVersion parses a version string such as 1.02.3.0-beta.1+abc
+func ParseNugetVersion(s string) (*NugetVersion, error) {
+
+	v := NugetVersion{}
+	s = strings.TrimSpace(s)
+
+	// Split off build metadata
+	if i := strings.Index(s, "+"); i >= 0 {
+		v.Metadata = s[i+1:]
+		s = s[:i]
+		for _, l := range strings.Split(v.Metadata, ".") {
+			if !isVersionLabel(l) {
+				return nil, &VersionError{"Invalid version: bad build metadata '" + v.Metadata + "'"}
+			}
+		}
+	}
+
+	// Split off prerelease labels
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Release = strings.Split(s[i+1:], ".")
+		s = s[:i]
+		for _, l := range v.Release {
+			if !isVersionLabel(l) {
+				return nil, &VersionError{"Invalid version: bad prerelease label '" + l + "'"}
+			}
+		}
+	}
+
+	// Read between one and four numeric parts
+	x := strings.Split(s, ".")
+	if len(x) > 4 {
+		return nil, &VersionError{"Invalid version: too many parts in '" + s + "'"}
+	}
+	for _, p := range x {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || strings.HasPrefix(p, "+") || strings.HasPrefix(p, "-") {
+			return nil, &VersionError{"Invalid version: bad number '" + p + "'"}
+		}
+		v.Parts = append(v.Parts, n)
+	}
+	for len(v.Parts) < 3 {
+		v.Parts = append(v.Parts, 0)
+	}
+
+	return &v, nil
+}
+
+// isVersionLabel returns true for a non empty label of alphanumerics and hyphens
+func isVersionLabel(l string) bool {
+	if l == "" {
+		return false
+	}
+	for _, c := range l {
+		if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the normalized form, without leading zeros, a zero revision or build metadata
+func (v *NugetVersion) String() string {
+	var sb strings.Builder
+	parts := v.Parts
+	if len(parts) == 4 && parts[3] == 0 {
+		parts = parts[:3]
+	}
+	for i, p := range parts {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(strconv.Itoa(p))
+	}
+	if len(v.Release) > 0 {
+		sb.WriteByte('-')
+		sb.WriteString(strings.Join(v.Release, "."))
+	}
+	return sb.String()
+}
+
+// FullString returns the normalized form including any build metadata
+func (v *NugetVersion) FullString() string {
+	if v.Metadata != "" {
+		return v.String() + "+" + v.Metadata
+	}
+	return v.String()
+}
+
+// IsPrerelease returns true if the version has prerelease labels
+func (v *NugetVersion) IsPrerelease() bool {
+	return len(v.Release) > 0
+}
+
+// IsSemVer2 returns true if the version can only be understood by SemVer 2.0 aware clients
+func (v *NugetVersion) IsSemVer2() bool {
+	return len(v.Release) > 1 || v.Metadata != ""
+}
+
+// Compare compares two versions, returning -1, 0 or 1, build metadata takes no part in ordering
+func (v *NugetVersion) Compare(o *NugetVersion) int {
+
+	// Compare numeric parts, missing parts count as zero
+	for i := 0; i < len(v.Parts) || i < len(o.Parts); i++ {
+		var x, y int
+		if i < len(v.Parts) {
+			x = v.Parts[i]
+		}
+		if i < len(o.Parts) {
+			y = o.Parts[i]
+		}
+		if x != y {
+			return compareInts(x, y)
+		}
+	}
+
+	// A release is higher than any prerelease of the same version
+	switch {
+	case len(v.Release) == 0 && len(o.Release) == 0:
+		return 0
+	case len(v.Release) == 0:
+		return 1
+	case len(o.Release) == 0:
+		return -1
+	}
+
+	// Compare prerelease labels identifier by identifier
+	for i := 0; i < len(v.Release) && i < len(o.Release); i++ {
+		x, xerr := strconv.Atoi(v.Release[i])
+		y, yerr := strconv.Atoi(o.Release[i])
+		switch {
+		case xerr == nil && yerr == nil:
+			if x != y {
+				return compareInts(x, y)
+			}
+		case xerr == nil:
+			// Numeric identifiers are lower than alphanumeric
+			return -1
+		case yerr == nil:
+			return 1
+		default:
+			// Nuget compares labels case insensitively
+			if c := strings.Compare(strings.ToLower(v.Release[i]), strings.ToLower(o.Release[i])); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInts(len(v.Release), len(o.Release))
+}
+
+// compareVersions compares two version strings, returning -1, 0 or 1, unparsable versions sort
+// below valid ones and amongst themselves by case insensitive string comparison
+func compareVersions(a string, b string) int {
+	va, aerr := ParseNugetVersion(a)
+	vb, berr := ParseNugetVersion(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return va.Compare(vb)
+	case aerr == nil:
+		return 1
+	case berr == nil:
+		return -1
+	}
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
+
+// normalizeVersion returns the normalized form of a version string, or the string unchanged if invalid
+func normalizeVersion(s string) string {
+	v, err := ParseNugetVersion(s)
+	if err != nil {
+		return s
+	}
+	return v.String()
+}
+
+// sameVersion returns true if two version strings are equal once normalized
+func sameVersion(a string, b string) bool {
+	return strings.EqualFold(normalizeVersion(a), normalizeVersion(b))
+}
+
+func compareInts(x int, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// isPrereleaseVersion returns true if the version string carries a prerelease label
+func isPrereleaseVersion(v string) bool {
+	nv, err := ParseNugetVersion(v)
+	if err != nil {
+		return strings.Contains(strings.SplitN(v, "+", 2)[0], "-")
+	}
+	return nv.IsPrerelease()
+}
+
+// isSemVer2Version returns true if the version string is only valid for SemVer 2.0 clients
+func isSemVer2Version(v string) bool {
+	nv, err := ParseNugetVersion(v)
+	return err == nil && nv.IsSemVer2()
+}
+
+// allowsSemVer2 returns true if a semVerLevel query parameter asks for SemVer 2.0 packages
+func allowsSemVer2(level string) bool {
+	v, err := ParseNugetVersion(level)
+	return err == nil && v.Parts[0] >= 2
+}
+
+// versionRange is a NuGet version range such as 1.0, [1.0,2.0) or (,3.0]
+type versionRange struct {
+	min          string
+	max          string
+	minInclusive bool
+	maxInclusive bool
+}
+
+// parseVersionRange parses NuGet version range notation, an empty string allows any version
+func parseVersionRange(s string) (*versionRange, error) {
+
+	s = strings.TrimSpace(s)
+	vr := versionRange{}
+	if s == "" {
+		return &vr, nil
+	}
+
+	// A bare version is a minimum inclusive bound
+	if !strings.HasPrefix(s, "[") && !strings.HasPrefix(s, "(") {
+		vr.min = s
+		vr.minInclusive = true
+		return &vr, nil
+	}
+
+	// Check the brackets
+	if len(s) < 3 || !strings.HasSuffix(s, "]") && !strings.HasSuffix(s, ")") {
+		return nil, &VersionError{"Invalid version range: " + s}
+	}
+	vr.minInclusive = s[0] == '['
+	vr.maxInclusive = s[len(s)-1] == ']'
+	bounds := strings.Split(s[1:len(s)-1], ",")
+
+	switch len(bounds) {
+	case 1:
+		// Exact version
+		if !vr.minInclusive || !vr.maxInclusive || strings.TrimSpace(bounds[0]) == "" {
+			return nil, &VersionError{"Invalid version range: " + s}
+		}
+		vr.min = strings.TrimSpace(bounds[0])
+		vr.max = vr.min
+	case 2:
+		vr.min = strings.TrimSpace(bounds[0])
+		vr.max = strings.TrimSpace(bounds[1])
+		if vr.min == "" && vr.max == "" {
+			return nil, &VersionError{"Invalid version range: " + s}
+		}
+	default:
+		return nil, &VersionError{"Invalid version range: " + s}
+	}
+
+	return &vr, nil
+}
+
+// Satisfies returns true if the version falls within the range
+func (vr *versionRange) Satisfies(v string) bool {
+	if vr.min != "" {
+		c := compareVersions(v, vr.min)
+		if c < 0 || (c == 0 && !vr.minInclusive) {
+			return false
+		}
+	}
+	if vr.max != "" {
+		c := compareVersions(v, vr.max)
+		if c > 0 || (c == 0 && !vr.maxInclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// VersionError is returned when a version or version range can't be parsed
+type VersionError struct {
+	ErrorString string
+}
+
+func (ve *VersionError) Error() string {
+	return ve.ErrorString
+}
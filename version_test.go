@@ -0,0 +1,173 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeVersion(t *testing.T) {
+	tests := []struct {
+		ver  string
+		norm string
+	}{
+		{"1.0.0", "1.0.0"},
+		{"1.0", "1.0.0"},
+		{"1", "1.0.0"},
+		{"1.0.0.0", "1.0.0"},
+		{"1.0.0.1", "1.0.0.1"},
+		{"01.002.0003", "1.2.3"},
+		{"1.0.0-beta", "1.0.0-beta"},
+		{"1.0-Beta.1", "1.0.0-Beta.1"},
+		{"1.0.0+build.5", "1.0.0"},
+		{"1.0.0.0-rc+abc", "1.0.0-rc"},
+		{" 2.1 ", "2.1.0"},
+		// Invalid versions are left as they are
+		{"1.0.0.0.0", "1.0.0.0.0"},
+		{"one", "one"},
+		{"1.0.0-", "1.0.0-"},
+		{"1.0.0-beta..1", "1.0.0-beta..1"},
+		{"1.0.0+", "1.0.0+"},
+	}
+	for _, tt := range tests {
+		if n := normalizeVersion(tt.ver); n != tt.norm {
+			t.Errorf("normalizeVersion(%q) = %q, want %q", tt.ver, n, tt.norm)
+		}
+	}
+}
+
+func TestParseNugetVersion(t *testing.T) {
+	tests := []struct {
+		ver        string
+		full       string
+		prerelease bool
+		semVer2    bool
+	}{
+		{"1.0.0", "1.0.0", false, false},
+		{"1.0.0-beta", "1.0.0-beta", true, false},
+		{"1.0.0-beta.1", "1.0.0-beta.1", true, true},
+		{"1.0.0+abc", "1.0.0+abc", false, true},
+		{"1.0.0.0-beta+abc", "1.0.0-beta+abc", true, true},
+	}
+	for _, tt := range tests {
+		v, err := ParseNugetVersion(tt.ver)
+		if err != nil {
+			t.Errorf("ParseNugetVersion(%q) error: %v", tt.ver, err)
+			continue
+		}
+		if v.FullString() != tt.full || v.IsPrerelease() != tt.prerelease || v.IsSemVer2() != tt.semVer2 {
+			t.Errorf("ParseNugetVersion(%q) = %q prerelease %v semVer2 %v, want %q %v %v",
+				tt.ver, v.FullString(), v.IsPrerelease(), v.IsSemVer2(), tt.full, tt.prerelease, tt.semVer2)
+		}
+	}
+	for _, ver := range []string{"", "a.b", "1.-1.0", "1.+1.0", "1.0.0-be_ta", "1.2.3.4.5", "1.0.0+", "1.0.0+../x"} {
+		if _, err := ParseNugetVersion(ver); err == nil {
+			t.Errorf("ParseNugetVersion(%q) expected an error", ver)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a string
+		b string
+		c int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0.0", 0},
+		{"1.9.0", "1.10.0", -1},
+		{"2.0.0", "1.10.0", 1},
+		{"1.0.0.1", "1.0.0", 1},
+		{"1.0.0-beta", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-Beta", "1.0.0-beta", 0},
+		{"1.0.0-beta.2", "1.0.0-beta.10", -1},
+		{"1.0.0-beta", "1.0.0-beta.1", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+		{"1.0.0+a", "1.0.0+b", 0},
+		// Invalid versions sort below valid ones
+		{"junk", "0.0.1", -1},
+		{"0.0.1", "junk", 1},
+		{"Junk", "junk", 0},
+	}
+	for _, tt := range tests {
+		if c := compareVersions(tt.a, tt.b); c != tt.c {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, c, tt.c)
+		}
+	}
+}
+
+func TestSameVersion(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		same bool
+	}{
+		{"1.0", "1.0.0", true},
+		{"1.0.0.0", "1.0.0", true},
+		{"1.0.0-RC", "1.0.0-rc", true},
+		{"1.0.0+abc", "1.0.0", true},
+		{"1.0.1", "1.0.0", false},
+		{"1.0.0-rc", "1.0.0", false},
+	}
+	for _, tt := range tests {
+		if s := sameVersion(tt.a, tt.b); s != tt.same {
+			t.Errorf("sameVersion(%q, %q) = %v, want %v", tt.a, tt.b, s, tt.same)
+		}
+	}
+}
+
+func TestVersionRange(t *testing.T) {
+	tests := []struct {
+		vr  string
+		ver string
+		in  bool
+	}{
+		{"", "0.0.1", true},
+		{"1.0", "1.0.0", true},
+		{"1.0", "0.9.0", false},
+		{"1.0", "5.0.0", true},
+		{"[1.0]", "1.0.0", true},
+		{"[1.0]", "1.0.1", false},
+		{"[1.0,2.0)", "1.5.0", true},
+		{"[1.0,2.0)", "2.0.0", false},
+		{"[1.0,2.0)", "2.0.0-beta", true},
+		{"(1.0,2.0]", "1.0.0", false},
+		{"(1.0,2.0]", "2.0.0", true},
+		{"(,3.0]", "0.1.0", true},
+		{"(,3.0]", "3.0.1", false},
+		{"(1.0,)", "1.0.0", false},
+		{"(1.0,)", "99.0.0", true},
+		{"[1.0, 2.0]", "2.0.0", true},
+	}
+	for _, tt := range tests {
+		vr, err := parseVersionRange(tt.vr)
+		if err != nil {
+			t.Errorf("parseVersionRange(%q) error: %v", tt.vr, err)
+			continue
+		}
+		if in := vr.Satisfies(tt.ver); in != tt.in {
+			t.Errorf("parseVersionRange(%q).Satisfies(%q) = %v, want %v", tt.vr, tt.ver, in, tt.in)
+		}
+	}
+	for _, s := range []string{"[", "[]", "(1.0)", "[1.0", "(,)", "[1.0,2.0,3.0]"} {
+		if _, err := parseVersionRange(s); err == nil {
+			t.Errorf("parseVersionRange(%q) expected an error", s)
+		}
+	}
+}
+
+func TestPackageStoreFile(t *testing.T) {
+	tests := []struct {
+		id   string
+		ver  string
+		ext  string
+		path string
+	}{
+		{"Pkg", "1.0", ".nupkg", "Pkg/1.0.0/Pkg.1.0.0.nupkg"},
+		{"Pkg", "1.0.0.0-Beta+abc", ".snupkg", "Pkg/1.0.0-Beta/Pkg.1.0.0-Beta.snupkg"},
+	}
+	for _, tt := range tests {
+		if p := packageStoreFile(tt.id, tt.ver, tt.ext); p != tt.path {
+			t.Errorf("packageStoreFile(%q, %q, %q) = %q, want %q", tt.id, tt.ver, tt.ext, p, tt.path)
+		}
+	}
+}